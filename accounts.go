@@ -0,0 +1,114 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"os"
+	"sync"
+)
+
+// An AccountStore holds the local users registered on a server.
+type AccountStore interface {
+	GetAccount([]byte) *pb.Account
+	PutAccount(*pb.Account) error
+	RemoveAccount([]byte) error
+	ListAccounts() []*pb.Account
+}
+
+// An InMemoryAccountStore keeps accounts in memory. If SrcPath is set, the
+// whole set is rewritten to that file on every change.
+type InMemoryAccountStore struct {
+	accounts map[string]*pb.Account
+	SrcPath  string
+	lck      *sync.Mutex
+}
+
+func NewInMemoryAccountStore() *InMemoryAccountStore {
+	return &InMemoryAccountStore{make(map[string]*pb.Account), "", &sync.Mutex{}}
+}
+
+func MakeFileAccountStore(path string) (*InMemoryAccountStore, error) {
+	s := NewInMemoryAccountStore()
+	s.SrcPath = path
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	lst := &pb.AccountList{}
+	if err := proto.Unmarshal(LoadBytes(fh), lst); err != nil {
+		return nil, err
+	}
+	for _, a := range lst.Accounts {
+		s.accounts[IdentToString(a.Ident.Ident)] = a
+	}
+	return s, nil
+}
+
+func (s *InMemoryAccountStore) saveNotThreadSafe() error {
+	if len(s.SrcPath) == 0 {
+		return nil
+	}
+	lst := &pb.AccountList{}
+	for _, a := range s.accounts {
+		lst.Accounts = append(lst.Accounts, a)
+	}
+	bs, err := proto.Marshal(lst)
+	if err != nil {
+		return err
+	}
+	return WriteBytes(s.SrcPath, bs)
+}
+
+func (s *InMemoryAccountStore) GetAccount(ident []byte) *pb.Account {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.accounts[IdentToString(ident)]
+}
+
+func (s *InMemoryAccountStore) PutAccount(a *pb.Account) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.accounts[IdentToString(a.Ident.Ident)] = a
+	return s.saveNotThreadSafe()
+}
+
+func (s *InMemoryAccountStore) RemoveAccount(ident []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	k := IdentToString(ident)
+	if _, ok := s.accounts[k]; !ok {
+		return errors.New("No such account")
+	}
+	delete(s.accounts, k)
+	return s.saveNotThreadSafe()
+}
+
+func (s *InMemoryAccountStore) ListAccounts() []*pb.Account {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	lst := make([]*pb.Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		lst = append(lst, a)
+	}
+	return lst
+}
@@ -0,0 +1,369 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How far a signed request's timestamp may be from our clock, in seconds.
+	authWindow = 5 * 60
+)
+
+type GSDPAdminServer struct {
+	gsdp   *GSDPServer
+	admins []*pb.Identity
+	seen   map[string]int64 // Signatures used, by their request's time
+	lck    *sync.Mutex
+}
+
+type AdminClient struct {
+	admin LocalUser
+	conn  *grpc.ClientConn
+}
+
+func newAdminServer(gs *GSDPServer, admins []*pb.Identity) *GSDPAdminServer {
+	return &GSDPAdminServer{gs, admins, make(map[string]int64), &sync.Mutex{}}
+}
+
+// Without TLS, the admin service only listens on loopback.
+func listenAdmin(port string, certFile string, keyFile string) (net.Listener, []grpc.ServerOption, error) {
+	if len(certFile) == 0 {
+		host, p, err := net.SplitHostPort(port)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(host) == 0 {
+			host = "127.0.0.1"
+		} else if !isLoopbackHost(host) {
+			return nil, nil, errors.New("Admin service without TLS may only listen on loopback, not " + host)
+		}
+		lis, err := net.Listen("tcp", net.JoinHostPort(host, p))
+		return lis, nil, err
+	}
+	creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lis, []grpc.ServerOption{grpc.Creds(creds)}, nil
+}
+
+func signAdminRequest(req proto.Message, auth *pb.AdminAuth, admin LocalUser) error {
+	auth.AdminIdent = admin.Ident()
+	auth.Tstamp = time.Now().Unix()
+	auth.Nonce = NewMsgId()
+	return SignMessage(req, &auth.Signature, admin.PrivKey())
+}
+
+func inAuthWindow(tstamp int64) bool {
+	d := time.Now().Unix() - tstamp
+	return d <= authWindow && d >= -authWindow
+}
+
+func (s *GSDPAdminServer) authenticate(req proto.Message, auth *pb.AdminAuth) error {
+	if auth == nil {
+		return errors.New("Missing admin auth")
+	}
+	var admin *pb.Identity
+	for _, a := range s.admins {
+		if bytes.Equal(a.Ident, auth.AdminIdent) {
+			admin = a
+		}
+	}
+	if admin == nil {
+		return errors.New("Not an admin")
+	}
+	if !inAuthWindow(auth.Tstamp) {
+		return errors.New("Admin request timestamp out of range")
+	}
+	if err := VerifyMessage(req, &auth.Signature, admin); err != nil {
+		return errors.New("Bad admin signature")
+	}
+	return s.useSignature(auth)
+}
+
+// A signed request is only good once, or replaying it could undo what an
+// admin has done since, e.g. deregister a user who has registered again.
+// Signatures are forgotten once their timestamp is out of the window.
+func (s *GSDPAdminServer) useSignature(auth *pb.AdminAuth) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for k, t := range s.seen {
+		if !inAuthWindow(t) {
+			delete(s.seen, k)
+		}
+	}
+	k := string(auth.Signature)
+	if _, ok := s.seen[k]; ok {
+		return errors.New("Admin request replayed")
+	}
+	s.seen[k] = auth.Tstamp
+	return nil
+}
+
+func adminError(err error) *pb.AdminResponse {
+	return &pb.AdminResponse{true, err.Error()}
+}
+
+func (s *GSDPAdminServer) RegisterUser(ctx context.Context, in *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	if in.Ident == nil || !bytes.Equal(BytesToIdentHash(in.Ident.PubKey), in.Ident.Ident) {
+		return adminError(errors.New("Ident does not match public key")), nil
+	}
+	acct := &pb.Account{in.Ident, false, in.MaxMessages, in.MaxBytes, time.Now().Unix(), nil, nil}
+	if err := s.gsdp.claimName(in.Ident); err != nil {
+		return adminError(err), nil
+	}
+	if err := s.gsdp.accounts.PutAccount(acct); err != nil {
+		return adminError(err), nil
+	}
+	return &pb.AdminResponse{false, ""}, nil
+}
+
+func (s *GSDPAdminServer) DeregisterUser(ctx context.Context, in *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	if in.Ident == nil {
+		return adminError(errors.New("No identity given")), nil
+	}
+	if err := s.gsdp.accounts.RemoveAccount(in.Ident.Ident); err != nil {
+		return adminError(err), nil
+	}
+	s.gsdp.mailboxes.Get(IdentToString(in.Ident.Ident), true)
+	// Forget the handle too, so mail to it is no longer taken.
+	s.gsdp.knownUsers.RemoveIdentity(in.Ident.Ident)
+	return &pb.AdminResponse{false, ""}, nil
+}
+
+func (s *GSDPAdminServer) updateAccount(in *pb.AdminUserRequest, update func(*pb.Account)) (*pb.AdminResponse, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	if in.Ident == nil {
+		return adminError(errors.New("No identity given")), nil
+	}
+	acct := s.gsdp.accounts.GetAccount(in.Ident.Ident)
+	if acct == nil {
+		return adminError(errors.New("No such account")), nil
+	}
+	acct = proto.Clone(acct).(*pb.Account)
+	update(acct)
+	if err := s.gsdp.accounts.PutAccount(acct); err != nil {
+		return adminError(err), nil
+	}
+	return &pb.AdminResponse{false, ""}, nil
+}
+
+func (s *GSDPAdminServer) SetQuota(ctx context.Context, in *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+	return s.updateAccount(in, func(a *pb.Account) {
+		a.MaxMessages = in.MaxMessages
+		a.MaxBytes = in.MaxBytes
+	})
+}
+
+func (s *GSDPAdminServer) SuspendUser(ctx context.Context, in *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+	return s.updateAccount(in, func(a *pb.Account) {
+		a.Suspended = in.Suspended
+	})
+}
+
+func (s *GSDPAdminServer) ListUsers(ctx context.Context, in *pb.AdminListRequest) (*pb.AccountList, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	return &pb.AccountList{s.gsdp.accounts.ListAccounts()}, nil
+}
+
+func (s *GSDPAdminServer) ListMailboxes(ctx context.Context, in *pb.AdminListRequest) (*pb.MailboxList, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	lst := &pb.MailboxList{}
+	for _, k := range s.gsdp.mailboxes.List() {
+		ident, _ := base64.StdEncoding.DecodeString(k)
+		id := s.gsdp.knownUsers.GetIdentityForIdent(ident)
+		if id == nil {
+			id = &pb.Identity{Ident: ident}
+		}
+		count, size := s.gsdp.mailboxes.Stat(k)
+		lst.Mailboxes = append(lst.Mailboxes, &pb.MailboxInfo{id, count, size})
+	}
+	return lst, nil
+}
+
+// ExportMailbox returns what is waiting in a local user's mailbox as an
+// export signed by the server, for the user to import elsewhere.
+func (s *GSDPAdminServer) ExportMailbox(ctx context.Context, in *pb.AdminUserRequest) (*pb.MailboxExport, error) {
+	if err := s.authenticate(in, in.Auth); err != nil {
+		return nil, err
+	}
+	if in.Ident == nil {
+		return &pb.MailboxExport{true, "No identity given", nil}, nil
+	}
+	if s.gsdp.serverClient == nil {
+		return &pb.MailboxExport{true, "Server has no key to sign exports with", nil}, nil
+	}
+	owner := s.gsdp.knownUsers.GetIdentityForIdent(in.Ident.Ident)
+	if owner == nil {
+		return &pb.MailboxExport{true, "No such user", nil}, nil
+	}
+	now := time.Now().Unix()
+	msgs := make([]*pb.RawMessage, 0)
+	for _, m := range s.gsdp.mailboxes.Get(IdentToString(owner.Ident), false) {
+		if !Expired(m, now) {
+			msgs = append(msgs, m)
+		}
+	}
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, owner, msgs, s.gsdp.serverClient.user); err != nil {
+		return &pb.MailboxExport{true, err.Error(), nil}, nil
+	}
+	return &pb.MailboxExport{false, "", buf.Bytes()}, nil
+}
+
+// NewAdminClient connects to the admin service at addr over TLS, trusting
+// the certificate in caFile if given and the system's otherwise. Only a
+// service on loopback is spoken to without TLS, and only with no caFile.
+func NewAdminClient(admin *LocalUser, addr string, caFile string) (*AdminClient, error) {
+	creds := grpc.WithInsecure()
+	if len(caFile) > 0 {
+		tc, err := credentials.NewClientTLSFromFile(caFile, "")
+		if err != nil {
+			return nil, err
+		}
+		creds = grpc.WithTransportCredentials(tc)
+	} else if host, _, err := net.SplitHostPort(addr); err != nil || !isLoopbackHost(host) {
+		creds = grpc.WithTransportCredentials(credentials.NewTLS(nil))
+	}
+	conn, err := grpc.Dial(addr, creds)
+	if err != nil {
+		return nil, err
+	}
+	return &AdminClient{*admin, conn}, nil
+}
+
+func (c *AdminClient) Close() error {
+	return c.conn.Close()
+}
+
+func (c *AdminClient) userRequest(ident *pb.Identity, call func(pb.GSDPAdminClient, *pb.AdminUserRequest) (*pb.AdminResponse, error), fill func(*pb.AdminUserRequest)) error {
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: ident}
+	if fill != nil {
+		fill(req)
+	}
+	if err := signAdminRequest(req, req.Auth, c.admin); err != nil {
+		return err
+	}
+	resp, err := call(pb.NewGSDPAdminClient(c.conn), req)
+	if err != nil {
+		return err
+	}
+	if resp.IsError {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (c *AdminClient) RegisterUser(ident *pb.Identity, maxMessages int64, maxBytes int64) error {
+	return c.userRequest(ident, func(a pb.GSDPAdminClient, r *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+		return a.RegisterUser(context.Background(), r)
+	}, func(r *pb.AdminUserRequest) {
+		r.MaxMessages = maxMessages
+		r.MaxBytes = maxBytes
+	})
+}
+
+func (c *AdminClient) DeregisterUser(ident *pb.Identity) error {
+	return c.userRequest(ident, func(a pb.GSDPAdminClient, r *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+		return a.DeregisterUser(context.Background(), r)
+	}, nil)
+}
+
+func (c *AdminClient) SetQuota(ident *pb.Identity, maxMessages int64, maxBytes int64) error {
+	return c.userRequest(ident, func(a pb.GSDPAdminClient, r *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+		return a.SetQuota(context.Background(), r)
+	}, func(r *pb.AdminUserRequest) {
+		r.MaxMessages = maxMessages
+		r.MaxBytes = maxBytes
+	})
+}
+
+func (c *AdminClient) SuspendUser(ident *pb.Identity, suspended bool) error {
+	return c.userRequest(ident, func(a pb.GSDPAdminClient, r *pb.AdminUserRequest) (*pb.AdminResponse, error) {
+		return a.SuspendUser(context.Background(), r)
+	}, func(r *pb.AdminUserRequest) {
+		r.Suspended = suspended
+	})
+}
+
+func (c *AdminClient) ListUsers() ([]*pb.Account, error) {
+	req := &pb.AdminListRequest{&pb.AdminAuth{}}
+	if err := signAdminRequest(req, req.Auth, c.admin); err != nil {
+		return nil, err
+	}
+	lst, err := pb.NewGSDPAdminClient(c.conn).ListUsers(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return lst.Accounts, nil
+}
+
+func (c *AdminClient) ListMailboxes() ([]*pb.MailboxInfo, error) {
+	req := &pb.AdminListRequest{&pb.AdminAuth{}}
+	if err := signAdminRequest(req, req.Auth, c.admin); err != nil {
+		return nil, err
+	}
+	lst, err := pb.NewGSDPAdminClient(c.conn).ListMailboxes(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	return lst.Mailboxes, nil
+}
+
+// ExportMailbox fetches an export of a local user's mailbox.
+func (c *AdminClient) ExportMailbox(ident *pb.Identity) ([]byte, error) {
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: ident}
+	if err := signAdminRequest(req, req.Auth, c.admin); err != nil {
+		return nil, err
+	}
+	resp, err := pb.NewGSDPAdminClient(c.conn).ExportMailbox(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.IsError {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Data, nil
+}
@@ -0,0 +1,154 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"net"
+	"testing"
+	"time"
+)
+
+func getMockAdmin(t *testing.T) (*GSDPServer, *GSDPAdminServer, LocalUser) {
+	id, privk, err := makeAnIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{Identities: NewInMemoryIdentStore()})
+	return gs, newAdminServer(gs, []*pb.Identity{id}), LocalUser{id, privk}
+}
+
+func TestAdminRejectsBadSignature(t *testing.T) {
+	_, as, admin := getMockAdmin(t)
+	user, _, _ := makeAnIdentity()
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(req, req.Auth, admin)
+	req.MaxMessages = 5
+	if _, err := as.RegisterUser(context.Background(), req); err == nil {
+		t.Error("Accepted a tampered request")
+	}
+	other, otherk, _ := makeAnIdentity()
+	signAdminRequest(req, req.Auth, LocalUser{other, otherk})
+	if _, err := as.RegisterUser(context.Background(), req); err == nil {
+		t.Error("Accepted a request from a non-admin")
+	}
+	signAdminRequest(req, req.Auth, admin)
+	if resp, err := as.RegisterUser(context.Background(), req); err != nil || resp.IsError {
+		t.Errorf("Rejected a good request: %v %v", resp, err)
+	}
+}
+
+func TestAdminRejectsReplays(t *testing.T) {
+	gs, as, admin := getMockAdmin(t)
+	user, _, _ := makeAnIdentity()
+	reg := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(reg, reg.Auth, admin)
+	as.RegisterUser(context.Background(), reg)
+	dereg := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(dereg, dereg.Auth, admin)
+	if _, err := as.DeregisterUser(context.Background(), dereg); err != nil {
+		t.Fatal(err)
+	}
+	signAdminRequest(reg, reg.Auth, admin)
+	as.RegisterUser(context.Background(), reg)
+	if _, err := as.DeregisterUser(context.Background(), dereg); err == nil {
+		t.Error("Accepted a replayed request")
+	}
+	if gs.accounts.GetAccount(user.Ident) == nil {
+		t.Error("Replayed request deregistered a user")
+	}
+}
+
+func TestAdminListensOnLoopbackWithoutTLS(t *testing.T) {
+	lis, _, err := listenAdmin(":0", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if ip := lis.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("Admin service without TLS listening on %v", ip)
+	}
+	if lis, _, err := listenAdmin("0.0.0.0:0", "", ""); err == nil {
+		lis.Close()
+		t.Error("Admin service without TLS listened on every interface")
+	}
+}
+
+func TestAdminSuspendAndQuota(t *testing.T) {
+	gs, as, admin := getMockAdmin(t)
+	user, userk, _ := makeAnIdentity()
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user, MaxMessages: 1}
+	signAdminRequest(req, req.Auth, admin)
+	as.RegisterUser(context.Background(), req)
+	nothin := []byte{}
+	msg := &pb.RawMessage{user, []*pb.Identity{user}, nothin, pb.MessageType_PLAIN, []byte("hi"), nothin, nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Errorf("First message rejected: %s", ack.Error)
+	}
+	msg.MsgId = NewMsgId()
+	if ack, _ := gs.Say(context.Background(), msg); !ack.IsError {
+		t.Error("Message over quota was accepted")
+	}
+	req = &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user, Suspended: true}
+	signAdminRequest(req, req.Auth, admin)
+	as.SuspendUser(context.Background(), req)
+	get := &pb.GetRequest{FromIdent: user, Tstamp: time.Now().Unix()}
+	SignMessage(get, &get.ProofOfIdent, userk)
+	if _, err := gs.GetMine(context.Background(), get); err == nil {
+		t.Error("Suspended user got their mail")
+	}
+	lst := &pb.AdminListRequest{&pb.AdminAuth{}}
+	signAdminRequest(lst, lst.Auth, admin)
+	boxes, err := as.ListMailboxes(context.Background(), lst)
+	if err != nil || len(boxes.Mailboxes) != 1 || boxes.Mailboxes[0].MessageCount != 1 {
+		t.Errorf("Bad mailbox listing: %v %v", boxes, err)
+	}
+}
+
+func TestOnlyLocalUsersGetMail(t *testing.T) {
+	gs, as, admin := getMockAdmin(t)
+	from, _, _ := makeAnIdentity()
+	// Someone we only heard of, e.g. through a permissions request, has
+	// no mailbox here.
+	remote, _, _ := makeAnIdentity()
+	remote.Handle, remote.Domain = "remote", "elsewhere.com"
+	gs.knownUsers.AddIdentity(remote)
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, remote)); !ack.IsError {
+		t.Error("Took mail for a user of another server")
+	}
+
+	user, _, _ := makeAnIdentity()
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(req, req.Auth, admin)
+	as.RegisterUser(context.Background(), req)
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, user)); ack.IsError {
+		t.Errorf("Mail to a registered user rejected: %s", ack.Error)
+	}
+	req = &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(req, req.Auth, admin)
+	if resp, err := as.DeregisterUser(context.Background(), req); err != nil || resp.IsError {
+		t.Fatalf("Deregister failed: %v %v", resp, err)
+	}
+	if gs.knownUsers.GetIdentityForHandleDomain(user.Handle, user.Domain) != nil {
+		t.Error("Deregistered user is still known")
+	}
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, user)); !ack.IsError {
+		t.Error("Took mail for a deregistered user")
+	}
+}
@@ -0,0 +1,340 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxArchiveRecord = 64 << 20
+)
+
+// An Archive keeps decrypted copies of a user's messages, so they can still
+// be found after the server has deleted them. On disk each message is sealed
+// with a key derived from the user's private key.
+type Archive struct {
+	entries []*pb.ArchivedMessage
+	seen    map[string]bool
+	added   []*pb.ArchivedMessage
+	// Set when entries were dropped, so the file must be rewritten.
+	dirty   bool
+	aead    cipher.AEAD
+	SrcPath string
+	lck     *sync.Mutex
+}
+
+// What to search an archive for. Empty fields match everything; Text
+// matches messages containing all of its words, in any case, and Tags
+// messages with any of the tags.
+type ArchiveQuery struct {
+	Text   string
+	From   string
+	Types  []pb.MessageType
+	Tags   []string
+	Since  int64
+	Until  int64
+	Status []pb.TaskStatus
+}
+
+func archiveAEAD(user LocalUser) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte("gsdp archive\n"), user.privKey...))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func NewArchive(user LocalUser) (*Archive, error) {
+	aead, err := archiveAEAD(user)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{make([]*pb.ArchivedMessage, 0), make(map[string]bool), make([]*pb.ArchivedMessage, 0), false, aead, "", &sync.Mutex{}}, nil
+}
+
+// MakeFileArchive opens the archive at path, which only user can read. A
+// missing file is an empty archive. Expired messages are dropped on load.
+func MakeFileArchive(path string, user LocalUser) (*Archive, error) {
+	a, err := NewArchive(user)
+	if err != nil {
+		return nil, err
+	}
+	a.SrcPath = path
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	r := bufio.NewReader(fh)
+	for {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if n > maxArchiveRecord || n < uint32(a.aead.NonceSize()) {
+			return nil, errors.New("Corrupt archive record")
+		}
+		rec := make([]byte, n)
+		if _, err := io.ReadFull(r, rec); err != nil {
+			return nil, err
+		}
+		ns := a.aead.NonceSize()
+		bs, err := a.aead.Open(nil, rec[:ns], rec[ns:], nil)
+		if err != nil {
+			return nil, errors.New("Cannot decrypt archive; is it someone else's?")
+		}
+		e := &pb.ArchivedMessage{}
+		if err := proto.Unmarshal(bs, e); err != nil {
+			return nil, err
+		}
+		a.addNotThreadSafe(e)
+	}
+	a.added = a.added[:0]
+	a.Expire(time.Now().Unix())
+	return a, nil
+}
+
+func (a *Archive) addNotThreadSafe(e *pb.ArchivedMessage) bool {
+	if e.Msg == nil || a.seen[string(e.Msg.MsgId)] {
+		return false
+	}
+	if len(e.Msg.MsgId) > 0 {
+		a.seen[string(e.Msg.MsgId)] = true
+	}
+	a.entries = append(a.entries, e)
+	a.added = append(a.added, e)
+	return true
+}
+
+// Add archives a message and its plaintext, unless the archive already has
+// it, it is a receipt, or it has expired. It says whether it did.
+func (a *Archive) Add(msg *pb.RawMessage, plaintext []byte) bool {
+	if msg.MsgType == pb.MessageType_RECEIPT || Expired(msg, time.Now().Unix()) {
+		return false
+	}
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	return a.addNotThreadSafe(&pb.ArchivedMessage{msg, plaintext, time.Now().Unix()})
+}
+
+// Expire drops the messages that have expired at now.
+func (a *Archive) Expire(now int64) int {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	kept := make([]*pb.ArchivedMessage, 0, len(a.entries))
+	for _, e := range a.entries {
+		if !Expired(e.Msg, now) {
+			kept = append(kept, e)
+		}
+	}
+	n := len(a.entries) - len(kept)
+	if n > 0 {
+		a.entries = kept
+		a.dirty = true
+	}
+	return n
+}
+
+func (a *Archive) writeRecords(w io.Writer, entries []*pb.ArchivedMessage) error {
+	for _, e := range entries {
+		bs, err := proto.Marshal(e)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, a.aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		rec := a.aead.Seal(nonce, nonce, bs, nil)
+		if err := binary.Write(w, binary.BigEndian, uint32(len(rec))); err != nil {
+			return err
+		}
+		if _, err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save appends newly archived messages to the file the archive came from, or
+// rewrites it if messages have been dropped.
+func (a *Archive) Save() error {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	if len(a.SrcPath) == 0 || (len(a.added) == 0 && !a.dirty) {
+		return nil
+	}
+	path, entries, flags := a.SrcPath, a.added, os.O_APPEND|os.O_CREATE|os.O_WRONLY
+	if a.dirty {
+		path, entries, flags = a.SrcPath+".tmp", a.entries, os.O_TRUNC|os.O_CREATE|os.O_WRONLY
+	}
+	fh, err := os.OpenFile(path, flags, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	if err := a.writeRecords(w, entries); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	if a.dirty {
+		if err := os.Rename(path, a.SrcPath); err != nil {
+			return err
+		}
+	}
+	a.added = a.added[:0]
+	a.dirty = false
+	return nil
+}
+
+// View returns the archived messages with their amendments applied.
+// Amendments that do not check out are ignored.
+func (a *Archive) View() *MessageView {
+	a.lck.Lock()
+	entries := a.entries
+	a.lck.Unlock()
+	v := NewMessageView()
+	now := time.Now().Unix()
+	for _, e := range entries {
+		if !Expired(e.Msg, now) {
+			v.Add(e.Msg, e.Plaintext)
+		}
+	}
+	return v
+}
+
+func (q *ArchiveQuery) matches(vm *ViewMessage) bool {
+	m := vm.Msg
+	if vm.Retracted {
+		return false
+	}
+	if q.Since > 0 && m.Tstamp < q.Since {
+		return false
+	}
+	if q.Until > 0 && m.Tstamp >= q.Until {
+		return false
+	}
+	if len(q.From) > 0 {
+		if m.FromIdent == nil {
+			return false
+		}
+		from := strings.ToLower(q.From)
+		if from != strings.ToLower(m.FromIdent.Handle) && from != strings.ToLower(m.FromIdent.Handle+"\\"+m.FromIdent.Domain) {
+			return false
+		}
+	}
+	if len(q.Types) > 0 {
+		ok := false
+		for _, t := range q.Types {
+			ok = ok || t == m.MsgType
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(q.Tags) > 0 && !HasAnyTag(MessageTags(m, vm.Plaintext), q.Tags) {
+		return false
+	}
+	if len(q.Status) > 0 {
+		p, _ := OpenPayload(m.MsgType, vm.Plaintext)
+		task, isTask := p.(*pb.TaskAssign)
+		ok := false
+		for _, st := range q.Status {
+			ok = ok || (isTask && pb.TaskStatus(task.Status) == st)
+		}
+		if !ok {
+			return false
+		}
+	}
+	text := strings.ToLower(vm.Text)
+	for _, w := range strings.Fields(strings.ToLower(q.Text)) {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns the archived messages matching q, as they stand after
+// edits, in the order they were archived. Retracted messages never match.
+func (a *Archive) Search(q ArchiveQuery) []*ViewMessage {
+	res := make([]*ViewMessage, 0)
+	for _, vm := range a.View().Messages() {
+		if q.matches(vm) {
+			res = append(res, vm)
+		}
+	}
+	return res
+}
+
+// Has says whether the archive has a message with the given id.
+func (a *Archive) Has(msgId []byte) bool {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	return a.seen[string(msgId)]
+}
+
+// Message returns the archived message with the given id, or nil. A nil
+// archive has nothing in it.
+func (a *Archive) Message(msgId []byte) *pb.RawMessage {
+	if a == nil || len(msgId) == 0 {
+		return nil
+	}
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	for _, e := range a.entries {
+		if bytes.Equal(e.Msg.MsgId, msgId) {
+			return e.Msg
+		}
+	}
+	return nil
+}
+
+// Entries returns everything in the archive, in the order it was added.
+func (a *Archive) Entries() []*pb.ArchivedMessage {
+	a.lck.Lock()
+	defer a.lck.Unlock()
+	return append([]*pb.ArchivedMessage{}, a.entries...)
+}
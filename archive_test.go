@@ -0,0 +1,100 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive")
+	alice, alicek, _ := makeAnIdentity()
+	alice.Handle = "alice"
+	bob, bobk, _ := makeAnIdentity()
+	me := MakeLocalUser(bob, bobk)
+	a, err := MakeFileArchive(path, me)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := makeMockMessage(alice, bob)
+	hello.Tstamp = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC).Unix()
+	a.Add(hello, []byte("Hello world"))
+	task := makeMockMessage(alice, bob)
+	task.MsgType = pb.MessageType_TASK_ASSIGN
+	bs, _ := proto.Marshal(&pb.TaskAssign{Subject: "Fix the build", Status: int32(pb.TaskStatus_BLOCKED), ProjectTags: []string{"infra"}})
+	a.Add(task, bs)
+	gone := makeMockMessage(alice, bob)
+	a.Add(gone, []byte("hello again"))
+	retract, pt := makeMockAmendment(t, pb.MessageType_RETRACT, gone, "", alice, alicek)
+	a.Add(retract, pt)
+	edit, pt := makeMockAmendment(t, pb.MessageType_EDIT, hello, "Hello there world", alice, alicek)
+	a.Add(edit, pt)
+	old := makeMockMessage(alice, bob)
+	old.ExpiresUtc = time.Now().Add(time.Hour).Unix()
+	a.Add(old, []byte("hello soon gone"))
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MakeFileArchive(path, MakeLocalUser(alice, alicek)); err == nil {
+		t.Error("Opened someone else's archive")
+	}
+	a, err = MakeFileArchive(path, me)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := a.Search(ArchiveQuery{Text: "HELLO there"}); len(res) != 1 || res[0].Text != "Hello there world" {
+		t.Errorf("Edited message not found by its new text: %v", res)
+	}
+	if res := a.Search(ArchiveQuery{Text: "hello"}); len(res) != 2 {
+		t.Errorf("Got %d results for hello, wanted 2 (one retracted)", len(res))
+	}
+	until := time.Date(2017, 6, 2, 0, 0, 0, 0, time.UTC).Unix()
+	if res := a.Search(ArchiveQuery{From: "Alice", Until: until}); len(res) != 1 || !bytes.Equal(res[0].Msg.MsgId, hello.MsgId) {
+		t.Errorf("Bad sender and date search: %v", res)
+	}
+	q := ArchiveQuery{Types: []pb.MessageType{pb.MessageType_TASK_ASSIGN}, Tags: []string{"INFRA"}, Status: []pb.TaskStatus{pb.TaskStatus_BLOCKED}, Text: "build"}
+	if res := a.Search(q); len(res) != 1 {
+		t.Errorf("Task not found by type, tag and status: %v", res)
+	}
+	q.Status = []pb.TaskStatus{pb.TaskStatus_DONE}
+	if res := a.Search(q); len(res) != 0 {
+		t.Error("Task found under the wrong status")
+	}
+
+	if n := a.Expire(time.Now().Add(2 * time.Hour).Unix()); n != 1 {
+		t.Errorf("Expired %d messages, wanted 1", n)
+	}
+	a.Save()
+	a, _ = MakeFileArchive(path, me)
+	if res := a.Search(ArchiveQuery{Text: "soon"}); len(res) != 0 || len(a.Entries()) != 5 {
+		t.Errorf("Expired message still archived: %d entries", len(a.Entries()))
+	}
+}
@@ -0,0 +1,282 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+// Package bot runs programs that read and answer GSDP mail. A Bot polls its
+// mailbox, decrypts each message and hands it to the handler registered for
+// its type, remembering how far it got so a restart does not replay mail.
+package bot
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"log"
+	"time"
+)
+
+const (
+	defaultPollFreq   = 5 * time.Second
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = time.Minute
+	defaultPageSize   = 100
+)
+
+// A Client is the part of GSDPClient a bot uses, so tests can stand in for
+// the server.
+type Client interface {
+	GetPage(afterSeq uint64, limit int, purge bool, tags []string) (*pb.PendingData, error)
+	Ack(seqs []uint64) error
+	Say(msg *pb.RawMessage) error
+}
+
+// Options for a Bot. With no CursorPath the cursor is only kept in memory.
+// With Ack, messages are deleted from the server once handled.
+type Options struct {
+	CursorPath string
+	PollFreq   time.Duration
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	PageSize   int
+	Ack        bool
+	// Used to find the keys to reply with; the sender's ident in the
+	// message is used if it is not known here.
+	Identities gsdp.IdentityStore
+}
+
+func DefaultOptions() Options {
+	return Options{PollFreq: defaultPollFreq, MinBackoff: defaultMinBackoff, MaxBackoff: defaultMaxBackoff, PageSize: defaultPageSize}
+}
+
+// A Message is a decrypted message. Payload is the structured content of
+// types that have one, such as a *pb.TaskAssign, and nil otherwise.
+type Message struct {
+	Raw       *pb.RawMessage
+	Plaintext []byte
+	Payload   proto.Message
+}
+
+// Text is the message's human-readable text.
+func (m *Message) Text() string {
+	return gsdp.PayloadText(m.Raw.MsgType, m.Plaintext)
+}
+
+func (m *Message) From() *pb.Identity {
+	return m.Raw.FromIdent
+}
+
+// A Handler handles one message. Errors are logged; the message still
+// counts as handled.
+type Handler func(b *Bot, m *Message) error
+
+type Bot struct {
+	identity *pb.Identity
+	privKey  []byte
+	client   Client
+	opts     Options
+	cursor   *Cursor
+	handlers map[pb.MessageType]Handler
+	fallback Handler
+}
+
+// New makes a bot for the identity id, reading its mail through client,
+// which is normally a *gsdp.GSDPClient for the same identity.
+func New(id *pb.Identity, privk []byte, client Client, opts Options) (*Bot, error) {
+	cursor, err := MakeFileCursor(opts.CursorPath)
+	if err != nil {
+		return nil, err
+	}
+	def := DefaultOptions()
+	if opts.PollFreq <= 0 {
+		opts.PollFreq = def.PollFreq
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = def.MinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = def.MaxBackoff
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = def.PageSize
+	}
+	return &Bot{id, privk, client, opts, cursor, make(map[pb.MessageType]Handler), nil}, nil
+}
+
+func (b *Bot) Identity() *pb.Identity {
+	return b.identity
+}
+
+func (b *Bot) Cursor() *Cursor {
+	return b.cursor
+}
+
+// Handle routes messages of type kind to h, replacing any handler before.
+func (b *Bot) Handle(kind pb.MessageType, h Handler) {
+	b.handlers[kind] = h
+}
+
+// HandleDefault routes messages of any type without a handler of its own to
+// h. Without one they are skipped.
+func (b *Bot) HandleDefault(h Handler) {
+	b.fallback = h
+}
+
+func (b *Bot) HandleText(h func(b *Bot, m *Message, text string) error) {
+	b.Handle(pb.MessageType_PLAIN, func(b *Bot, m *Message) error {
+		return h(b, m, string(m.Plaintext))
+	})
+}
+
+func (b *Bot) HandleQuestion(h func(b *Bot, m *Message, question string) error) {
+	b.Handle(pb.MessageType_QUESTION, func(b *Bot, m *Message) error {
+		return h(b, m, string(m.Plaintext))
+	})
+}
+
+func (b *Bot) HandleTask(h func(b *Bot, m *Message, task *pb.TaskAssign) error) {
+	b.Handle(pb.MessageType_TASK_ASSIGN, func(b *Bot, m *Message) error {
+		return h(b, m, m.Payload.(*pb.TaskAssign))
+	})
+}
+
+func (b *Bot) HandleCodeShare(h func(b *Bot, m *Message, cs *pb.CodeShare) error) {
+	b.Handle(pb.MessageType_CODE_SHARE, func(b *Bot, m *Message) error {
+		return h(b, m, m.Payload.(*pb.CodeShare))
+	})
+}
+
+func (b *Bot) HandleInvitation(h func(b *Bot, m *Message, inv *pb.Invitation) error) {
+	b.Handle(pb.MessageType_INVITATION, func(b *Bot, m *Message) error {
+		return h(b, m, m.Payload.(*pb.Invitation))
+	})
+}
+
+func (b *Bot) HandleLink(h func(b *Bot, m *Message, link *pb.Link) error) {
+	b.Handle(pb.MessageType_LINK, func(b *Bot, m *Message) error {
+		return h(b, m, m.Payload.(*pb.Link))
+	})
+}
+
+// Receipts are not encrypted; their payload is the *pb.Receipt, as parsed by
+// gsdp.ParseReceipt. Handlers that act on one should check it with
+// gsdp.OpenReceipt against the message it is for.
+func (b *Bot) open(raw *pb.RawMessage) (*Message, error) {
+	if raw.MsgType == pb.MessageType_RECEIPT {
+		r, err := gsdp.ParseReceipt(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &Message{raw, nil, r}, nil
+	}
+	pt, err := gsdp.DoRawMessageDecryption(raw, b.privKey)
+	if err != nil {
+		return nil, err
+	}
+	p, err := gsdp.OpenPayload(raw.MsgType, pt)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{raw, pt, p}, nil
+}
+
+// Calls h, turning a panic into an error so one bad message cannot stop the
+// bot.
+func callHandler(h Handler, b *Bot, m *Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Handler panicked: %v", r)
+		}
+	}()
+	return h(b, m)
+}
+
+// Dispatch decrypts a message and passes it to its handler.
+func (b *Bot) Dispatch(raw *pb.RawMessage) error {
+	h, ok := b.handlers[raw.MsgType]
+	if !ok {
+		h = b.fallback
+	}
+	if h == nil {
+		return nil
+	}
+	m, err := b.open(raw)
+	if err != nil {
+		return err
+	}
+	return callHandler(h, b, m)
+}
+
+// Poll handles everything after the cursor, a page at a time, acking each
+// page if asked to and then moving the cursor and saving it. It returns how
+// many messages it saw.
+func (b *Bot) Poll() (int, error) {
+	n := 0
+	for {
+		page, err := b.client.GetPage(b.cursor.Seq(), b.opts.PageSize, false, nil)
+		if err != nil {
+			return n, err
+		}
+		seqs := make([]uint64, 0, len(page.Messages))
+		for _, m := range page.Messages {
+			seqs = append(seqs, m.Seq)
+			if err := b.Dispatch(m); err != nil {
+				log.Printf("Bot failed on message %s: %v\n", gsdp.IdentToString(m.MsgId), err)
+			}
+			n++
+		}
+		// Acked before the cursor moves past them, so after a failed ack
+		// the page is handled and acked again.
+		if b.opts.Ack && len(seqs) > 0 {
+			if err := b.client.Ack(seqs); err != nil {
+				return n, err
+			}
+		}
+		if page.NextSeq > b.cursor.Seq() {
+			b.cursor.Set(page.NextSeq)
+			if err := b.cursor.Save(); err != nil {
+				return n, err
+			}
+		}
+		if !page.More {
+			return n, nil
+		}
+	}
+}
+
+// Run polls until ctx is done. When the server cannot be reached it backs
+// off, doubling the wait up to MaxBackoff, and carries on from the cursor
+// once it is back.
+func (b *Bot) Run(ctx context.Context) error {
+	backoff := b.opts.MinBackoff
+	for {
+		wait := b.opts.PollFreq
+		if _, err := b.Poll(); err != nil {
+			log.Printf("Bot poll failed, retrying in %v: %v\n", backoff, err)
+			wait = backoff
+			if backoff *= 2; backoff > b.opts.MaxBackoff {
+				backoff = b.opts.MaxBackoff
+			}
+		} else {
+			backoff = b.opts.MinBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
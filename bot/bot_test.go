@@ -0,0 +1,241 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package bot
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A stand-in for the server: a mailbox of messages in seq order, and what
+// the bot sent and acked.
+type mockClient struct {
+	mailbox  []*pb.RawMessage
+	said     []*pb.RawMessage
+	acked    []uint64
+	fails    int
+	ackFails int
+	polls    int
+}
+
+func (c *mockClient) GetPage(afterSeq uint64, limit int, purge bool, tags []string) (*pb.PendingData, error) {
+	c.polls++
+	if c.fails > 0 {
+		c.fails--
+		return nil, errors.New("connection refused")
+	}
+	page := &pb.PendingData{NextSeq: afterSeq}
+	for _, m := range c.mailbox {
+		if m.Seq <= afterSeq {
+			continue
+		}
+		if len(page.Messages) == limit {
+			page.More = true
+			break
+		}
+		page.Messages = append(page.Messages, m)
+		page.NextSeq = m.Seq
+	}
+	return page, nil
+}
+
+func (c *mockClient) Ack(seqs []uint64) error {
+	if c.ackFails > 0 {
+		c.ackFails--
+		return errors.New("connection reset")
+	}
+	c.acked = append(c.acked, seqs...)
+	return nil
+}
+
+func (c *mockClient) Say(msg *pb.RawMessage) error {
+	c.said = append(c.said, msg)
+	return nil
+}
+
+func (c *mockClient) deliver(t *testing.T, from *pb.Identity, to *pb.Identity, kind pb.MessageType, content []byte) *pb.RawMessage {
+	nothin := []byte{}
+	msg := &pb.RawMessage{from, []*pb.Identity{to}, []byte("block"), kind, nothin, gsdp.NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, uint64(len(c.mailbox) + 1), 0, false, 0, nothin, nil}
+	if err := gsdp.DoRawMessageEncryption(content, to, msg); err != nil {
+		t.Fatal(err)
+	}
+	c.mailbox = append(c.mailbox, msg)
+	return msg
+}
+
+func makeTestBot(t *testing.T, client Client, cursorPath string) (*Bot, *pb.Identity) {
+	id, privk := gsdp.NewIdentity("bot", "bot", "example.com", "")
+	opts := DefaultOptions()
+	opts.CursorPath = cursorPath
+	opts.PageSize = 2
+	opts.Ack = true
+	b, err := New(id, privk, client, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, id
+}
+
+func TestBotRoutesAndReplies(t *testing.T) {
+	client := &mockClient{}
+	b, botId := makeTestBot(t, client, "")
+	userId, userPrivk := gsdp.NewIdentity("user", "user", "example.com", "")
+
+	client.deliver(t, userId, botId, pb.MessageType_PLAIN, []byte("hello"))
+	task, _ := proto.Marshal(&pb.TaskAssign{Subject: "Fix the build", Priority: 3, ProjectTags: []string{"ci"}})
+	assigned := client.deliver(t, userId, botId, pb.MessageType_TASK_ASSIGN, task)
+	client.deliver(t, userId, botId, pb.MessageType_QUESTION, []byte("why?"))
+	client.deliver(t, userId, botId, pb.MessageType_REACTION, []byte("+1"))
+
+	b.HandleText(func(b *Bot, m *Message, text string) error {
+		_, err := b.Reply(m, "echo: "+text)
+		return err
+	})
+	b.HandleTask(func(b *Bot, m *Message, task *pb.TaskAssign) error {
+		_, err := b.UpdateTask(m, pb.TaskStatus_IN_PROGRESS, "on it: "+task.Subject)
+		return err
+	})
+	b.HandleQuestion(func(b *Bot, m *Message, q string) error {
+		panic("no answers today")
+	})
+	others := 0
+	b.HandleDefault(func(b *Bot, m *Message) error {
+		others++
+		return nil
+	})
+
+	n, err := b.Poll()
+	if err != nil || n != 4 || others != 1 {
+		t.Fatalf("Bad poll: %d %v, %d others", n, err, others)
+	}
+	if len(client.said) != 2 || len(client.acked) != 4 || b.Cursor().Seq() != 4 {
+		t.Fatalf("Bad replies %d, acks %v or cursor %d", len(client.said), client.acked, b.Cursor().Seq())
+	}
+	echo := client.said[0]
+	pt, err := gsdp.DoRawMessageDecryption(echo, userPrivk)
+	if err != nil || string(pt) != "echo: hello" {
+		t.Errorf("Bad echo: %q %v", pt, err)
+	}
+	if string(echo.ReMsgId) != string(client.mailbox[0].MsgId) || string(echo.BlockId) != "block" {
+		t.Error("Echo is not a reply")
+	}
+	pt, err = gsdp.DoRawMessageDecryption(client.said[1], userPrivk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := &pb.TaskAssign{}
+	if err := proto.Unmarshal(pt, update); err != nil {
+		t.Fatal(err)
+	}
+	if update.Status != int32(pb.TaskStatus_IN_PROGRESS) || string(update.ReMsgId) != string(assigned.MsgId) || update.Description != "on it: Fix the build" || update.Priority != 3 {
+		t.Errorf("Bad task update: %v", update)
+	}
+
+	m, _ := b.open(client.mailbox[0])
+	if _, err := b.Answer(m, "not a question"); err == nil {
+		t.Error("Answered a plain message")
+	}
+	if _, err := b.UpdateTask(m, pb.TaskStatus_DONE, ""); err == nil {
+		t.Error("Updated a plain message as a task")
+	}
+}
+
+func TestBotCursorSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bot.cursor")
+	client := &mockClient{}
+	b, botId := makeTestBot(t, client, path)
+	userId, _ := gsdp.NewIdentity("user", "user", "example.com", "")
+	seen := 0
+	count := func(b *Bot, m *Message, text string) error {
+		seen++
+		return nil
+	}
+	b.HandleText(count)
+	for i := 0; i < 3; i++ {
+		client.deliver(t, userId, botId, pb.MessageType_PLAIN, []byte("hi"))
+	}
+	if _, err := b.Poll(); err != nil || seen != 3 {
+		t.Fatalf("Bad first poll: %d %v", seen, err)
+	}
+
+	client.deliver(t, userId, botId, pb.MessageType_PLAIN, []byte("again"))
+	cursor, err := MakeFileCursor(path)
+	if err != nil || cursor.Seq() != 3 {
+		t.Fatalf("Bad saved cursor: %v %v", cursor, err)
+	}
+	// A new bot with the same key and cursor only sees the new message.
+	again, err := New(botId, b.privKey, client, Options{CursorPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.HandleText(count)
+	if _, err := again.Poll(); err != nil || seen != 4 {
+		t.Errorf("Restarted bot saw %d messages: %v", seen, err)
+	}
+}
+
+func TestBotRetriesFailedAcks(t *testing.T) {
+	client := &mockClient{ackFails: 1}
+	b, botId := makeTestBot(t, client, "")
+	userId, _ := gsdp.NewIdentity("user", "user", "example.com", "")
+	seen := 0
+	b.HandleText(func(b *Bot, m *Message, text string) error {
+		seen++
+		return nil
+	})
+	client.deliver(t, userId, botId, pb.MessageType_PLAIN, []byte("hi"))
+	if _, err := b.Poll(); err == nil {
+		t.Fatal("Failed ack not reported")
+	}
+	if b.Cursor().Seq() != 0 {
+		t.Errorf("Cursor moved past an unacked page: %d", b.Cursor().Seq())
+	}
+	if _, err := b.Poll(); err != nil || seen != 2 || len(client.acked) != 1 || b.Cursor().Seq() != 1 {
+		t.Errorf("Page not handled and acked again: seen %d, acked %v, cursor %d, %v", seen, client.acked, b.Cursor().Seq(), err)
+	}
+}
+
+func TestBotRunBacksOff(t *testing.T) {
+	client := &mockClient{fails: 2}
+	id, privk := gsdp.NewIdentity("bot", "bot", "example.com", "")
+	b, err := New(id, privk, client, Options{PollFreq: time.Hour, MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := b.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Run ended with %v", err)
+	}
+	// Two failures, then one good poll, then waiting PollFreq.
+	if client.polls != 3 {
+		t.Errorf("Polled %d times", client.polls)
+	}
+}
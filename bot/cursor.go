@@ -0,0 +1,78 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package bot
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Cursor is the seq of the last message a bot handled, kept in a file so
+// it survives restarts.
+type Cursor struct {
+	seq     uint64
+	SrcPath string
+	lck     *sync.Mutex
+}
+
+// MakeFileCursor loads a cursor from path. A missing file, or no path,
+// starts from the beginning of the mailbox.
+func MakeFileCursor(path string) (*Cursor, error) {
+	c := &Cursor{0, path, &sync.Mutex{}}
+	if len(path) == 0 {
+		return c, nil
+	}
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.seq, err = strconv.ParseUint(strings.TrimSpace(string(bs)), 10, 64); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Cursor) Seq() uint64 {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.seq
+}
+
+func (c *Cursor) Set(seq uint64) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.seq = seq
+}
+
+// Save writes the cursor to its file, if any, replacing it whole so a crash
+// leaves the old value rather than a torn one.
+func (c *Cursor) Save() error {
+	if len(c.SrcPath) == 0 {
+		return nil
+	}
+	tmp := c.SrcPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatUint(c.Seq(), 10)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.SrcPath)
+}
@@ -0,0 +1,87 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package bot
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"time"
+)
+
+// Prefers the keys we know for an ident to those a message claims.
+func (b *Bot) lookup(id *pb.Identity) *pb.Identity {
+	if b.opts.Identities != nil && id != nil {
+		if known := b.opts.Identities.GetIdentityForIdent(id.Ident); known != nil {
+			return known
+		}
+	}
+	return id
+}
+
+// Send encrypts content of type kind to to and sends it. A reply names the
+// message it answers in reMsgId and shares its block id, so clients thread
+// them together.
+func (b *Bot) Send(to *pb.Identity, kind pb.MessageType, content []byte, re *pb.RawMessage) (*pb.RawMessage, error) {
+	to = b.lookup(to)
+	if to == nil || len(to.PubKey) == 0 {
+		return nil, errors.New("No key to send to")
+	}
+	nothin := []byte{}
+	msg := &pb.RawMessage{b.identity, []*pb.Identity{to}, nothin, kind, nothin, gsdp.NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+	if re != nil {
+		msg.ReMsgId, msg.BlockId = re.MsgId, re.BlockId
+	}
+	if err := gsdp.DoRawMessageEncryption(content, to, msg); err != nil {
+		return nil, err
+	}
+	return msg, b.client.Say(msg)
+}
+
+// SendPayload sends a structured payload, such as a *pb.TaskAssign.
+func (b *Bot) SendPayload(to *pb.Identity, kind pb.MessageType, payload proto.Message, re *pb.RawMessage) (*pb.RawMessage, error) {
+	bs, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return b.Send(to, kind, bs, re)
+}
+
+// Reply sends text back to the sender of m, as a reply to it.
+func (b *Bot) Reply(m *Message, text string) (*pb.RawMessage, error) {
+	return b.Send(m.From(), pb.MessageType_PLAIN, []byte(text), m.Raw)
+}
+
+// Answer answers a QUESTION.
+func (b *Bot) Answer(m *Message, text string) (*pb.RawMessage, error) {
+	if m.Raw.MsgType != pb.MessageType_QUESTION {
+		return nil, errors.New("Not a question")
+	}
+	return b.Reply(m, text)
+}
+
+// UpdateTask tells whoever assigned the task in m that its status is now
+// status, with a note saying why.
+func (b *Bot) UpdateTask(m *Message, status pb.TaskStatus, note string) (*pb.RawMessage, error) {
+	task, ok := m.Payload.(*pb.TaskAssign)
+	if !ok {
+		return nil, errors.New("Not a task")
+	}
+	update := &pb.TaskAssign{task.Subject, time.Now().Unix(), note, task.DueTime, task.Priority, m.Raw.MsgId, int32(status), task.ProjectTags}
+	return b.SendPayload(m.From(), pb.MessageType_TASK_ASSIGN, update, m.Raw)
+}
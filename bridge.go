@@ -0,0 +1,564 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	maxBridgeBodyBytes  = 1 << 20
+	webhookRetryBackoff = time.Second
+	webhookMaxBackoff   = 5 * time.Minute
+	webhookTimeout      = 10 * time.Second
+	WebhookSignatureHdr = "X-Gsdp-Signature"
+	WebhookTimestampHdr = "X-Gsdp-Timestamp"
+	webhookSignaturePfx = "sha256="
+	bridgeBearerPrefix  = "Bearer "
+	bridgeJSONType      = "application/json"
+)
+
+// A BridgeService is an identity the server holds the key for, so programs
+// that cannot do GSDP themselves can send as it over HTTP with Token. If it
+// has a Webhook, everything delivered to it is also posted there as JSON,
+// signed with Secret.
+type BridgeService struct {
+	Name    string
+	User    *LocalUser
+	Token   string
+	Webhook string
+	Secret  string
+}
+
+// The Bridge is the server's optional HTTP face for machine-generated
+// messages:
+//
+//	POST   /v1/messages  sends a JSONMessage as the service
+//	PUT    /v1/webhook   sets the service's webhook, from {"url", "secret"}
+//	DELETE /v1/webhook   removes it
+//
+// Each request carries "Authorization: Bearer <token>". Messages are
+// encrypted to each recipient here, before they leave the bridge, so human
+// recipients read them with their own keys as usual.
+//
+// Webhooks are fed from the services' mailboxes, each by its own worker, and
+// a message is only acked once its webhook has answered 2xx.
+type Bridge struct {
+	gs       *GSDPServer
+	services []*BridgeService
+	byIdent  map[string]*BridgeService
+	wake     map[string]chan struct{}
+	hooks    *WebhookStore
+	mux      *http.ServeMux
+	http     *http.Client
+	lck      *sync.Mutex
+	done     chan struct{}
+	wg       *sync.WaitGroup
+}
+
+type bridgeResponse struct {
+	Error  string   `json:"error,omitempty"`
+	MsgIds []string `json:"msg_ids,omitempty"`
+}
+
+type webhookRequest struct {
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+// NewBridge makes a bridge for the server's services and attaches it to the
+// server, adding the services' identities to the server's if they are not
+// there yet, and starts delivering webhooks. Webhooks set over the bridge
+// are kept in hooks, if given, and win over those the services came with.
+func NewBridge(gs *GSDPServer, services []*BridgeService, hooks *WebhookStore) (*Bridge, error) {
+	if hooks == nil {
+		hooks = NewWebhookStore()
+	}
+	b := &Bridge{gs, services, make(map[string]*BridgeService), make(map[string]chan struct{}), hooks, http.NewServeMux(), newWebhookClient(), &sync.Mutex{}, make(chan struct{}), &sync.WaitGroup{}}
+	for _, svc := range services {
+		if svc.User == nil || len(svc.Token) == 0 {
+			return nil, errors.New("Bridge service " + svc.Name + " needs an identity and a token")
+		}
+		if url, secret, ok := hooks.Get(svc.Name); ok {
+			svc.Webhook, svc.Secret = url, secret
+		}
+		if len(svc.Webhook) > 0 {
+			if err := checkWebhook(svc.Webhook, svc.Secret); err != nil {
+				return nil, err
+			}
+		}
+		id := svc.User.identity
+		if gs.knownUsers.GetIdentityForIdent(id.Ident) == nil {
+			if err := gs.knownUsers.AddIdentity(id); err != nil {
+				return nil, err
+			}
+		}
+		b.byIdent[IdentToString(id.Ident)] = svc
+		b.wake[IdentToString(id.Ident)] = make(chan struct{}, 1)
+	}
+	b.mux.HandleFunc("/v1/messages", b.handleMessages)
+	b.mux.HandleFunc("/v1/webhook", b.handleWebhook)
+	gs.bridge = b
+	for _, svc := range services {
+		b.wg.Add(1)
+		go b.deliverWebhooks(svc)
+	}
+	return b, nil
+}
+
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mux.ServeHTTP(w, r)
+}
+
+// Stop stops delivering webhooks. What has not been delivered stays in the
+// services' mailboxes, to be delivered once the bridge is back.
+func (b *Bridge) Stop() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// Listens for the bridge on port. Tokens and webhook secrets must not cross
+// the network in the clear, so without a certificate the bridge only
+// listens on loopback, e.g. behind a proxy that does TLS; with no host in
+// port, that is 127.0.0.1.
+func listenBridge(port string, certFile string, keyFile string) (net.Listener, error) {
+	host, p, err := net.SplitHostPort(port)
+	if err != nil {
+		return nil, err
+	}
+	if len(certFile) == 0 {
+		if len(host) == 0 {
+			host = "127.0.0.1"
+		} else if !isLoopbackHost(host) {
+			return nil, errors.New("Bridge without TLS may only listen on loopback, not " + host)
+		}
+		return net.Listen("tcp", net.JoinHostPort(host, p))
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	lis, err := net.Listen("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(lis, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}), nil
+}
+
+func isLoopbackHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback())
+}
+
+// Webhooks may only reach public addresses, so that a service cannot use
+// the server to get at the network it sits in.
+func checkPublicIP(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return errors.New("Webhook address " + ip.String() + " is not public")
+	}
+	return nil
+}
+
+// Checks every address a webhook connects to, after DNS, so a name cannot
+// be pointed at a private address once the webhook is set.
+func webhookDialControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("Webhook dialed a name, not an address: " + host)
+	}
+	return checkPublicIP(ip)
+}
+
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}
+	return &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: webhookTimeout},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return errors.New("Webhook redirected away from https")
+			}
+			if len(via) >= 5 {
+				return errors.New("Webhook redirected too often")
+			}
+			return nil
+		},
+	}
+}
+
+func checkWebhook(rawurl string, secret string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "https" || len(u.Hostname()) == 0 {
+		return errors.New("Webhook must be an https URL")
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errors.New("Webhook must not point at this machine")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := checkPublicIP(ip); err != nil {
+			return err
+		}
+	}
+	if len(secret) == 0 {
+		return errors.New("Webhook needs a secret to sign with")
+	}
+	return nil
+}
+
+// SignWebhook returns the signature header value for a webhook body sent at
+// tstamp: an HMAC-SHA256, keyed with the secret, over "<tstamp>.<body>".
+func SignWebhook(secret string, tstamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(tstamp, 10) + "."))
+	mac.Write(body)
+	return webhookSignaturePfx + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a webhook request's signature, and that it was sent
+// within maxAge of now.
+func VerifyWebhook(secret string, sig string, tstamp string, body []byte, maxAge time.Duration) bool {
+	ts, err := strconv.ParseInt(tstamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > maxAge || age < -maxAge {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(SignWebhook(secret, ts, body)))
+}
+
+func writeBridgeResponse(w http.ResponseWriter, status int, resp *bridgeResponse) {
+	w.Header().Set("Content-Type", bridgeJSONType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func bridgeError(w http.ResponseWriter, status int, msg string) {
+	writeBridgeResponse(w, status, &bridgeResponse{Error: msg})
+}
+
+// Finds the service a request's token belongs to, comparing every token in
+// constant time.
+func (b *Bridge) authenticate(r *http.Request) *BridgeService {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bridgeBearerPrefix) {
+		return nil
+	}
+	token := []byte(strings.TrimPrefix(auth, bridgeBearerPrefix))
+	var found *BridgeService
+	for _, svc := range b.services {
+		if subtle.ConstantTimeCompare(token, []byte(svc.Token)) == 1 {
+			found = svc
+		}
+	}
+	return found
+}
+
+func (b *Bridge) readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBridgeBodyBytes)).Decode(v); err != nil {
+		bridgeError(w, http.StatusBadRequest, "bad JSON: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// Looks a recipient up here, or for other domains, asks their server.
+func (b *Bridge) resolve(svc *BridgeService, to string) (*pb.Identity, error) {
+	i := strings.LastIndex(to, "\\")
+	if i <= 0 || i == len(to)-1 {
+		return nil, errors.New("Recipient must be handle\\domain: " + to)
+	}
+	handle, domain := to[:i], to[i+1:]
+	if id := b.gs.knownUsers.GetIdentityForHandleDomain(handle, domain); id != nil {
+		return id, nil
+	}
+	if strings.EqualFold(domain, b.gs.domain) {
+		return nil, errors.New("No such user " + to)
+	}
+	client := NewClient(svc.User, b.gs.knownUsers, b.gs.connectionPool)
+	res, err := client.Name(&pb.NameInquiry{svc.User.identity, nil, false, handle, domain})
+	if err != nil {
+		return nil, err
+	}
+	if res.IsError || res.Name == nil {
+		return nil, errors.New("Cannot find " + to)
+	}
+	return res.Name, nil
+}
+
+// Hands a message to this server, or for other domains, sends it on as the
+// service, stamping it if asked to as clients do.
+func (b *Bridge) say(svc *BridgeService, msg *pb.RawMessage) error {
+	to := msg.ToIdent[0]
+	if !strings.EqualFold(to.Domain, b.gs.domain) {
+		client := NewClient(svc.User, b.gs.knownUsers, b.gs.connectionPool)
+		return client.Say(msg)
+	}
+	ack, err := b.gs.Say(context.Background(), msg)
+	if err == nil && ack.IsError && ack.StampBits > 0 && ack.StampBits <= MaxStampBits {
+		StampMessage(msg, int(ack.StampBits))
+		ack, err = b.gs.Say(context.Background(), msg)
+	}
+	if err != nil {
+		return err
+	}
+	if ack.IsError {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+func (b *Bridge) handleMessages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		bridgeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	svc := b.authenticate(r)
+	if svc == nil {
+		bridgeError(w, http.StatusUnauthorized, "bad token")
+		return
+	}
+	var j JSONMessage
+	if !b.readJSON(w, r, &j) {
+		return
+	}
+	kind, err := j.MessageType()
+	if err == nil && (kind == pb.MessageType_RECEIPT || isAmendment(kind)) {
+		err = errors.New("Cannot send " + kind.String() + " messages through the bridge")
+	}
+	var content []byte
+	if err == nil {
+		content, err = j.Content()
+	}
+	var reMsgId, blockId []byte
+	if err == nil && len(j.ReMsgId) > 0 {
+		reMsgId, err = base64.StdEncoding.DecodeString(j.ReMsgId)
+	}
+	if err == nil && len(j.BlockId) > 0 {
+		blockId, err = base64.StdEncoding.DecodeString(j.BlockId)
+	}
+	if err == nil {
+		err = checkTags(j.Tags)
+	}
+	if err == nil && len(j.To) == 0 {
+		err = errors.New("No recipients")
+	}
+	if err != nil {
+		bridgeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	recips := make([]*pb.Identity, 0, len(j.To))
+	for _, to := range j.To {
+		id, err := b.resolve(svc, to)
+		if err != nil {
+			bridgeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		recips = append(recips, id)
+	}
+	// Each recipient gets their own copy, encrypted to them.
+	resp := &bridgeResponse{}
+	for _, to := range recips {
+		nothin := []byte{}
+		msg := &pb.RawMessage{svc.User.identity, []*pb.Identity{to}, blockId, kind, nothin, NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, j.ExpiresUtc, reMsgId, j.Tags}
+		err := DoRawMessageEncryption(content, to, msg)
+		if err == nil {
+			err = SignRawMessage(msg, svc.User.privKey)
+		}
+		if err != nil {
+			bridgeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if err := b.say(svc, msg); err != nil {
+			resp.Error = "sending to " + to.Handle + "\\" + to.Domain + ": " + err.Error()
+			writeBridgeResponse(w, http.StatusBadGateway, resp)
+			return
+		}
+		resp.MsgIds = append(resp.MsgIds, IdentToString(msg.MsgId))
+	}
+	writeBridgeResponse(w, http.StatusOK, resp)
+}
+
+func (b *Bridge) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	svc := b.authenticate(r)
+	if svc == nil {
+		bridgeError(w, http.StatusUnauthorized, "bad token")
+		return
+	}
+	// A DELETE sets no webhook.
+	var req webhookRequest
+	switch r.Method {
+	case "PUT":
+		if !b.readJSON(w, r, &req) {
+			return
+		}
+		if err := checkWebhook(req.Url, req.Secret); err != nil {
+			bridgeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case "DELETE":
+	default:
+		bridgeError(w, http.StatusMethodNotAllowed, "use PUT or DELETE")
+		return
+	}
+	if err := b.setWebhook(svc, req.Url, req.Secret); err != nil {
+		bridgeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeBridgeResponse(w, http.StatusOK, &bridgeResponse{})
+}
+
+// Keeps a service's new webhook, or removes it if url is empty, and has
+// its worker deliver what is waiting.
+func (b *Bridge) setWebhook(svc *BridgeService, url string, secret string) error {
+	if err := b.hooks.Put(svc.Name, url, secret); err != nil {
+		return err
+	}
+	b.lck.Lock()
+	svc.Webhook, svc.Secret = url, secret
+	b.lck.Unlock()
+	b.poke(svc.User.identity)
+	return nil
+}
+
+func (b *Bridge) poke(id *pb.Identity) {
+	select {
+	case b.wake[IdentToString(id.Ident)] <- struct{}{}:
+	default:
+	}
+}
+
+// Called as a message is delivered to id, to have the worker of the
+// service it is for, if any, post it.
+func (b *Bridge) notify(id *pb.Identity, msg *pb.RawMessage) {
+	if _, ok := b.byIdent[IdentToString(id.Ident)]; ok {
+		b.poke(id)
+	}
+}
+
+// Posts what is in svc's mailbox to its webhook, oldest first, until the
+// bridge stops. A message that fails holds up the rest of svc's messages,
+// but no other service's, and is tried again with backoff.
+func (b *Bridge) deliverWebhooks(svc *BridgeService) {
+	defer b.wg.Done()
+	wake := b.wake[IdentToString(svc.User.identity.Ident)]
+	backoff := webhookRetryBackoff
+	for {
+		var retry <-chan time.Time
+		if err := b.drainMailbox(svc); err != nil {
+			log.Printf("Webhook for %s failed, retrying in %v: %v\n", svc.Name, backoff, err)
+			retry = time.After(backoff)
+			if backoff *= 2; backoff > webhookMaxBackoff {
+				backoff = webhookMaxBackoff
+			}
+		} else {
+			backoff = webhookRetryBackoff
+		}
+		select {
+		case <-wake:
+		case <-retry:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Posts each message waiting for svc and acks it once the webhook has it.
+func (b *Bridge) drainMailbox(svc *BridgeService) error {
+	box := IdentToString(svc.User.identity.Ident)
+	for _, m := range b.gs.mailboxes.Get(box, false) {
+		b.lck.Lock()
+		hook, secret := svc.Webhook, svc.Secret
+		b.lck.Unlock()
+		if len(hook) == 0 {
+			return nil
+		}
+		select {
+		case <-b.done:
+			return nil
+		default:
+		}
+		body, err := webhookBody(svc, m)
+		if err != nil {
+			// Trying again will not help, so it is dropped.
+			log.Printf("Cannot post %s to %s: %v\n", IdentToString(m.MsgId), svc.Name, err)
+		} else if err := b.postOnce(hook, secret, body); err != nil {
+			return err
+		}
+		b.gs.mailboxes.Ack(box, []uint64{m.Seq})
+	}
+	return nil
+}
+
+func webhookBody(svc *BridgeService, msg *pb.RawMessage) ([]byte, error) {
+	var pt []byte
+	if msg.MsgType != pb.MessageType_RECEIPT {
+		var err error
+		if pt, err = DoRawMessageDecryption(msg, svc.User.privKey); err != nil {
+			return nil, err
+		}
+	}
+	j, err := MakeJSONMessage(msg, pt)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(j)
+}
+
+func (b *Bridge) postOnce(hook string, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", hook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	req.Header.Set("Content-Type", bridgeJSONType)
+	req.Header.Set(WebhookTimestampHdr, strconv.FormatInt(now, 10))
+	req.Header.Set(WebhookSignatureHdr, SignWebhook(secret, now, body))
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook answered " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeMockBridge(t *testing.T, gs *GSDPServer) (*Bridge, *BridgeService) {
+	id, privk := NewIdentity("ci", "ci", "testname", "")
+	uu := MakeLocalUser(id, privk)
+	svc := &BridgeService{"ci", &uu, "s3cret-token", "", ""}
+	b, err := NewBridge(gs, []*BridgeService{svc}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, svc
+}
+
+func bridgeRequest(b *Bridge, method string, path string, token string, body string) (int, *bridgeResponse) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, req)
+	resp := &bridgeResponse{}
+	json.Unmarshal(w.Body.Bytes(), resp)
+	return w.Code, resp
+}
+
+func TestBridgeSendsToHumans(t *testing.T) {
+	gs := getMockServer(true)
+	b, svc := makeMockBridge(t, gs)
+	defer b.Stop()
+	human, humank := NewIdentity("alice", "alice", "testname", "")
+	gs.knownUsers.AddIdentity(human)
+	gs.accounts.PutAccount(&pb.Account{Ident: human})
+
+	code, resp := bridgeRequest(b, "POST", "/v1/messages", "wrong", `{"to": ["alice\\testname"], "text": "hi"}`)
+	if code != http.StatusUnauthorized {
+		t.Errorf("Accepted a bad token: %d %v", code, resp)
+	}
+	code, resp = bridgeRequest(b, "POST", "/v1/messages", svc.Token, `{"to": ["bob\\testname"], "text": "hi"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("Sent to an unknown user: %d %v", code, resp)
+	}
+	code, resp = bridgeRequest(b, "POST", "/v1/messages", svc.Token, `{"to": ["alice\\testname"], "type": "REACTION", "text": "+1"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("Sent an unsigned amendment: %d %v", code, resp)
+	}
+
+	body := `{"to": ["alice\\testname"], "type": "task_assign", "tags": ["ci"],
+		"payload": {"subject": "Build broke on main", "priority": 3, "project_tags": ["ci"]}}`
+	code, resp = bridgeRequest(b, "POST", "/v1/messages", svc.Token, body)
+	if code != http.StatusOK || len(resp.MsgIds) != 1 {
+		t.Fatalf("Bad send: %d %v", code, resp)
+	}
+	msgs := gs.mailboxes.Get(IdentToString(human.Ident), false)
+	if len(msgs) != 1 || msgs[0].MsgType != pb.MessageType_TASK_ASSIGN || msgs[0].FromIdent.Handle != "ci" || IdentToString(msgs[0].MsgId) != resp.MsgIds[0] {
+		t.Fatalf("Bad delivery: %v", msgs)
+	}
+	pt, err := DoRawMessageDecryption(msgs[0], humank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &pb.TaskAssign{}
+	if err := proto.Unmarshal(pt, task); err != nil || task.Subject != "Build broke on main" || task.Priority != 3 {
+		t.Errorf("Bad task: %v %v", task, err)
+	}
+}
+
+// A client that trusts hook's certificate and sends every request to it,
+// whatever the URL, standing in for DNS.
+func hookClient(hook *httptest.Server) *http.Client {
+	c := hook.Client()
+	c.Transport.(*http.Transport).DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		return net.Dial(network, hook.Listener.Addr().String())
+	}
+	return c
+}
+
+// The name hook's certificate is for, on hook's port.
+func hookURL(hook *httptest.Server) string {
+	_, port, _ := net.SplitHostPort(hook.Listener.Addr().String())
+	return "https://example.com:" + port + "/hook"
+}
+
+func TestBridgeWebhooks(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got <- r
+		bodies <- body
+	}))
+	defer hook.Close()
+
+	gs := getMockServer(true)
+	b, svc := makeMockBridge(t, gs)
+	defer b.Stop()
+	b.http = hookClient(hook)
+	if code, _ := bridgeRequest(b, "PUT", "/v1/webhook", svc.Token, `{"url": "`+hookURL(hook)+`"}`); code != http.StatusBadRequest {
+		t.Errorf("Set a webhook without a secret: %d", code)
+	}
+	if code, _ := bridgeRequest(b, "PUT", "/v1/webhook", svc.Token, `{"url": "`+hook.URL+`", "secret": "shh"}`); code != http.StatusBadRequest {
+		t.Errorf("Set a webhook on a loopback address: %d", code)
+	}
+	if code, _ := bridgeRequest(b, "PUT", "/v1/webhook", svc.Token, `{"url": "`+hookURL(hook)+`", "secret": "shh"}`); code != http.StatusOK {
+		t.Fatalf("Could not set webhook: %d", code)
+	}
+
+	human, _ := NewIdentity("alice", "alice", "testname", "")
+	gs.knownUsers.AddIdentity(human)
+	nothin := []byte{}
+	msg := &pb.RawMessage{human, []*pb.Identity{svc.User.identity}, nothin, pb.MessageType_QUESTION, nothin, NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+	DoRawMessageEncryption([]byte("is main green?"), svc.User.identity, msg)
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Fatal(ack.Error)
+	}
+
+	select {
+	case r := <-got:
+		body := <-bodies
+		sig, ts := r.Header.Get(WebhookSignatureHdr), r.Header.Get(WebhookTimestampHdr)
+		if !VerifyWebhook("shh", sig, ts, body, time.Minute) {
+			t.Error("Bad webhook signature")
+		}
+		if VerifyWebhook("other", sig, ts, body, time.Minute) {
+			t.Error("Signature verified with the wrong secret")
+		}
+		var j JSONMessage
+		if err := json.Unmarshal(body, &j); err != nil {
+			t.Fatal(err)
+		}
+		if j.Type != "QUESTION" || j.Text != "is main green?" || j.From.Handle != "alice" || j.MsgId != IdentToString(msg.MsgId) {
+			t.Errorf("Bad webhook message: %v", j)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No webhook")
+	}
+	if !waitForEmptyMailbox(gs, svc) {
+		t.Error("Delivered webhook not acked")
+	}
+}
+
+func waitForEmptyMailbox(gs *GSDPServer, svc *BridgeService) bool {
+	for i := 0; i < 100; i++ {
+		if n, _ := gs.mailboxes.Stat(IdentToString(svc.User.identity.Ident)); n == 0 {
+			return true
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return false
+}
+
+func TestWebhooksAreRetriedAndKept(t *testing.T) {
+	calls := make(chan int, 10)
+	n := 0
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		calls <- n
+		if n == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hook.Close()
+	dir, err := ioutil.TempDir("", "gsdp-webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks")
+	store, err := MakeFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gs := getMockServer(true)
+	id, privk := NewIdentity("ci", "ci", "testname", "")
+	uu := MakeLocalUser(id, privk)
+	svc := &BridgeService{"ci", &uu, "s3cret-token", "", ""}
+	b, err := NewBridge(gs, []*BridgeService{svc}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.http = hookClient(hook)
+
+	// Mail that arrives before there is a webhook waits for one.
+	human, _ := NewIdentity("alice", "alice", "testname", "")
+	gs.knownUsers.AddIdentity(human)
+	msg := makeEncryptedMessage(t, human, svc.User.identity, "deploy?")
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Fatal(ack.Error)
+	}
+	if code, _ := bridgeRequest(b, "PUT", "/v1/webhook", svc.Token, `{"url": "`+hookURL(hook)+`", "secret": "shh"}`); code != http.StatusOK {
+		t.Fatalf("Could not set webhook: %d", code)
+	}
+	for want := 1; want <= 2; want++ {
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Webhook called %d times, wanted %d", want-1, want)
+		}
+	}
+	if !waitForEmptyMailbox(gs, svc) {
+		t.Error("Retried webhook not acked")
+	}
+	b.Stop()
+
+	// The webhook outlives the bridge.
+	reloaded, err := MakeFileWebhookStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc2 := &BridgeService{"ci", &uu, "s3cret-token", "", ""}
+	b2, err := NewBridge(gs, []*BridgeService{svc2}, reloaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b2.Stop()
+	if svc2.Webhook != hookURL(hook) || svc2.Secret != "shh" {
+		t.Errorf("Webhook not kept: %q %q", svc2.Webhook, svc2.Secret)
+	}
+}
+
+func TestWebhookTargets(t *testing.T) {
+	for _, u := range []string{"http://example.com/hook", "https://localhost/hook", "https://127.0.0.1/hook", "https://10.1.2.3/hook", "https://192.168.0.1/hook", "https://169.254.169.254/latest", "https://[::1]/hook", "https://[fe80::1]/hook", "https://0.0.0.0/hook"} {
+		if err := checkWebhook(u, "shh"); err == nil {
+			t.Errorf("Accepted webhook %s", u)
+		}
+	}
+	if err := checkWebhook("https://example.com/hook", "shh"); err != nil {
+		t.Errorf("Rejected a public webhook: %v", err)
+	}
+	// Names are checked again once resolved.
+	for _, addr := range []string{"127.0.0.1:443", "10.0.0.8:443", "[::1]:443", "169.254.169.254:80"} {
+		if err := webhookDialControl("tcp", addr, nil); err == nil {
+			t.Errorf("Dialed %s for a webhook", addr)
+		}
+	}
+	if err := webhookDialControl("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("Would not dial a public address: %v", err)
+	}
+}
+
+func TestBridgeListensOnLoopbackWithoutTLS(t *testing.T) {
+	lis, err := listenBridge(":0", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	if ip := lis.Addr().(*net.TCPAddr).IP; !ip.IsLoopback() {
+		t.Errorf("Bridge without TLS listening on %v", ip)
+	}
+	if lis, err := listenBridge("0.0.0.0:0", "", ""); err == nil {
+		lis.Close()
+		t.Error("Bridge without TLS listened on every interface")
+	}
+}
@@ -0,0 +1,371 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	icsTimeFormat  = "20060102T150405Z"
+	icsLocalFormat = "20060102T150405"
+	icsDateFormat  = "20060102"
+	icsLineLen     = 75
+)
+
+// An Event is an invitation, sent to us or by us, with the replies to it
+// that we have seen. MsgId is what replies refer to: the invitation_id every
+// copy of the invitation shares, or for invitations without one, the msg_id
+// of the copy. Invitees are everyone the copies we have went to, and only
+// their replies count. Replies are keyed by IdentToString of the invitee's
+// ident.
+type Event struct {
+	MsgId      []byte
+	Organizer  *pb.Identity
+	Invitation *pb.Invitation
+	Cancelled  bool
+	Invitees   []*pb.Identity
+	Replies    map[string]*pb.Rsvp
+}
+
+// Invite sends inv to each of to, every copy with the same invitation_id,
+// and returns the messages sent. Keep them (see KeepSent) to see the
+// replies in BuildCalendar.
+func (c *GSDPClient) Invite(inv *pb.Invitation, to []*pb.Identity) ([]*pb.RawMessage, error) {
+	if len(inv.InvitationId) == 0 {
+		inv.InvitationId = NewMsgId()
+	}
+	msgs := make([]*pb.RawMessage, 0, len(to))
+	for _, id := range to {
+		msg, err := c.SendPayload(pb.MessageType_INVITATION, inv, id)
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// Rsvp answers the invitation with id reMsgId, telling its organizer.
+func (c *GSDPClient) Rsvp(reMsgId []byte, organizer *pb.Identity, response pb.RsvpResponse, note string) error {
+	_, err := c.SendPayload(pb.MessageType_RSVP, &pb.Rsvp{reMsgId, response, note, time.Now().Unix()}, organizer)
+	return err
+}
+
+// Events are told apart by organizer as well as id, so nobody can add to
+// someone else's event by reusing its invitation_id.
+func eventKey(organizer *pb.Identity, id []byte) string {
+	return IdentToString(organizer.Ident) + "\n" + string(id)
+}
+
+func hasIdent(ids []*pb.Identity, id *pb.Identity) bool {
+	for _, i := range ids {
+		if bytes.Equal(i.Ident, id.Ident) {
+			return true
+		}
+	}
+	return false
+}
+
+// BuildCalendar makes a list of events, by start time, from the invitations
+// among msgs, and applies the replies to them. Copies of one invitation to
+// several invitees are one event. An event is cancelled once every copy of
+// it has been retracted. Only the latest reply from each invitee counts.
+func BuildCalendar(msgs []*ViewMessage) []*Event {
+	byKey := make(map[string]*Event)
+	events := make([]*Event, 0)
+	for _, vm := range msgs {
+		if vm.Msg.MsgType != pb.MessageType_INVITATION || len(vm.Msg.MsgId) == 0 || vm.Msg.FromIdent == nil {
+			continue
+		}
+		p, err := OpenPayload(vm.Msg.MsgType, vm.Plaintext)
+		if err != nil {
+			continue
+		}
+		inv := p.(*pb.Invitation)
+		id := inv.InvitationId
+		if len(id) == 0 {
+			id = vm.Msg.MsgId
+		}
+		ev, ok := byKey[eventKey(vm.Msg.FromIdent, id)]
+		if !ok {
+			ev = &Event{id, vm.Msg.FromIdent, inv, true, make([]*pb.Identity, 0), make(map[string]*pb.Rsvp)}
+			byKey[eventKey(vm.Msg.FromIdent, id)] = ev
+			events = append(events, ev)
+		}
+		// Replies from before invitations had ids refer to the copy.
+		byKey[eventKey(vm.Msg.FromIdent, vm.Msg.MsgId)] = ev
+		ev.Cancelled = ev.Cancelled && vm.Retracted
+		for _, to := range vm.Msg.ToIdent {
+			if !hasIdent(ev.Invitees, to) {
+				ev.Invitees = append(ev.Invitees, to)
+			}
+		}
+	}
+	for _, vm := range msgs {
+		if vm.Msg.MsgType != pb.MessageType_RSVP || vm.Msg.FromIdent == nil || len(vm.Msg.ToIdent) == 0 {
+			continue
+		}
+		p, err := OpenPayload(vm.Msg.MsgType, vm.Plaintext)
+		if err != nil {
+			continue
+		}
+		r := p.(*pb.Rsvp)
+		ev, ok := byKey[eventKey(vm.Msg.ToIdent[0], r.ReMsgId)]
+		if !ok || !hasIdent(ev.Invitees, vm.Msg.FromIdent) {
+			continue
+		}
+		k := IdentToString(vm.Msg.FromIdent.Ident)
+		if old, ok := ev.Replies[k]; !ok || r.Timestamp >= old.Timestamp {
+			ev.Replies[k] = r
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Invitation.EventTime < events[j].Invitation.EventTime })
+	return events
+}
+
+// ReplyCounts counts the replies to an event by response.
+func (ev *Event) ReplyCounts() map[pb.RsvpResponse]int {
+	counts := make(map[pb.RsvpResponse]int)
+	for _, r := range ev.Replies {
+		counts[r.Response]++
+	}
+	return counts
+}
+
+var icsEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n", "\r", "\\n")
+
+var icsUnescaper = strings.NewReplacer("\\\\", "\\", "\\;", ";", "\\,", ",", "\\n", "\n", "\\N", "\n")
+
+// Makes s safe as a quoted parameter value, which cannot hold quotes or
+// control characters; a line break in one would start a new property.
+func icsParamValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '"' {
+			return '\''
+		} else if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Writes one content line, folded at 75 octets without splitting characters.
+func writeICSLine(w *bufio.Writer, line string) {
+	prefix := ""
+	for len(prefix)+len(line) > icsLineLen {
+		n := icsLineLen - len(prefix)
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		w.WriteString(prefix + line[:n] + "\r\n")
+		line = line[n:]
+		prefix = " "
+	}
+	w.WriteString(prefix + line + "\r\n")
+}
+
+// WriteICS writes events as an iCalendar file that ordinary calendar
+// software can import. Each event's UID comes from its invitation's msg_id.
+func WriteICS(w io.Writer, events []*Event) error {
+	bw := bufio.NewWriter(w)
+	writeICSLine(bw, "BEGIN:VCALENDAR")
+	writeICSLine(bw, "VERSION:2.0")
+	writeICSLine(bw, "PRODID:-//gsdp//gsdp//EN")
+	for _, ev := range events {
+		inv := ev.Invitation
+		writeICSLine(bw, "BEGIN:VEVENT")
+		writeICSLine(bw, "UID:"+base64.RawURLEncoding.EncodeToString(ev.MsgId)+"@gsdp")
+		stamp := inv.Timestamp
+		if stamp == 0 {
+			stamp = time.Now().Unix()
+		}
+		writeICSLine(bw, "DTSTAMP:"+time.Unix(stamp, 0).UTC().Format(icsTimeFormat))
+		writeICSLine(bw, "DTSTART:"+time.Unix(inv.EventTime, 0).UTC().Format(icsTimeFormat))
+		if inv.EndTime > inv.EventTime {
+			writeICSLine(bw, "DTEND:"+time.Unix(inv.EndTime, 0).UTC().Format(icsTimeFormat))
+		}
+		writeICSLine(bw, "SUMMARY:"+icsEscaper.Replace(inv.Subject))
+		if len(inv.Note) > 0 {
+			writeICSLine(bw, "DESCRIPTION:"+icsEscaper.Replace(inv.Note))
+		}
+		if len(inv.Location) > 0 {
+			writeICSLine(bw, "LOCATION:"+icsEscaper.Replace(inv.Location))
+		}
+		if ev.Organizer != nil {
+			writeICSLine(bw, "ORGANIZER;CN=\""+icsParamValue(ev.Organizer.Name)+"\":urn:gsdp:"+base64.RawURLEncoding.EncodeToString(ev.Organizer.Ident))
+		}
+		if ev.Cancelled {
+			writeICSLine(bw, "STATUS:CANCELLED")
+		}
+		writeICSLine(bw, "END:VEVENT")
+	}
+	writeICSLine(bw, "END:VCALENDAR")
+	return bw.Flush()
+}
+
+var icsDurationRe = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+func parseICSDuration(s string) (time.Duration, error) {
+	m := icsDurationRe.FindStringSubmatch(s)
+	if m == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, errors.New("Bad iCalendar duration " + s)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	d := time.Duration(0)
+	for i, u := range units {
+		if len(m[i+2]) > 0 {
+			n, _ := strconv.Atoi(m[i+2])
+			d += time.Duration(n) * u
+		}
+	}
+	if m[1] == "-" {
+		d = -d
+	}
+	return d, nil
+}
+
+// Times are UTC if they end in Z, in their TZID if we know it, and local
+// otherwise. Dates are midnight local time.
+func parseICSTime(value string, params map[string]string) (int64, error) {
+	loc := time.Local
+	if tzid, ok := params["TZID"]; ok {
+		if l, err := time.LoadLocation(strings.Trim(tzid, "\"")); err == nil {
+			loc = l
+		}
+	}
+	var t time.Time
+	var err error
+	switch {
+	case strings.HasSuffix(value, "Z"):
+		t, err = time.Parse(icsTimeFormat, value)
+	case len(value) == len(icsDateFormat):
+		t, err = time.ParseInLocation(icsDateFormat, value, time.Local)
+	default:
+		t, err = time.ParseInLocation(icsLocalFormat, value, loc)
+	}
+	if err != nil {
+		return 0, errors.New("Bad iCalendar time " + value)
+	}
+	return t.Unix(), nil
+}
+
+// Splits a content line into its name, parameters and value.
+func parseICSLine(line string) (string, map[string]string, string) {
+	params := make(map[string]string)
+	quoted := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return "", params, ""
+	}
+	pcs := strings.Split(line[:colon], ";")
+	for _, p := range pcs[1:] {
+		if kv := strings.SplitN(p, "=", 2); len(kv) == 2 {
+			params[strings.ToUpper(kv[0])] = kv[1]
+		}
+	}
+	return strings.ToUpper(pcs[0]), params, line[colon+1:]
+}
+
+// ReadICS reads the events in an iCalendar file as invitations, ready to be
+// sent. Events without a start time are skipped.
+func ReadICS(r io.Reader) ([]*pb.Invitation, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	lines := make([]string, 0)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+		} else if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	invs := make([]*pb.Invitation, 0)
+	var inv *pb.Invitation
+	var dur time.Duration
+	depth := 0
+	for _, line := range lines {
+		name, params, value := parseICSLine(line)
+		switch {
+		case name == "BEGIN" && strings.ToUpper(value) == "VEVENT":
+			inv, dur, depth = &pb.Invitation{Timestamp: time.Now().Unix()}, 0, 0
+		case inv == nil:
+			// Outside any event.
+		case name == "BEGIN":
+			// Skip nested components such as alarms.
+			depth++
+		case name == "END" && depth > 0:
+			depth--
+		case depth > 0:
+		case name == "END" && strings.ToUpper(value) == "VEVENT":
+			if inv.EventTime != 0 {
+				if inv.EndTime == 0 && dur > 0 {
+					inv.EndTime = inv.EventTime + int64(dur/time.Second)
+				}
+				invs = append(invs, inv)
+			}
+			inv = nil
+		case name == "SUMMARY":
+			inv.Subject = icsUnescaper.Replace(value)
+		case name == "DESCRIPTION":
+			inv.Note = icsUnescaper.Replace(value)
+		case name == "LOCATION":
+			inv.Location = icsUnescaper.Replace(value)
+		case name == "DTSTART" || name == "DTEND":
+			t, err := parseICSTime(value, params)
+			if err != nil {
+				return nil, err
+			}
+			if name == "DTSTART" {
+				inv.EventTime = t
+			} else {
+				inv.EndTime = t
+			}
+		case name == "DURATION":
+			d, err := parseICSDuration(value)
+			if err != nil {
+				return nil, err
+			}
+			dur = d
+		}
+	}
+	return invs, nil
+}
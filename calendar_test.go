@@ -0,0 +1,134 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildCalendar(t *testing.T) {
+	alice, alicek, _ := makeAnIdentity()
+	bob, _, _ := makeAnIdentity()
+	carol, _, _ := makeAnIdentity()
+	v := NewMessageView()
+	addPayload := func(kind pb.MessageType, from *pb.Identity, to *pb.Identity, p proto.Message) *pb.RawMessage {
+		msg := makeMockMessage(from, to)
+		msg.MsgType = kind
+		bs, _ := proto.Marshal(p)
+		v.Add(msg, bs)
+		return msg
+	}
+	dave, _, _ := makeAnIdentity()
+	mallory, _, _ := makeAnIdentity()
+
+	// An invitation from before they had ids, answered by its msg_id.
+	later := addPayload(pb.MessageType_INVITATION, alice, bob, &pb.Invitation{Subject: "Retro", EventTime: 2000})
+	addPayload(pb.MessageType_RSVP, bob, alice, &pb.Rsvp{later.MsgId, pb.RsvpResponse_ACCEPT, "", 5})
+	// As alice sees it: the copies she sent to bob and carol, and their
+	// replies to the invitation id.
+	invId := NewMsgId()
+	addPayload(pb.MessageType_INVITATION, alice, bob, &pb.Invitation{Subject: "Standup", EventTime: 1000, InvitationId: invId})
+	addPayload(pb.MessageType_INVITATION, alice, carol, &pb.Invitation{Subject: "Standup", EventTime: 1000, InvitationId: invId})
+	addPayload(pb.MessageType_RSVP, bob, alice, &pb.Rsvp{invId, pb.RsvpResponse_TENTATIVE, "", 10})
+	addPayload(pb.MessageType_RSVP, bob, alice, &pb.Rsvp{invId, pb.RsvpResponse_ACCEPT, "", 20})
+	addPayload(pb.MessageType_RSVP, carol, alice, &pb.Rsvp{invId, pb.RsvpResponse_DECLINE, "", 15})
+	// Not invited, so not counted.
+	addPayload(pb.MessageType_RSVP, dave, alice, &pb.Rsvp{invId, pb.RsvpResponse_DECLINE, "", 15})
+	// Reusing the id makes another event, not a change to alice's.
+	addPayload(pb.MessageType_INVITATION, mallory, alice, &pb.Invitation{Subject: "Standup moved", EventTime: 3000, InvitationId: invId})
+	retract, pt := makeMockAmendment(t, pb.MessageType_RETRACT, later, "", alice, alicek)
+	v.Add(retract, pt)
+
+	events := BuildCalendar(v.Messages())
+	if len(events) != 3 || events[0].Invitation.Subject != "Standup" || !events[1].Cancelled || events[2].Organizer != mallory {
+		t.Fatalf("Bad calendar: %v", events)
+	}
+	if len(events[0].Invitees) != 2 || string(events[0].MsgId) != string(invId) {
+		t.Errorf("Copies of one invitation not merged: %v", events[0])
+	}
+	counts := events[0].ReplyCounts()
+	if counts[pb.RsvpResponse_ACCEPT] != 1 || counts[pb.RsvpResponse_DECLINE] != 1 || counts[pb.RsvpResponse_TENTATIVE] != 0 {
+		t.Errorf("Bad replies: %v", counts)
+	}
+	if len(events[1].Replies) != 1 || len(events[2].Replies) != 0 {
+		t.Errorf("Replies matched to the wrong events: %v %v", events[1].Replies, events[2].Replies)
+	}
+}
+
+func TestICSRoundTrip(t *testing.T) {
+	alice, _, _ := makeAnIdentity()
+	start := time.Date(2017, 6, 1, 15, 0, 0, 0, time.UTC)
+	alice.Name = "Alice\r\nATTENDEE:mailto:eve@example.com"
+	inv := &pb.Invitation{"Planning; Q3, all hands", 100, strings.Repeat("Bring notes.\n", 10), start.Unix(), nil, start.Add(time.Hour).Unix(), "Room \\ 4", nil}
+	var buf bytes.Buffer
+	if err := WriteICS(&buf, []*Event{&Event{NewMsgId(), alice, inv, false, nil, nil}}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "\nATTENDEE") || strings.ContainsAny(icsEscaper.Replace("a\rb"), "\r") {
+		t.Errorf("Line breaks got into the calendar: %q", buf.String())
+	}
+	for _, line := range strings.Split(buf.String(), "\r\n") {
+		if len(line) > icsLineLen {
+			t.Errorf("Line not folded: %q", line)
+		}
+	}
+	invs, err := ReadICS(&buf)
+	if err != nil || len(invs) != 1 {
+		t.Fatalf("Read back %d events: %v", len(invs), err)
+	}
+	got := invs[0]
+	if got.Subject != inv.Subject || got.Note != inv.Note || got.Location != inv.Location || got.EventTime != inv.EventTime || got.EndTime != inv.EndTime {
+		t.Errorf("Event changed on the way through: %v", got)
+	}
+}
+
+func TestReadICS(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"SUMMARY:Dentist",
+		"DTSTART;TZID=America/New_York:20170601T090000",
+		"DURATION:PT1H30M",
+		"DESCRIPTION:Bring the",
+		"  insurance card",
+		"BEGIN:VALARM",
+		"DESCRIPTION:Reminder",
+		"END:VALARM",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"SUMMARY:No start",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	invs, err := ReadICS(strings.NewReader(ics))
+	if err != nil || len(invs) != 1 {
+		t.Fatalf("Read %d events: %v", len(invs), err)
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone database")
+	}
+	start := time.Date(2017, 6, 1, 9, 0, 0, 0, ny).Unix()
+	if inv := invs[0]; inv.EventTime != start || inv.EndTime != start+5400 || inv.Note != "Bring the insurance card" {
+		t.Errorf("Bad event: %v", inv)
+	}
+}
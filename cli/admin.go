@@ -0,0 +1,164 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultAdminServer = "localhost:50052"
+)
+
+type accountRecord struct {
+	User        *gsdp.JSONIdent `json:"user"`
+	Suspended   bool            `json:"suspended,omitempty"`
+	MaxMessages int64           `json:"max_messages,omitempty"`
+	MaxBytes    int64           `json:"max_bytes,omitempty"`
+}
+
+type mailboxRecord struct {
+	Mailbox  *gsdp.JSONIdent `json:"mailbox"`
+	Messages int64           `json:"messages"`
+	Bytes    int64           `json:"bytes"`
+}
+
+func printAdminUsage() {
+	fmt.Printf("Usage: %s admin <register|deregister|quota|suspend|unsuspend|users|mailboxes|export> *args\n", os.Args[0])
+}
+
+func runAdmin(args []string, adminIdentPath *string, config GsdpAdminConfig) {
+	if len(args) < 1 {
+		printAdminUsage()
+		os.Exit(2)
+	}
+	adminCmd := flag.NewFlagSet("admin "+args[0], flag.ExitOnError)
+	addOutputFlag(adminCmd)
+	identPath := adminCmd.String("id", "", "Admin identity path (without .priv or .ident)")
+	server := adminCmd.String("server", "", "Admin service address (host:port)")
+	caCert := adminCmd.String("cacert", "", "Certificate to trust for the admin service's TLS, if not the system's")
+	userPath := adminCmd.String("user", "", "User public identity path (without .ident)")
+	maxMsgs := adminCmd.Int64("maxmsgs", 0, "Mailbox quota in messages (0 for unlimited)")
+	maxBytes := adminCmd.Int64("maxbytes", 0, "Mailbox quota in bytes (0 for unlimited)")
+	exportFile := adminCmd.String("file", "", "File to export the user's mailbox to")
+	adminCmd.Parse(args[1:])
+
+	if len(*identPath) == 0 && adminIdentPath != nil {
+		identPath = adminIdentPath
+	}
+	if len(*server) == 0 {
+		*server = config.Server
+	}
+	if len(*server) == 0 {
+		*server = defaultAdminServer
+	}
+	if len(*caCert) == 0 {
+		*caCert = config.CACert
+	}
+	id, privk, err := gsdp.LoadIdentity(*identPath)
+	if err != nil {
+		panic(err)
+	}
+	admin := gsdp.MakeLocalUser(id, privk)
+	client, err := gsdp.NewAdminClient(&admin, *server, *caCert)
+	if err != nil {
+		panic(err)
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "users":
+		accts, err := client.ListUsers()
+		if err != nil {
+			panic(err)
+		}
+		matrix := make([][]string, 0)
+		records := make([]interface{}, 0, len(accts))
+		for _, a := range accts {
+			status := "active"
+			if a.Suspended {
+				status = "suspended"
+			}
+			matrix = append(matrix, []string{a.Ident.Handle + "\\" + a.Ident.Domain, status, strconv.FormatInt(a.MaxMessages, 10), strconv.FormatInt(a.MaxBytes, 10)})
+			records = append(records, &accountRecord{gsdp.MakeJSONIdent(a.Ident), a.Suspended, a.MaxMessages, a.MaxBytes})
+		}
+		printOutput(matrix, records)
+		return
+	case "mailboxes":
+		boxes, err := client.ListMailboxes()
+		if err != nil {
+			panic(err)
+		}
+		matrix := make([][]string, 0)
+		records := make([]interface{}, 0, len(boxes))
+		for _, b := range boxes {
+			name := gsdp.IdentToString(b.Ident.Ident)
+			if len(b.Ident.Handle) > 0 {
+				name = b.Ident.Handle + "\\" + b.Ident.Domain
+			}
+			matrix = append(matrix, []string{name, strconv.FormatInt(b.MessageCount, 10), strconv.FormatInt(b.TotalBytes, 10)})
+			records = append(records, &mailboxRecord{gsdp.MakeJSONIdent(b.Ident), b.MessageCount, b.TotalBytes})
+		}
+		printOutput(matrix, records)
+		return
+	}
+
+	if len(*userPath) == 0 {
+		panic(errors.New("Need a -user for admin " + args[0]))
+	}
+	user, err := gsdp.LoadPublicIdentity(*userPath)
+	if err != nil {
+		panic(err)
+	}
+	switch args[0] {
+	case "register":
+		err = client.RegisterUser(user, *maxMsgs, *maxBytes)
+	case "deregister":
+		err = client.DeregisterUser(user)
+	case "quota":
+		err = client.SetQuota(user, *maxMsgs, *maxBytes)
+	case "suspend":
+		err = client.SuspendUser(user, true)
+	case "unsuspend":
+		err = client.SuspendUser(user, false)
+	case "export":
+		if len(*exportFile) == 0 {
+			panic(errors.New("Need a -file for admin export"))
+		}
+		var data []byte
+		if data, err = client.ExportMailbox(user); err == nil {
+			err = ioutil.WriteFile(*exportFile, data, 0600)
+		}
+	default:
+		printAdminUsage()
+		os.Exit(2)
+	}
+	if err != nil {
+		panic(err)
+	}
+	rec := &resultRecord{Action: args[0], To: user.Handle + "\\" + user.Domain}
+	if args[0] == "export" {
+		rec.File = *exportFile
+	}
+	printResult(rec, "OK: %s %s\\%s\n", args[0], user.Handle, user.Domain)
+}
@@ -0,0 +1,120 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	eventTimeFormat = "2006-01-02 15:04"
+)
+
+// Builds an invitation from the invite subcommand's flags.
+func invitationFromFlags(subject, note, location, at string, duration time.Duration) (*pb.Invitation, error) {
+	if len(subject) == 0 || len(at) == 0 {
+		return nil, errors.New("Need a -subject and an -at time, or an -ics file")
+	}
+	t, err := time.ParseInLocation(eventTimeFormat, at, time.Local)
+	if err != nil {
+		return nil, errors.New("Bad -at time " + at + ", want YYYY-MM-DD HH:MM")
+	}
+	inv := &pb.Invitation{subject, time.Now().Unix(), note, t.Unix(), nil, 0, location, nil}
+	if duration > 0 {
+		inv.EndTime = t.Add(duration).Unix()
+	}
+	return inv, nil
+}
+
+func invitationsFromICS(path string) ([]*pb.Invitation, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	return gsdp.ReadICS(fh)
+}
+
+func parseRsvpResponse(s string) (pb.RsvpResponse, error) {
+	v, ok := pb.RsvpResponse_value[strings.ToUpper(s)]
+	if !ok || pb.RsvpResponse(v) == pb.RsvpResponse_NO_REPLY {
+		return 0, errors.New("Response must be accept, decline or tentative")
+	}
+	return pb.RsvpResponse(v), nil
+}
+
+type replyRecord struct {
+	Ident    string `json:"ident"`
+	Response string `json:"response"`
+	Note     string `json:"note,omitempty"`
+	Tstamp   int64  `json:"tstamp,omitempty"`
+}
+
+type eventRecord struct {
+	MsgId     string          `json:"msg_id"`
+	Organizer *gsdp.JSONIdent `json:"organizer,omitempty"`
+	Subject   string          `json:"subject"`
+	Note      string          `json:"note,omitempty"`
+	Location  string          `json:"location,omitempty"`
+	Start     int64           `json:"start"`
+	End       int64           `json:"end,omitempty"`
+	Cancelled bool            `json:"cancelled,omitempty"`
+	Replies   []*replyRecord  `json:"replies,omitempty"`
+}
+
+func makeEventRecord(ev *gsdp.Event) *eventRecord {
+	inv := ev.Invitation
+	rec := &eventRecord{gsdp.IdentToString(ev.MsgId), gsdp.MakeJSONIdent(ev.Organizer), inv.Subject, inv.Note, inv.Location, inv.EventTime, inv.EndTime, ev.Cancelled, nil}
+	for k, r := range ev.Replies {
+		rec.Replies = append(rec.Replies, &replyRecord{k, r.Response.String(), r.Note, r.Timestamp})
+	}
+	sort.Slice(rec.Replies, func(i, j int) bool { return rec.Replies[i].Ident < rec.Replies[j].Ident })
+	return rec
+}
+
+func printEvents(events []*gsdp.Event) {
+	matrix := [][]string{[]string{"when", "subject", "organizer", "where", "replies", "id"}}
+	records := make([]interface{}, 0, len(events))
+	for _, ev := range events {
+		records = append(records, makeEventRecord(ev))
+		inv := ev.Invitation
+		subject := inv.Subject
+		if ev.Cancelled {
+			subject += " (cancelled)"
+		}
+		replies := make([]string, 0)
+		counts := ev.ReplyCounts()
+		for _, r := range []pb.RsvpResponse{pb.RsvpResponse_ACCEPT, pb.RsvpResponse_TENTATIVE, pb.RsvpResponse_DECLINE} {
+			if counts[r] > 0 {
+				replies = append(replies, fmt.Sprintf("%d %s", counts[r], strings.ToLower(r.String())))
+			}
+		}
+		organizer := "-"
+		if ev.Organizer != nil {
+			organizer = ev.Organizer.Handle + "\\" + ev.Organizer.Domain
+		}
+		matrix = append(matrix, []string{time.Unix(inv.EventTime, 0).Format(eventTimeFormat), subject, organizer, inv.Location, strings.Join(replies, ", "), gsdp.IdentToString(ev.MsgId)})
+	}
+	printOutput(matrix, records)
+}
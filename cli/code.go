@@ -0,0 +1,145 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	ansiReset   = "\x1b[0m"
+	ansiRed     = "\x1b[31m"
+	ansiGreen   = "\x1b[32m"
+	ansiBlue    = "\x1b[34m"
+	ansiMagenta = "\x1b[35m"
+	ansiCyan    = "\x1b[36m"
+	ansiGrey    = "\x1b[90m"
+)
+
+type syntax struct {
+	comment  string
+	keywords map[string]bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+var cLikeKeywords = "if else for while do switch case default break continue return struct enum union typedef static const void int char long short unsigned float double sizeof goto"
+
+var syntaxes = map[string]syntax{
+	"go":         {"//", keywordSet("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false")},
+	"c":          {"//", keywordSet(cLikeKeywords)},
+	"c++":        {"//", keywordSet(cLikeKeywords + " class namespace template typename public private protected virtual new delete this nullptr auto")},
+	"java":       {"//", keywordSet("class interface extends implements public private protected static final void new return if else for while switch case break continue try catch finally throw throws import package this null true false")},
+	"javascript": {"//", keywordSet("var let const function return if else for while switch case break continue new this class extends import export from try catch finally throw null undefined true false async await")},
+	"typescript": {"//", keywordSet("var let const function return if else for while switch case break continue new this class extends implements interface type import export from try catch finally throw null undefined true false async await")},
+	"rust":       {"//", keywordSet("fn let mut const static struct enum impl trait pub use mod crate self match if else loop while for in return break continue true false")},
+	"protobuf":   {"//", keywordSet("syntax package import message enum service rpc returns repeated optional oneof map")},
+	"python":     {"#", keywordSet("def class return if elif else for while in not and or is import from as try except finally raise with yield lambda pass break continue None True False")},
+	"ruby":       {"#", keywordSet("def class module end if elsif else unless while until for in do return yield begin rescue ensure nil true false self")},
+	"shell":      {"#", keywordSet("if then else elif fi for while do done case esac function return in export local")},
+	"yaml":       {"#", nil},
+	"toml":       {"#", nil},
+	"make":       {"#", nil},
+	"sql":        {"--", keywordSet("SELECT FROM WHERE INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE DROP ALTER JOIN LEFT RIGHT INNER OUTER ON AND OR NOT NULL ORDER BY GROUP HAVING LIMIT AS select from where insert into values update set delete create table drop alter join on and or not null order by group having limit as")},
+}
+
+var wordRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// Only color output going to a terminal, and never if NO_COLOR is set.
+func useColor() bool {
+	if len(os.Getenv("NO_COLOR")) > 0 {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func colored(color string, s string) string {
+	return color + s + ansiReset
+}
+
+func highlightLine(line string, lang string) string {
+	if lang == gsdp.DiffLanguage {
+		switch {
+		case strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---"):
+			return colored(ansiBlue, line)
+		case strings.HasPrefix(line, "@@"):
+			return colored(ansiCyan, line)
+		case strings.HasPrefix(line, "+"):
+			return colored(ansiGreen, line)
+		case strings.HasPrefix(line, "-"):
+			return colored(ansiRed, line)
+		}
+		return line
+	}
+	syn, ok := syntaxes[lang]
+	if !ok {
+		return line
+	}
+	comment := ""
+	if i := strings.Index(line, syn.comment); i >= 0 {
+		line, comment = line[:i], colored(ansiGrey, line[i:])
+	}
+	line = wordRe.ReplaceAllStringFunc(line, func(w string) string {
+		if syn.keywords[w] {
+			return colored(ansiMagenta, w)
+		}
+		return w
+	})
+	return line + comment
+}
+
+// Prints a code share with a header, line numbers, and in a terminal, colors
+// for its language.
+func printCodeShare(msg *pb.RawMessage, cs *pb.CodeShare) {
+	lang := strings.ToLower(cs.Language)
+	if len(lang) == 0 {
+		lang = "text"
+	}
+	header := lang
+	if len(cs.Filename) > 0 {
+		header = cs.Filename + " (" + lang + ")"
+	}
+	fmt.Printf("%s\\%s shared %s\n", msg.FromIdent.Handle, msg.FromIdent.Domain, header)
+	if len(cs.Note) > 0 {
+		fmt.Printf("%s\n", cs.Note)
+	}
+	if gsdp.IsPatch(cs) {
+		fmt.Printf("Apply with: gsdpcli apply -re %s\n", gsdp.IdentToString(msg.MsgId))
+	}
+	fmt.Printf("\n")
+	color := useColor()
+	lines := strings.Split(strings.TrimSuffix(cs.Code, "\n"), "\n")
+	width := len(fmt.Sprintf("%d", len(lines)))
+	for i, line := range lines {
+		if color {
+			line = highlightLine(line, lang)
+		}
+		fmt.Printf("%*d | %s\n", width, i+1, line)
+	}
+}
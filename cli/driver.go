@@ -17,28 +17,200 @@
 package main
 
 import (
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/jwvictor/gsdp"
 	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 )
 
+const (
+	shutdownTimeout      = 30 * time.Second
+	defaultWatchPollFreq = 5 * time.Second
+	popPageSize          = 100
+)
+
 type GsdpIdentConfig struct {
 	IdentityPath      string `toml:"ident"`
 	PubIdentitiesPath string `toml:"idents_path"`
+	IdentitiesDbPath  string `toml:"idents_db"`
+	ArchivePath       string `toml:"archive"`
+}
+
+// KeyPath is the server's domain identity (without .priv or .ident), created
+// on first start if it does not exist. Servers on BlockedDomains may not call
+// this one. Spent stamps are kept in StampsPath, by default next to the
+// mailboxes.
+type GsdpServerConfig struct {
+	MailboxPath      string   `toml:"mailbox_path"`
+	WatchPollFreq    string   `toml:"watch_poll_frequency"`
+	KeyPath          string   `toml:"key"`
+	Domain           string   `toml:"domain"`
+	OpenRegistration bool     `toml:"open_registration"`
+	BlockedDomains   []string `toml:"blocked_domains"`
+	StampBits        int      `toml:"stamp_bits"`
+	StampsPath       string   `toml:"stamps_path"`
+}
+
+// Durations are strings as understood by time.ParseDuration.
+type GsdpPoolConfig struct {
+	IdleTimeout      string `toml:"idle_timeout"`
+	MaxLifetime      string `toml:"max_lifetime"`
+	ReapFrequency    string `toml:"reap_frequency"`
+	MaxConns         int    `toml:"max_conns"`
+	DialTimeout      string `toml:"dial_timeout"`
+	Port             string `toml:"port"`
+	KeepaliveTime    string `toml:"keepalive_time"`
+	KeepaliveTimeout string `toml:"keepalive_timeout"`
+}
+
+// Admins are identity paths (without .ident) allowed to use the admin service.
+// Without TLSCert and TLSKey it only listens on loopback. Server and CACert
+// are for the admin client: where the service is, and the certificate to
+// trust for it if not one the system does.
+type GsdpAdminConfig struct {
+	Port         string   `toml:"port"`
+	Admins       []string `toml:"admins"`
+	AccountsPath string   `toml:"accounts_path"`
+	TLSCert      string   `toml:"tls_cert"`
+	TLSKey       string   `toml:"tls_key"`
+	Server       string   `toml:"server"`
+	CACert       string   `toml:"ca_cert"`
+}
+
+// Rates are in messages per second; zero means unlimited.
+type GsdpUserLimitsConfig struct {
+	SenderRate  float64 `toml:"sender_rate"`
+	SenderBurst int     `toml:"sender_burst"`
+	MaxMessages int64   `toml:"max_messages"`
+	MaxBytes    int64   `toml:"max_bytes"`
+}
+
+// Users are keyed by handle\domain.
+type GsdpLimitsConfig struct {
+	SenderRate  float64                         `toml:"sender_rate"`
+	SenderBurst int                             `toml:"sender_burst"`
+	DomainRate  float64                         `toml:"domain_rate"`
+	DomainBurst int                             `toml:"domain_burst"`
+	MaxMessages int64                           `toml:"max_messages"`
+	MaxBytes    int64                           `toml:"max_bytes"`
+	Users       map[string]GsdpUserLimitsConfig `toml:"users"`
+}
+
+func (c GsdpLimitsConfig) Limits() gsdp.Limits {
+	l := gsdp.Limits{
+		SenderRate:  gsdp.RateLimit{c.SenderRate, c.SenderBurst},
+		DomainRate:  gsdp.RateLimit{c.DomainRate, c.DomainBurst},
+		MaxMessages: c.MaxMessages,
+		MaxBytes:    c.MaxBytes,
+		Users:       make(map[string]gsdp.UserLimits),
+	}
+	for k, u := range c.Users {
+		if i := strings.LastIndex(k, "\\"); i >= 0 {
+			k = k[:i+1] + strings.ToLower(k[i+1:])
+		}
+		l.Users[k] = gsdp.UserLimits{gsdp.RateLimit{u.SenderRate, u.SenderBurst}, u.MaxMessages, u.MaxBytes}
+	}
+	return l
+}
+
+// Ident is the service's identity path (without .priv or .ident), which
+// the server holds the key for.
+type GsdpBridgeServiceConfig struct {
+	Name    string `toml:"name"`
+	Ident   string `toml:"ident"`
+	Token   string `toml:"token"`
+	Webhook string `toml:"webhook"`
+	Secret  string `toml:"secret"`
+}
+
+// Without TLSCert and TLSKey, the bridge only listens on loopback. Webhooks
+// services set over the bridge are kept in WebhooksPath, by default next to
+// the mailboxes.
+type GsdpBridgeConfig struct {
+	Port         string                    `toml:"port"`
+	TLSCert      string                    `toml:"tls_cert"`
+	TLSKey       string                    `toml:"tls_key"`
+	WebhooksPath string                    `toml:"webhooks_path"`
+	Services     []GsdpBridgeServiceConfig `toml:"services"`
+}
+
+func (c GsdpBridgeConfig) BridgeServices() ([]*gsdp.BridgeService, error) {
+	svcs := make([]*gsdp.BridgeService, 0, len(c.Services))
+	for _, sc := range c.Services {
+		id, privk, err := gsdp.LoadIdentity(sc.Ident)
+		if err != nil {
+			return nil, err
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		svcs = append(svcs, &gsdp.BridgeService{sc.Name, &uu, sc.Token, sc.Webhook, sc.Secret})
+	}
+	return svcs, nil
 }
 
 type GsdpClientConfig struct {
-	Identity GsdpIdentConfig `toml:"identity"`
+	Identity GsdpIdentConfig  `toml:"identity"`
+	Server   GsdpServerConfig `toml:"server"`
+	Pool     GsdpPoolConfig   `toml:"pool"`
+	Admin    GsdpAdminConfig  `toml:"admin"`
+	Limits   GsdpLimitsConfig `toml:"limits"`
+	Bridge   GsdpBridgeConfig `toml:"bridge"`
+}
+
+func parseDurationOr(s string, def time.Duration) time.Duration {
+	if len(s) == 0 {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (c GsdpPoolConfig) PoolOptions() gsdp.PoolOptions {
+	opts := gsdp.DefaultPoolOptions()
+	opts.IdleTimeout = parseDurationOr(c.IdleTimeout, opts.IdleTimeout)
+	opts.MaxLifetime = parseDurationOr(c.MaxLifetime, opts.MaxLifetime)
+	opts.ReapFrequency = parseDurationOr(c.ReapFrequency, opts.ReapFrequency)
+	opts.DialTimeout = parseDurationOr(c.DialTimeout, opts.DialTimeout)
+	opts.Keepalive.Time = parseDurationOr(c.KeepaliveTime, opts.Keepalive.Time)
+	opts.Keepalive.Timeout = parseDurationOr(c.KeepaliveTimeout, opts.Keepalive.Timeout)
+	opts.MaxConns = c.MaxConns
+	if len(c.Port) > 0 {
+		opts.Port = c.Port
+	}
+	return opts
+}
+
+func loadOrCreateServerKey(config GsdpServerConfig) (*gsdp.LocalUser, error) {
+	if len(config.KeyPath) == 0 {
+		return nil, errors.New("No server key configured (set key under [server] or pass -id)")
+	}
+	id, privk, err := gsdp.LoadIdentity(config.KeyPath)
+	if os.IsNotExist(err) {
+		fmt.Printf("Creating server key at %s\n", config.KeyPath)
+		id, privk = gsdp.NewIdentity(config.Domain, "_server", config.Domain, "")
+		err = gsdp.SaveIdentity(id, privk, config.KeyPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	uu := gsdp.MakeLocalUser(id, privk)
+	return &uu, nil
 }
 
 func printUsage() {
-	fmt.Printf("Usage: %s <cmd> *args\n", os.Args[0])
+	fmt.Printf("Usage: %s [-o json|jsonl|table] <cmd> *args\n", os.Args[0])
 }
 
 func main() {
@@ -46,6 +218,12 @@ func main() {
 	serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
 	serveIdentPath := serveCmd.String("id", "", idPathHelp)
 	serveIdsPath := serveCmd.String("pubidpath", "", "Public identity path (directory)")
+	serveMailboxPath := serveCmd.String("mailboxpath", "", "Mailbox path (directory); mailboxes are kept in memory only if empty")
+	serveDomain := serveCmd.String("domain", "", "Domain served by this server")
+
+	registerCmd := flag.NewFlagSet("register", flag.ExitOnError)
+	registerIdentPath := registerCmd.String("id", "", idPathHelp)
+	registerIdsPath := registerCmd.String("pubidpath", "", "Public identity path (directory)")
 
 	newIdCmd := flag.NewFlagSet("newid", flag.ExitOnError)
 	newIdName := newIdCmd.String("name", "", "Name for newly generated user")
@@ -59,23 +237,136 @@ func main() {
 	sayTextInput := sayCmd.String("text", "", "Text input")
 	sayToStr := sayCmd.String("to", "", "Recipient list (semicolon-delimited)")
 	sayIdsPath := sayCmd.String("pubidpath", "", "Public identity path (directory)")
+	sayReceipts := sayCmd.Bool("receipts", false, "Ask for delivery and read receipts")
+	sayTtl := sayCmd.Duration("ttl", 0, "Delete the message this long after sending, e.g. 1h (0 to keep it)")
+	sayRe := sayCmd.String("re", "", "Id of the message this replies to, as shown by ls; sent in the clear")
+	sayTags := sayCmd.String("tag", "", "Project tags, comma-separated; sent in the clear so servers can filter on them")
 
 	lsCmd := flag.NewFlagSet("ls", flag.ExitOnError)
 	lsIdentPath := lsCmd.String("id", "", idPathHelp)
 	lsIdsPath := lsCmd.String("pubidpath", "", "Public identity path (directory)")
+	lsThreads := lsCmd.Bool("threads", false, "Show messages as conversation threads")
+	lsTags := lsCmd.String("tag", "", "Only show messages with one of these tags (comma-separated)")
+
+	tagsCmd := flag.NewFlagSet("tags", flag.ExitOnError)
+	tagsIdentPath := tagsCmd.String("id", "", idPathHelp)
+	tagsIdsPath := tagsCmd.String("pubidpath", "", "Public identity path (directory)")
+	tagsPin := tagsCmd.String("pin", "", "Tags to pin, listing their messages first (comma-separated)")
+	tagsMute := tagsCmd.String("mute", "", "Tags to mute, hiding their messages from ls (comma-separated)")
+	tagsClear := tagsCmd.String("clear", "", "Tags to neither pin nor mute (comma-separated)")
 
 	popCmd := flag.NewFlagSet("pop", flag.ExitOnError)
 	popIdsPath := popCmd.String("pubidpath", "", "Public identity path (directory)")
 	popIdentPath := popCmd.String("id", "", idPathHelp)
 
+	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+	searchIdentPath := searchCmd.String("id", "", idPathHelp)
+	searchIdsPath := searchCmd.String("pubidpath", "", "Public identity path (directory)")
+	searchText := searchCmd.String("text", "", "Words the message must contain")
+	searchFrom := searchCmd.String("from", "", "Sender (handle or handle\\domain)")
+	searchType := searchCmd.String("type", "", "Message types, comma-separated, e.g. plain,task_assign")
+	searchTag := searchCmd.String("tag", "", "Project tags, comma-separated; any of them matches")
+	searchSince := searchCmd.String("since", "", "Sent on or after this date (YYYY-MM-DD)")
+	searchUntil := searchCmd.String("until", "", "Sent on or before this date (YYYY-MM-DD)")
+	searchStatus := searchCmd.String("status", "", "Task statuses, comma-separated, e.g. in_progress,blocked")
+
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	exportIdentPath := exportCmd.String("id", "", idPathHelp)
+	exportIdsPath := exportCmd.String("pubidpath", "", "Public identity path (directory)")
+	exportFile := exportCmd.String("file", "", "File to export to, or import from")
+
+	inviteCmd := flag.NewFlagSet("invite", flag.ExitOnError)
+	inviteIdentPath := inviteCmd.String("id", "", idPathHelp)
+	inviteIdsPath := inviteCmd.String("pubidpath", "", "Public identity path (directory)")
+	inviteTo := inviteCmd.String("to", "", "Invitees (semicolon-delimited handle\\domain)")
+	inviteSubject := inviteCmd.String("subject", "", "What the event is")
+	inviteNote := inviteCmd.String("note", "", "Details for the invitees")
+	inviteLocation := inviteCmd.String("location", "", "Where the event is")
+	inviteAt := inviteCmd.String("at", "", "When the event starts (YYYY-MM-DD HH:MM, local time)")
+	inviteDuration := inviteCmd.Duration("duration", 0, "How long the event lasts, e.g. 1h30m")
+	inviteIcs := inviteCmd.String("ics", "", "Send the events in this iCalendar file instead")
+
+	rsvpCmd := flag.NewFlagSet("rsvp", flag.ExitOnError)
+	rsvpIdentPath := rsvpCmd.String("id", "", idPathHelp)
+	rsvpIdsPath := rsvpCmd.String("pubidpath", "", "Public identity path (directory)")
+	rsvpTo := rsvpCmd.String("to", "", "Organizer of the event (handle\\domain)")
+	rsvpRe := rsvpCmd.String("re", "", "Id of the invitation, as shown by events")
+	rsvpResponse := rsvpCmd.String("response", "", "accept, decline or tentative")
+	rsvpNote := rsvpCmd.String("note", "", "Note for the organizer")
+
+	eventsCmd := flag.NewFlagSet("events", flag.ExitOnError)
+	eventsIdentPath := eventsCmd.String("id", "", idPathHelp)
+	eventsIdsPath := eventsCmd.String("pubidpath", "", "Public identity path (directory)")
+	eventsIcs := eventsCmd.String("ics", "", "Also write the events to this iCalendar file")
+
+	shareCmd := flag.NewFlagSet("share", flag.ExitOnError)
+	shareIdentPath := shareCmd.String("id", "", idPathHelp)
+	shareIdsPath := shareCmd.String("pubidpath", "", "Public identity path (directory)")
+	shareTo := shareCmd.String("to", "", "Recipients (semicolon-delimited handle\\domain)")
+	shareFile := shareCmd.String("file", "", "File to share; a .diff or .patch is shared as a patch")
+	shareNote := shareCmd.String("note", "", "Note for the recipients")
+	shareLang := shareCmd.String("lang", "", "Language of the code, if not guessed from the file name")
+	shareTags := shareCmd.String("tag", "", "Project tags, comma-separated")
+
+	showCmd := flag.NewFlagSet("show", flag.ExitOnError)
+	showIdentPath := showCmd.String("id", "", idPathHelp)
+	showIdsPath := showCmd.String("pubidpath", "", "Public identity path (directory)")
+	showRe := showCmd.String("re", "", "Id of the code share or link to show, as shown by ls")
+
+	applyCmd := flag.NewFlagSet("apply", flag.ExitOnError)
+	applyIdentPath := applyCmd.String("id", "", idPathHelp)
+	applyIdsPath := applyCmd.String("pubidpath", "", "Public identity path (directory)")
+	applyRe := applyCmd.String("re", "", "Id of the shared patch, as shown by ls")
+	applyDir := applyCmd.String("dir", ".", "Checkout to apply the patch in")
+	applyStrip := applyCmd.Int("p", 1, "Leading path components to strip, as with patch -p")
+	applyDry := applyCmd.Bool("dry", false, "Only check that the patch applies")
+
+	linkCmd := flag.NewFlagSet("link", flag.ExitOnError)
+	linkIdentPath := linkCmd.String("id", "", idPathHelp)
+	linkIdsPath := linkCmd.String("pubidpath", "", "Public identity path (directory)")
+	linkTo := linkCmd.String("to", "", "Recipients (semicolon-delimited handle\\domain)")
+	linkUrl := linkCmd.String("url", "", "The http or https URL to send")
+	linkNote := linkCmd.String("note", "", "Note for the recipients")
+	linkTitle := linkCmd.String("title", "", "Title to show, instead of the page's own")
+	linkDesc := linkCmd.String("desc", "", "Description to show, instead of the page's own")
+	linkNoPreview := linkCmd.Bool("nopreview", false, "Do not fetch the page to build a preview")
+	linkTags := linkCmd.String("tag", "", "Project tags, comma-separated")
+
+	blockCmd := flag.NewFlagSet("block", flag.ExitOnError)
+	blockIdentPath := blockCmd.String("id", "", idPathHelp)
+	blockIdsPath := blockCmd.String("pubidpath", "", "Public identity path (directory)")
+	blockUser := blockCmd.String("user", "", "User to block, allow or grant (handle\\domain)")
+	blockPattern := blockCmd.String("pattern", "", "Handle pattern to block or allow, e.g. spam*")
+	blockDomain := blockCmd.String("domain", "", "Domain to block or allow")
+	blockAllow := blockCmd.Bool("allow", false, "Make this an allow rule")
+	blockSilent := blockCmd.Bool("silent", false, "Drop blocked messages without telling the sender")
+
+	amendCmd := flag.NewFlagSet("edit", flag.ExitOnError)
+	amendIdentPath := amendCmd.String("id", "", idPathHelp)
+	amendIdsPath := amendCmd.String("pubidpath", "", "Public identity path (directory)")
+	amendTo := amendCmd.String("to", "", "Recipient of the original message (handle\\domain)")
+	amendRe := amendCmd.String("re", "", "Id of the message to edit, retract or react to, as shown by ls")
+	amendText := amendCmd.String("text", "", "New text for edit, or the reaction for react (empty takes it back)")
+
+	for _, fs := range []*flag.FlagSet{serveCmd, registerCmd, newIdCmd, sayCmd, lsCmd, tagsCmd, popCmd, searchCmd, exportCmd, inviteCmd, rsvpCmd, eventsCmd, shareCmd, showCmd, applyCmd, linkCmd, blockCmd, amendCmd} {
+		addOutputFlag(fs)
+	}
+
 	idsPath := ""
 	idPath := &idsPath
 	idPath = nil
 	allIdentPath := &idsPath
 	allIdentPath = nil
-	r, _ := time.ParseDuration("60000ms")  // TODO: make configurable
-	connectionPool := gsdp.NewConnectionPool(r)
-	connectionPool.Start()
+
+	args, err := takeOutputFlag(os.Args)
+	if err != nil || len(args) < 2 {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		printUsage()
+		os.Exit(2)
+	}
+	os.Args = args
 
 	// Handle for config file
 	defaultCfgFn := os.Getenv("HOME") + "/.gsdp.toml"
@@ -91,15 +382,39 @@ func main() {
 	} else {
 		panic(err)
 	}
+	connectionPool := gsdp.NewConnectionPoolWithOptions(config.Pool.PoolOptions())
+	connectionPool.Start()
 
 	switch os.Args[1] {
+	case "admin":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		runAdmin(os.Args[2:], path, config.Admin)
+		return
 	case "serve":
 		serveCmd.Parse(os.Args[2:])
 		if idPath == nil || (len(*idPath) == 0) {
 			idPath = serveIdsPath
 		}
+		if len(*serveIdentPath) > 0 {
+			config.Server.KeyPath = *serveIdentPath
+		}
+		if len(*serveMailboxPath) > 0 {
+			config.Server.MailboxPath = *serveMailboxPath
+		}
+		if len(*serveDomain) > 0 {
+			config.Server.Domain = *serveDomain
+		}
+	case "register":
+		registerCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = registerIdsPath
+		}
 		if allIdentPath == nil || (len(*allIdentPath) == 0) {
-			allIdentPath = serveIdentPath
+			allIdentPath = registerIdentPath
 		}
 	case "newid":
 		newIdCmd.Parse(os.Args[2:])
@@ -130,6 +445,102 @@ func main() {
 		if allIdentPath == nil || (len(*allIdentPath) == 0) {
 			allIdentPath = lsIdentPath
 		}
+	case "edit", "retract", "react":
+		amendCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = amendIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = amendIdentPath
+		}
+	case "block", "unblock", "blocks", "grant":
+		blockCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = blockIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = blockIdentPath
+		}
+	case "search":
+		searchCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = searchIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = searchIdentPath
+		}
+	case "export", "import":
+		exportCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = exportIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = exportIdentPath
+		}
+	case "tags":
+		tagsCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = tagsIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = tagsIdentPath
+		}
+	case "invite":
+		inviteCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = inviteIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = inviteIdentPath
+		}
+	case "rsvp":
+		rsvpCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = rsvpIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = rsvpIdentPath
+		}
+	case "events":
+		eventsCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = eventsIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = eventsIdentPath
+		}
+	case "share":
+		shareCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = shareIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = shareIdentPath
+		}
+	case "show":
+		showCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = showIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = showIdentPath
+		}
+	case "apply":
+		applyCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = applyIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = applyIdentPath
+		}
+	case "link":
+		linkCmd.Parse(os.Args[2:])
+		if idPath == nil || (len(*idPath) == 0) {
+			idPath = linkIdsPath
+		}
+		if allIdentPath == nil || (len(*allIdentPath) == 0) {
+			allIdentPath = linkIdentPath
+		}
 	case "pop":
 		popCmd.Parse(os.Args[2:])
 		if idPath == nil || (len(*idPath) == 0) {
@@ -147,20 +558,152 @@ func main() {
 		idPath = &envPath
 	}
 
-	allIdentities := gsdp.MakeInMemoryIdentStoreFromFiles(*idPath)
-	privIds := gsdp.MakeFilePrivateKeyStore(*idPath)
+	dirIdentities := gsdp.MakeInMemoryIdentStoreFromFiles(*idPath)
+	var allIdentities gsdp.IdentityStore = dirIdentities
+	if len(config.Identity.IdentitiesDbPath) > 0 {
+		db, err := gsdp.MakeBoltIdentStore(config.Identity.IdentitiesDbPath)
+		if err != nil {
+			panic(err)
+		}
+		defer db.Close()
+		// Identities created with newid still land in the directory, so pick them up.
+		if err := gsdp.CopyIdentities(db, allIdentities); err != nil {
+			panic(err)
+		}
+		allIdentities = db
+	}
 	switch os.Args[1] {
 	case "serve":
 		fmt.Printf("Serving...\n")
 		ids := allIdentities
-		gsdp.Serve(":50051", privIds, ids, connectionPool)
+		var mailboxes gsdp.MailboxStore = gsdp.NewInMemoryMailboxStore()
+		if len(config.Server.MailboxPath) > 0 {
+			mbs, err := gsdp.MakeFileMailboxStore(config.Server.MailboxPath)
+			if err != nil {
+				panic(err)
+			}
+			mailboxes = mbs
+		}
+		serverKey, err := loadOrCreateServerKey(config.Server)
+		if err != nil {
+			panic(err)
+		}
+		opts := gsdp.ServerOptions{
+			ServerKey:        serverKey,
+			Domain:           config.Server.Domain,
+			Identities:       ids,
+			Mailboxes:        mailboxes,
+			PoolOptions:      config.Pool.PoolOptions(),
+			DomainPolicy:     gsdp.BlockDomainsPolicy(config.Server.BlockedDomains),
+			Limits:           config.Limits.Limits(),
+			OpenRegistration: config.Server.OpenRegistration,
+			StampBits:        config.Server.StampBits,
+		}
+		stampsPath := config.Server.StampsPath
+		if len(stampsPath) == 0 && len(config.Server.MailboxPath) > 0 {
+			stampsPath = strings.TrimSuffix(config.Server.MailboxPath, "/") + ".stamps"
+		}
+		if len(stampsPath) > 0 {
+			if opts.SpentStamps, err = gsdp.MakeFileSpentStamps(stampsPath); err != nil {
+				panic(err)
+			}
+		}
+		if len(config.Admin.AccountsPath) > 0 {
+			accts, err := gsdp.MakeFileAccountStore(config.Admin.AccountsPath)
+			if err != nil {
+				panic(err)
+			}
+			opts.Accounts = accts
+		}
+		if len(config.Admin.Port) > 0 {
+			opts.AdminPort = config.Admin.Port
+			opts.AdminTLSCert, opts.AdminTLSKey = config.Admin.TLSCert, config.Admin.TLSKey
+			for _, p := range config.Admin.Admins {
+				adm, err := gsdp.LoadPublicIdentity(p)
+				if err != nil {
+					panic(err)
+				}
+				opts.Admins = append(opts.Admins, adm)
+			}
+		}
+		if len(config.Bridge.Port) > 0 {
+			opts.BridgePort = config.Bridge.Port
+			opts.BridgeTLSCert, opts.BridgeTLSKey = config.Bridge.TLSCert, config.Bridge.TLSKey
+			if opts.BridgeServices, err = config.Bridge.BridgeServices(); err != nil {
+				panic(err)
+			}
+			hooksPath := config.Bridge.WebhooksPath
+			if len(hooksPath) == 0 && len(config.Server.MailboxPath) > 0 {
+				hooksPath = strings.TrimSuffix(config.Server.MailboxPath, "/") + ".webhooks"
+			}
+			if len(hooksPath) > 0 {
+				if opts.BridgeWebhooks, err = gsdp.MakeFileWebhookStore(hooksPath); err != nil {
+					panic(err)
+				}
+			}
+		}
+		server, err := gsdp.NewServer(":50051", opts)
+		if err != nil {
+			panic(err)
+		}
+		pollFreq := parseDurationOr(config.Server.WatchPollFreq, defaultWatchPollFreq)
+		if memIds, ok := ids.(*gsdp.InMemoryIdentStore); ok {
+			defer memIds.Watch(pollFreq).Stop()
+		} else {
+			// Identity files that were deleted are dropped from the
+			// database too.
+			dirIds := *idPath
+			defer gsdp.WatchDir(dirIds, ".ident", pollFreq, func() error {
+				now := gsdp.MakeInMemoryIdentStoreFromFiles(dirIds)
+				if err := gsdp.SyncIdentities(ids, dirIdentities, now); err != nil {
+					return err
+				}
+				dirIdentities = now
+				return nil
+			}).Stop()
+		}
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			sig := <-sigs
+			fmt.Printf("Got %v, shutting down...\n", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := server.GracefulStop(ctx); err != nil {
+				fmt.Printf("Err: %v\n", err)
+			}
+		}()
+		if err := server.Serve(); err != nil {
+			panic(err)
+		}
+		<-stopped
+		connectionPool.Close()
+		fmt.Printf("Server stopped.\n")
+	case "register":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		if err := client.Register(); err != nil {
+			panic(err)
+		}
+		printResult(&resultRecord{Action: "registered", To: identString(id)}, "Registered %s\\%s\n", id.Handle, id.Domain)
 	case "newid":
 		newid, privkey := gsdp.NewIdentity(*newIdName, *newIdHandle, *newIdDomain, *newIdProfileUrl)
 		fnb := *idPath + "/" + *newIdHandle + "__" + *newIdDomain
-		fmt.Printf("Handle: %s\n", *newIdHandle)
+		logf("Handle: %s\n", *newIdHandle)
 		e := gsdp.SaveIdentity(newid, privkey, fnb)
 		if e == nil {
-			fmt.Printf("Identity saved to: %s\n", fnb)
+			printResult(&resultRecord{Action: "created", To: identString(newid), File: fnb}, "Identity saved to: %s\n", fnb)
 		} else {
 			panic(e)
 		}
@@ -192,7 +735,7 @@ func main() {
 		}
 		idLookup := allIdentities.GetIdentityForHandleDomain(toPcs[0], lookupDomain)
 		if len(toPcs) < 2 || idLookup == nil {
-			fmt.Printf("Looking up %s at %s", toPcs[0], lookupDomain)
+			logf("Looking up %s at %s", toPcs[0], lookupDomain)
 			res, e := client.Name(&pb.NameInquiry{id, nil, false, toPcs[0], lookupDomain})
 			if e != nil {
 				panic(e)
@@ -200,17 +743,26 @@ func main() {
 			if res.IsError == true {
 				panic(errors.New("Cannot find user at nameserver."))
 			} else {
-				fmt.Printf("Got new user identity: %s (%s)\n", toPcs, res.ProfileUrl)
+				logf("Got new user identity: %s (%s)\n", toPcs, res.ProfileUrl)
 				recipDomain = res.Name.Domain
 				allIdentities.AddIdentity(res.Name)
 			}
 		}
-		recipId, err := gsdp.LoadPublicIdentity(*idPath + "/" + toPcs[0] + "__" + recipDomain)
-		if err != nil {
-			panic(err)
+		recipId := allIdentities.GetIdentityForHandleDomain(toPcs[0], recipDomain)
+		if recipId == nil {
+			panic(errors.New("No identity for " + toPcs[0] + "\\" + recipDomain))
 		}
 		recips := []*pb.Identity{recipId}
-		rawm := &pb.RawMessage{id, recips, nothin, pb.MessageType_PLAIN, txtBytes, nothin, nothin, time.Now().Unix(), nothin, nothin}
+		rawm := &pb.RawMessage{id, recips, nothin, pb.MessageType_PLAIN, txtBytes, gsdp.NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, *sayReceipts, 0, nothin, nil}
+		if len(*sayRe) > 0 {
+			if rawm.ReMsgId, err = base64.StdEncoding.DecodeString(*sayRe); err != nil {
+				panic(err)
+			}
+		}
+		rawm.Tags = splitList(*sayTags)
+		if *sayTtl > 0 {
+			rawm.ExpiresUtc = time.Now().Add(*sayTtl).Unix()
+		}
 		err = gsdp.DoRawMessageEncryption(txtBytes, recipId, rawm)
 		if err != nil {
 			panic(err)
@@ -219,7 +771,15 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("Sent message (%d bytes) \n", len(rawm.MessageContent))
+		// Kept so that receipts and replies can be matched to it.
+		if archive, err := openArchive(config.Identity.ArchivePath, *path, uu); err != nil {
+			logf("Err: %v\n", err)
+		} else if archive.Add(rawm, txtBytes) {
+			if err := archive.Save(); err != nil {
+				logf("Err: %v\n", err)
+			}
+		}
+		printResult(&resultRecord{Action: "sent", MsgId: gsdp.IdentToString(rawm.MsgId), To: identString(recipId)}, "Sent message %s (%d bytes) \n", gsdp.IdentToString(rawm.MsgId), len(rawm.MessageContent))
 	case "pop":
 		path := allIdentPath
 		envPath := os.Getenv("GSDPID")
@@ -232,18 +792,487 @@ func main() {
 		}
 		uu := gsdp.MakeLocalUser(id, privk)
 		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
-		msgs, err := client.GetMine(true)
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
 		if err != nil {
 			panic(err)
 		}
-		for i, m := range msgs {
-			pt, err := gsdp.DoRawMessageDecryption(m, privk)
+		// Messages are only deleted from the server once they have been
+		// printed and archived, a page at a time.
+		i := 0
+		receipts := make([]*pb.RawMessage, 0)
+		out := &jsonStream{}
+		for cursor, more := uint64(0), true; more; {
+			page, err := client.GetPage(cursor, popPageSize, false, nil)
 			if err != nil {
-				fmt.Printf("Err: %v\n", err)
+				panic(err)
 			}
-			fmt.Printf("Msg %d: %s - %s\n", i, (m.FromIdent.Handle + "\\" + m.FromIdent.Domain), string(pt))
+			seqs := make([]uint64, 0, len(page.Messages))
+			for _, m := range page.Messages {
+				seqs = append(seqs, m.Seq)
+				if m.MsgType == pb.MessageType_RECEIPT {
+					receipts = append(receipts, m)
+					continue
+				}
+				pt, err := gsdp.DoRawMessageDecryption(m, privk)
+				if err != nil {
+					logf("Err: %v\n", err)
+				} else {
+					archive.Add(m, pt)
+				}
+				if jsonOutput() {
+					out.Print(makeMessageRecord(m, pt))
+				} else {
+					fmt.Printf("Msg %d: %s - %s\n", i, (m.FromIdent.Handle + "\\" + m.FromIdent.Domain), string(pt))
+				}
+				// Nobody has read what could not be decrypted.
+				if err == nil {
+					if err := client.SendReadReceipt(m); err != nil {
+						logf("Err: %v\n", err)
+					}
+				}
+				i++
+			}
+			if err := archive.Save(); err != nil {
+				panic(err)
+			}
+			if err := client.Ack(seqs); err != nil {
+				panic(err)
+			}
+			cursor, more = page.NextSeq, page.More
+		}
+		sts := summarizeReceipts(receipts, archive, connectionPool)
+		if jsonOutput() {
+			out.Print(receiptRecords(sts)...)
+			out.End()
+		} else {
+			printReceipts(sts)
+			fmt.Printf("\n\n")
+		}
+	case "edit", "retract", "react":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		reMsgId, err := base64.StdEncoding.DecodeString(*amendRe)
+		if err != nil || len(reMsgId) == 0 {
+			panic(errors.New("Need the -re message id, as shown by ls"))
+		}
+		recipId, err := lookupRecipient(&client, allIdentities, *amendTo)
+		if err != nil {
+			panic(err)
+		}
+		kinds := map[string]pb.MessageType{"edit": pb.MessageType_EDIT, "retract": pb.MessageType_RETRACT, "react": pb.MessageType_REACTION}
+		if err := client.Amend(kinds[os.Args[1]], reMsgId, *amendText, recipId); err != nil {
+			panic(err)
+		}
+		printResult(&resultRecord{Action: os.Args[1], MsgId: *amendRe, To: identString(recipId)}, "Sent %s of %s to %s\\%s\n", os.Args[1], *amendRe, recipId.Handle, recipId.Domain)
+	case "block", "unblock", "blocks", "grant":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		if os.Args[1] == "grant" {
+			to, err := identityFromFlag(*blockUser, allIdentities)
+			if err != nil {
+				panic(err)
+			}
+			if err := client.GrantPermissions(to); err != nil {
+				panic(err)
+			}
+			printResult(&resultRecord{Action: "grant", To: identString(to)}, "Granted permissions to %s\\%s\n", to.Handle, to.Domain)
+			break
+		}
+		var add, remove []*pb.FilterRule
+		if os.Args[1] != "blocks" {
+			rule, err := filterRuleFromFlags(*blockUser, *blockPattern, *blockDomain, *blockAllow, *blockSilent, allIdentities)
+			if err != nil {
+				panic(err)
+			}
+			if os.Args[1] == "block" {
+				add = append(add, rule)
+			} else {
+				remove = append(remove, rule)
+			}
+		}
+		rules, err := client.UpdateFilters(add, remove)
+		if err != nil {
+			panic(err)
+		}
+		printFilters(rules, allIdentities)
+	case "search":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		q, err := archiveQueryFromFlags(*searchText, *searchFrom, *searchType, *searchTag, *searchSince, *searchUntil, *searchStatus)
+		if err != nil {
+			panic(err)
+		}
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		printSearch(archive.Search(q))
+		// Loading dropped anything that has expired since; make it stick.
+		if err := archive.Save(); err != nil {
+			logf("Err: %v\n", err)
+		}
+	case "export", "import":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		if len(*exportFile) == 0 {
+			panic(errors.New("Need a -file to " + os.Args[1]))
+		}
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		if os.Args[1] == "export" {
+			fh, err := os.OpenFile(*exportFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				panic(err)
+			}
+			if err := archive.Export(fh, uu); err != nil {
+				fh.Close()
+				panic(err)
+			}
+			if err := fh.Close(); err != nil {
+				panic(err)
+			}
+			n := len(archive.Entries())
+			printResult(&resultRecord{Action: "exported", File: *exportFile, Count: n}, "Exported %d messages to %s\n", n, *exportFile)
+			return
+		}
+		fh, err := os.Open(*exportFile)
+		if err != nil {
+			panic(err)
+		}
+		defer fh.Close()
+		n, err := archive.Import(fh, uu, gsdp.NewDomainKeyStore(connectionPool))
+		if err != nil {
+			panic(err)
+		}
+		if err := archive.Save(); err != nil {
+			panic(err)
+		}
+		printResult(&resultRecord{Action: "imported", File: *exportFile, Count: n}, "Imported %d new messages from %s\n", n, *exportFile)
+	case "tags":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		prefs, err := gsdp.MakeFileTagPrefs(*path + ".tags")
+		if err != nil {
+			panic(err)
+		}
+		for _, t := range splitList(*tagsPin) {
+			prefs.Pin(t)
+		}
+		for _, t := range splitList(*tagsMute) {
+			prefs.Mute(t)
+		}
+		for _, t := range splitList(*tagsClear) {
+			prefs.Clear(t)
+		}
+		if err := prefs.Save(); err != nil {
+			panic(err)
+		}
+		printTagPrefs(prefs)
+	case "invite":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		var invs []*pb.Invitation
+		if len(*inviteIcs) > 0 {
+			invs, err = invitationsFromICS(*inviteIcs)
+		} else {
+			var inv *pb.Invitation
+			inv, err = invitationFromFlags(*inviteSubject, *inviteNote, *inviteLocation, *inviteAt, *inviteDuration)
+			invs = []*pb.Invitation{inv}
+		}
+		if err != nil {
+			panic(err)
+		}
+		// Sent invitations are archived, so events can show the replies.
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		client.KeepSent(archive)
+		recips := make([]*pb.Identity, 0)
+		for _, to := range strings.Split(*inviteTo, ";") {
+			recipId, err := lookupRecipient(&client, allIdentities, to)
+			if err != nil {
+				panic(err)
+			}
+			recips = append(recips, recipId)
+		}
+		records := make([]interface{}, 0)
+		for _, inv := range invs {
+			msgs, err := client.Invite(inv, recips)
+			if serr := archive.Save(); serr != nil {
+				logf("Err: %v\n", serr)
+			}
+			if err != nil {
+				panic(err)
+			}
+			for i, msg := range msgs {
+				records = append(records, &resultRecord{Action: "invited", MsgId: gsdp.IdentToString(msg.MsgId), To: identString(recips[i])})
+				if !jsonOutput() {
+					fmt.Printf("Invited %s\\%s to %s (%s)\n", recips[i].Handle, recips[i].Domain, inv.Subject, gsdp.IdentToString(msg.MsgId))
+				}
+			}
+		}
+		if jsonOutput() {
+			printJSON(records)
+		}
+	case "rsvp":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		reMsgId, err := base64.StdEncoding.DecodeString(*rsvpRe)
+		if err != nil || len(reMsgId) == 0 {
+			panic(errors.New("Need the -re invitation id, as shown by events"))
+		}
+		response, err := parseRsvpResponse(*rsvpResponse)
+		if err != nil {
+			panic(err)
+		}
+		recipId, err := lookupRecipient(&client, allIdentities, *rsvpTo)
+		if err != nil {
+			panic(err)
+		}
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		client.KeepSent(archive)
+		if err := client.Rsvp(reMsgId, recipId, response, *rsvpNote); err != nil {
+			panic(err)
+		}
+		if err := archive.Save(); err != nil {
+			logf("Err: %v\n", err)
+		}
+		printResult(&resultRecord{Action: strings.ToLower(response.String()), MsgId: *rsvpRe, To: identString(recipId)}, "Sent %s to %s\\%s\n", strings.ToLower(response.String()), recipId.Handle, recipId.Domain)
+	case "share":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		code, err := ioutil.ReadFile(*shareFile)
+		if err != nil {
+			panic(err)
+		}
+		cs := gsdp.MakeCodeShare(*shareFile, string(code), *shareLang, *shareNote, splitList(*shareTags))
+		records := make([]interface{}, 0)
+		for _, to := range strings.Split(*shareTo, ";") {
+			recipId, err := lookupRecipient(&client, allIdentities, to)
+			if err != nil {
+				panic(err)
+			}
+			msg, err := client.SendPayload(pb.MessageType_CODE_SHARE, cs, recipId)
+			if err != nil {
+				panic(err)
+			}
+			records = append(records, &resultRecord{Action: "shared", MsgId: gsdp.IdentToString(msg.MsgId), To: identString(recipId), File: cs.Filename})
+			if !jsonOutput() {
+				fmt.Printf("Shared %s with %s\\%s (%s)\n", cs.Filename, recipId.Handle, recipId.Domain, gsdp.IdentToString(msg.MsgId))
+			}
+		}
+		if jsonOutput() {
+			printJSON(records)
+		}
+	case "link":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		client := gsdp.NewClient(&uu, allIdentities, connectionPool)
+		preview, err := linkPreviewFromFlags(*linkUrl, *linkTitle, *linkDesc, !*linkNoPreview)
+		if err != nil {
+			panic(err)
+		}
+		records := make([]interface{}, 0)
+		for _, to := range strings.Split(*linkTo, ";") {
+			recipId, err := lookupRecipient(&client, allIdentities, to)
+			if err != nil {
+				panic(err)
+			}
+			msg, err := client.SendLink(preview, *linkNote, splitList(*linkTags), recipId)
+			if err != nil {
+				panic(err)
+			}
+			records = append(records, &resultRecord{Action: "sent", MsgId: gsdp.IdentToString(msg.MsgId), To: identString(recipId)})
+			if !jsonOutput() {
+				fmt.Printf("Sent %s to %s\\%s (%s)\n", preview.Url, recipId.Handle, recipId.Domain, gsdp.IdentToString(msg.MsgId))
+			}
+		}
+		if jsonOutput() {
+			printJSON(records)
+		}
+	case "show", "apply":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		re := *showRe
+		if os.Args[1] == "apply" {
+			re = *applyRe
+		}
+		reMsgId, err := base64.StdEncoding.DecodeString(re)
+		if err != nil || len(reMsgId) == 0 {
+			panic(errors.New("Need the -re code share id, as shown by ls"))
+		}
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		vm := archive.View().Get(reMsgId)
+		if vm != nil && os.Args[1] == "show" && jsonOutput() && (vm.Msg.MsgType == pb.MessageType_LINK || vm.Msg.MsgType == pb.MessageType_CODE_SHARE) {
+			printJSON([]interface{}{makeViewRecord(vm)})
+			break
+		}
+		if vm != nil && vm.Msg.MsgType == pb.MessageType_LINK && os.Args[1] == "show" {
+			p, err := gsdp.OpenPayload(vm.Msg.MsgType, vm.Plaintext)
+			if err != nil {
+				panic(err)
+			}
+			printLink(vm.Msg, p.(*pb.Link), archive)
+			break
+		}
+		if vm == nil || vm.Msg.MsgType != pb.MessageType_CODE_SHARE {
+			panic(errors.New("No code share with that id in the archive; run ls first"))
+		}
+		p, err := gsdp.OpenPayload(vm.Msg.MsgType, vm.Plaintext)
+		if err != nil {
+			panic(err)
+		}
+		cs := p.(*pb.CodeShare)
+		if os.Args[1] == "show" {
+			printCodeShare(vm.Msg, cs)
+			break
+		}
+		if !gsdp.IsPatch(cs) {
+			panic(errors.New("That code share is not a patch"))
+		}
+		patches, err := gsdp.ParsePatch(cs.Code)
+		if err != nil {
+			panic(err)
+		}
+		changed, err := gsdp.ApplyPatches(*applyDir, patches, *applyStrip, *applyDry)
+		if err != nil {
+			panic(err)
+		}
+		verb := "Patched"
+		if *applyDry {
+			verb = "Would patch"
+		}
+		if jsonOutput() {
+			action := "patched"
+			if *applyDry {
+				action = "checked"
+			}
+			printJSON([]interface{}{&resultRecord{Action: action, MsgId: re, Count: len(changed), Files: changed}})
+			break
+		}
+		for _, f := range changed {
+			fmt.Printf("%s %s\n", verb, f)
+		}
+	case "events":
+		path := allIdentPath
+		envPath := os.Getenv("GSDPID")
+		if len(envPath) > 0 {
+			path = &envPath
+		}
+		id, privk, err := gsdp.LoadIdentity(*path)
+		if err != nil {
+			panic(err)
+		}
+		uu := gsdp.MakeLocalUser(id, privk)
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		events := gsdp.BuildCalendar(archive.View().Messages())
+		printEvents(events)
+		if len(*eventsIcs) > 0 {
+			fh, err := os.Create(*eventsIcs)
+			if err != nil {
+				panic(err)
+			}
+			if err := gsdp.WriteICS(fh, events); err != nil {
+				fh.Close()
+				panic(err)
+			}
+			if err := fh.Close(); err != nil {
+				panic(err)
+			}
+			logf("Wrote %d events to %s\n", len(events), *eventsIcs)
 		}
-		fmt.Printf("\n\n")
 	case "ls":
 		path := allIdentPath
 		envPath := os.Getenv("GSDPID")
@@ -260,16 +1289,59 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
-		matrix := make([][]string, 0)
+		archive, err := openArchive(config.Identity.ArchivePath, *path, uu)
+		if err != nil {
+			panic(err)
+		}
+		prefs, err := gsdp.MakeFileTagPrefs(*path + ".tags")
+		if err != nil {
+			panic(err)
+		}
+		wantTags := splitList(*lsTags)
+		view := gsdp.NewMessageView()
 		for _, m := range msgs {
+			if m.MsgType == pb.MessageType_RECEIPT {
+				continue
+			}
 			pt, err := gsdp.DoRawMessageDecryption(m, privk)
 			if err != nil {
-				fmt.Printf("Err: %v\n", err)
+				logf("Err: %v\n", err)
+				continue
+			}
+			archive.Add(m, pt)
+			if hiddenByTags(m, pt, wantTags, prefs) {
+				continue
+			}
+			if err := view.Add(m, pt); err != nil {
+				logf("Err: %v\n", err)
+				continue
+			}
+			if err := client.SendReadReceipt(m); err != nil {
+				logf("Err: %v\n", err)
 			}
-			matrix = append(matrix, []string{m.FromIdent.Handle  + "\\" + m.FromIdent.Domain, string(pt)})
 		}
-		PrintGrid(matrix)
-		fmt.Printf("\n\n")
+		read, err := gsdp.MakeFileReadState(*path + ".read")
+		if err != nil {
+			panic(err)
+		}
+		receipts := summarizeReceipts(msgs, archive, connectionPool)
+		if *lsThreads {
+			printThreads(gsdp.BuildThreads(view, read), receipts)
+		} else {
+			printView(prefs.Apply(view.Messages()), receipts)
+		}
+		for _, vm := range view.Messages() {
+			read.MarkRead(vm.Msg.MsgId)
+		}
+		if err := read.Save(); err != nil {
+			logf("Err: %v\n", err)
+		}
+		if err := archive.Save(); err != nil {
+			logf("Err: %v\n", err)
+		}
+		if !jsonOutput() {
+			fmt.Printf("\n\n")
+		}
 	case "test":
 		path := allIdentPath
 		envPath := os.Getenv("GSDPID")
@@ -0,0 +1,93 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+)
+
+// Builds a block/allow rule from the block command's flags. A -user is
+// looked up to pin the rule to their identity.
+func filterRuleFromFlags(user string, pattern string, domain string, allow bool, silent bool, ids gsdp.IdentityStore) (*pb.FilterRule, error) {
+	rule := &pb.FilterRule{pb.FilterAction_BLOCK, nil, pattern, domain, silent}
+	if allow {
+		rule.Action = pb.FilterAction_ALLOW
+	}
+	if len(user) > 0 {
+		id, err := identityFromFlag(user, ids)
+		if err != nil {
+			return nil, err
+		}
+		rule.Ident = id.Ident
+	}
+	if len(rule.Ident) == 0 && len(pattern) == 0 && len(domain) == 0 {
+		return nil, errors.New("Need a -user, -pattern or -domain")
+	}
+	return rule, nil
+}
+
+// Looks up a -user given as handle\domain.
+func identityFromFlag(user string, ids gsdp.IdentityStore) (*pb.Identity, error) {
+	pcs := strings.Split(user, "\\")
+	if len(pcs) < 2 {
+		return nil, errors.New("Give -user as handle\\domain")
+	}
+	id := ids.GetIdentityForHandleDomain(pcs[0], pcs[1])
+	if id == nil {
+		return nil, errors.New("No identity for " + user)
+	}
+	return id, nil
+}
+
+type filterRecord struct {
+	Action  string `json:"action"`
+	Ident   string `json:"ident,omitempty"`
+	User    string `json:"user,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	Domain  string `json:"domain,omitempty"`
+	Silent  bool   `json:"silent,omitempty"`
+}
+
+func printFilters(rules []*pb.FilterRule, ids gsdp.IdentityStore) {
+	matrix := make([][]string, 0)
+	records := make([]interface{}, 0, len(rules))
+	for _, r := range rules {
+		rec := &filterRecord{Action: strings.ToLower(r.Action.String()), Pattern: r.HandlePattern, Domain: r.Domain, Silent: r.Silent}
+		who := ""
+		if len(r.Ident) > 0 {
+			who = gsdp.IdentToString(r.Ident)
+			if id := ids.GetIdentityForIdent(r.Ident); id != nil {
+				who = id.Handle + "\\" + id.Domain
+				rec.User = who
+			}
+			rec.Ident = gsdp.IdentToString(r.Ident)
+		}
+		records = append(records, rec)
+		mode := "reject"
+		if r.Silent {
+			mode = "drop"
+		}
+		if r.Action == pb.FilterAction_ALLOW {
+			mode = ""
+		}
+		matrix = append(matrix, []string{strings.ToLower(r.Action.String()), who, r.HandlePattern, r.Domain, mode})
+	}
+	printOutput(matrix, records)
+}
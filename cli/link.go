@@ -0,0 +1,61 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+)
+
+// Builds the preview for the link subcommand. Titles and descriptions given
+// on the command line win over what the page says.
+func linkPreviewFromFlags(rawurl, title, desc string, fetch bool) (*gsdp.LinkPreview, error) {
+	p := &gsdp.LinkPreview{Url: rawurl}
+	if fetch {
+		var err error
+		if p, err = gsdp.FetchLinkPreview(gsdp.NewHTTPLinkFetcher(), rawurl); err != nil {
+			return nil, err
+		}
+	}
+	if len(title) > 0 {
+		p.Title = title
+	}
+	if len(desc) > 0 {
+		p.Description = desc
+	}
+	return p, nil
+}
+
+// Prints a link as its sender previewed it. Nothing here fetches the URL.
+func printLink(msg *pb.RawMessage, link *pb.Link, archive *gsdp.Archive) {
+	fmt.Printf("%s\\%s shared a link\n", msg.FromIdent.Handle, msg.FromIdent.Domain)
+	if len(link.Note) > 0 {
+		fmt.Printf("%s\n", link.Note)
+	}
+	fmt.Printf("\n%s\n%s\n", link.Title, link.Url)
+	if len(link.Description) > 0 {
+		fmt.Printf("%s\n", link.Description)
+	}
+	if len(link.ThumbnailMsgId) > 0 {
+		status := "not received yet"
+		if thumb := archive.View().Get(link.ThumbnailMsgId); thumb != nil {
+			status = fmt.Sprintf("%d bytes", len(thumb.Plaintext))
+		}
+		fmt.Printf("Thumbnail: %s (%s, %s)\n", gsdp.IdentToString(link.ThumbnailMsgId), link.ThumbnailType, status)
+	}
+}
@@ -0,0 +1,229 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"os"
+	"strings"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputJSONL = "jsonl"
+)
+
+// How results are printed, set from -o. With json, each command prints one
+// JSON array of records; with jsonl, one record per line.
+var outputMode = outputTable
+
+// The -o flag, which every subcommand takes.
+type outputFlag struct{}
+
+func (outputFlag) String() string {
+	return outputMode
+}
+
+func (outputFlag) Set(mode string) error {
+	switch mode {
+	case outputTable, outputJSON, outputJSONL:
+		outputMode = mode
+		return nil
+	}
+	return errors.New("Unknown output mode " + mode + ", want json, jsonl or table")
+}
+
+func addOutputFlag(fs *flag.FlagSet) {
+	fs.Var(outputFlag{}, "o", "Output: json, jsonl or table")
+}
+
+// Takes -o <mode> (or -o=<mode>) from before the subcommand's name. After
+// the name it is parsed with the subcommand's own flags, so an argument that
+// merely looks like it, such as message text, is left alone.
+func takeOutputFlag(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	i := 1
+	for ; i < len(args); i++ {
+		a := args[i]
+		if a == "-o" || a == "--o" {
+			if i+1 == len(args) {
+				return nil, errors.New("-o needs json, jsonl or table")
+			}
+			i++
+			if err := (outputFlag{}).Set(args[i]); err != nil {
+				return nil, err
+			}
+		} else if strings.HasPrefix(a, "-o=") || strings.HasPrefix(a, "--o=") {
+			if err := (outputFlag{}).Set(a[strings.Index(a, "=")+1:]); err != nil {
+				return nil, err
+			}
+		} else {
+			break
+		}
+	}
+	return append([]string{args[0]}, args[i:]...), nil
+}
+
+func jsonOutput() bool {
+	return outputMode != outputTable
+}
+
+// Prints progress and warnings, which go to stderr when stdout is for JSON.
+func logf(format string, args ...interface{}) {
+	if jsonOutput() {
+		fmt.Fprintf(os.Stderr, format, args...)
+	} else {
+		fmt.Printf(format, args...)
+	}
+}
+
+func printJSON(records []interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	if outputMode == outputJSONL {
+		for _, r := range records {
+			enc.Encode(r)
+		}
+		return
+	}
+	if records == nil {
+		records = []interface{}{}
+	}
+	enc.SetIndent("", "  ")
+	enc.Encode(records)
+}
+
+// Prints records as they come, for commands that should not hold them back
+// until the end: with jsonl a line each, with json as the elements of one
+// array that End closes.
+type jsonStream struct {
+	n int
+}
+
+func (js *jsonStream) Print(records ...interface{}) {
+	for _, r := range records {
+		if outputMode == outputJSONL {
+			json.NewEncoder(os.Stdout).Encode(r)
+			continue
+		}
+		b, err := json.MarshalIndent(r, "  ", "  ")
+		if err != nil {
+			continue
+		}
+		if js.n == 0 {
+			fmt.Print("[\n  ")
+		} else {
+			fmt.Print(",\n  ")
+		}
+		os.Stdout.Write(b)
+		js.n++
+	}
+}
+
+func (js *jsonStream) End() {
+	if outputMode == outputJSONL {
+		return
+	}
+	if js.n == 0 {
+		fmt.Println("[]")
+	} else {
+		fmt.Print("\n]\n")
+	}
+}
+
+// Prints a command's results: the grid for table output, the records
+// otherwise.
+func printOutput(matrix [][]string, records []interface{}) {
+	if jsonOutput() {
+		printJSON(records)
+	} else {
+		PrintGrid(matrix)
+	}
+}
+
+// What commands that do one thing, like sending a message, print as JSON.
+type resultRecord struct {
+	Action string   `json:"action"`
+	MsgId  string   `json:"msg_id,omitempty"`
+	To     string   `json:"to,omitempty"`
+	File   string   `json:"file,omitempty"`
+	Count  int      `json:"count,omitempty"`
+	Files  []string `json:"files,omitempty"`
+}
+
+// Prints the outcome of a command: the line of text for table output, the
+// record otherwise.
+func printResult(rec *resultRecord, format string, args ...interface{}) {
+	if jsonOutput() {
+		printJSON([]interface{}{rec})
+	} else {
+		fmt.Printf(format, args...)
+	}
+}
+
+func identString(id *pb.Identity) string {
+	if id == nil {
+		return ""
+	}
+	return id.Handle + "\\" + id.Domain
+}
+
+// A message as JSON, as it stands after edits, retractions and reactions.
+// Thread and Depth place it in ls -threads output.
+type messageRecord struct {
+	*gsdp.JSONMessage
+	Edited    int64          `json:"edited,omitempty"`
+	Retracted bool           `json:"retracted,omitempty"`
+	Reactions map[string]int `json:"reactions,omitempty"`
+	Thread    int            `json:"thread,omitempty"`
+	Depth     int            `json:"depth,omitempty"`
+	Unread    bool           `json:"unread,omitempty"`
+}
+
+func makeMessageRecord(m *pb.RawMessage, pt []byte) *messageRecord {
+	j, err := gsdp.MakeJSONMessage(m, pt)
+	if err != nil {
+		// Still show what we can of a payload that will not unmarshal.
+		j = &gsdp.JSONMessage{MsgId: gsdp.IdentToString(m.MsgId), From: gsdp.MakeJSONIdent(m.FromIdent), Type: m.MsgType.String(), Tstamp: m.Tstamp, Text: string(pt)}
+	}
+	return &messageRecord{JSONMessage: j}
+}
+
+func makeViewRecord(vm *gsdp.ViewMessage) *messageRecord {
+	rec := makeMessageRecord(vm.Msg, vm.Plaintext)
+	rec.Text = vm.Text
+	rec.Edited, rec.Retracted = vm.Edited, vm.Retracted
+	if counts := vm.ReactionCounts(); len(counts) > 0 {
+		rec.Reactions = counts
+	}
+	return rec
+}
+
+func viewRecords(msgs []*gsdp.ViewMessage) []interface{} {
+	records := make([]interface{}, 0, len(msgs))
+	for _, vm := range msgs {
+		records = append(records, makeViewRecord(vm))
+	}
+	return records
+}
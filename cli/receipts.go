@@ -0,0 +1,67 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"time"
+)
+
+func receiptTime(t int64) string {
+	if t == 0 {
+		return "-"
+	}
+	return time.Unix(t, 0).Format("2006-01-02 15:04")
+}
+
+// What a receipt summary row looks like as JSON.
+type receiptRecord struct {
+	Type      string `json:"type"`
+	MsgId     string `json:"msg_id"`
+	Recipient string `json:"recipient"`
+	Delivered int64  `json:"delivered,omitempty"`
+	Read      int64  `json:"read,omitempty"`
+}
+
+func receiptRecords(sts []*gsdp.ReceiptStatus) []interface{} {
+	records := make([]interface{}, 0, len(sts))
+	for _, st := range sts {
+		records = append(records, &receiptRecord{pb.MessageType_RECEIPT.String(), gsdp.IdentToString(st.MsgId), identString(st.Recipient), st.Delivered, st.Read})
+	}
+	return records
+}
+
+// Checks the receipts among msgs against the messages we sent, as kept in
+// archive, and the keys the recipients' domains publish.
+func summarizeReceipts(msgs []*pb.RawMessage, archive *gsdp.Archive, pool *gsdp.ConnectionPool) []*gsdp.ReceiptStatus {
+	return gsdp.SummarizeReceipts(msgs, archive, gsdp.NewDomainKeyStore(pool))
+}
+
+// Prints one row per sent message and recipient we have receipts for.
+func printReceipts(sts []*gsdp.ReceiptStatus) {
+	if len(sts) == 0 {
+		return
+	}
+	fmt.Printf("\nReceipts:\n")
+	matrix := [][]string{[]string{"message", "recipient", "delivered", "read"}}
+	for _, st := range sts {
+		matrix = append(matrix, []string{gsdp.IdentToString(st.MsgId), st.Recipient.Handle + "\\" + st.Recipient.Domain, receiptTime(st.Delivered), receiptTime(st.Read)})
+	}
+	PrintGrid(matrix)
+}
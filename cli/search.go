@@ -0,0 +1,99 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"errors"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"time"
+)
+
+const (
+	dateFormat = "2006-01-02"
+)
+
+func splitList(s string) []string {
+	lst := make([]string, 0)
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			lst = append(lst, p)
+		}
+	}
+	return lst
+}
+
+func parseDate(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	t, err := time.ParseInLocation(dateFormat, s, time.Local)
+	if err != nil {
+		return 0, errors.New("Bad date " + s + ", want YYYY-MM-DD")
+	}
+	return t.Unix(), nil
+}
+
+// Builds a search from the search subcommand's flags. Types and statuses are
+// comma-separated enum names, in any case; until is inclusive.
+func archiveQueryFromFlags(text, from, types, tags, since, until, status string) (gsdp.ArchiveQuery, error) {
+	q := gsdp.ArchiveQuery{Text: text, From: from, Tags: splitList(tags)}
+	for _, t := range splitList(types) {
+		v, ok := pb.MessageType_value[strings.ToUpper(t)]
+		if !ok {
+			return q, errors.New("Unknown message type " + t)
+		}
+		q.Types = append(q.Types, pb.MessageType(v))
+	}
+	for _, st := range splitList(status) {
+		v, ok := pb.TaskStatus_value[strings.ToUpper(st)]
+		if !ok {
+			return q, errors.New("Unknown task status " + st)
+		}
+		q.Status = append(q.Status, pb.TaskStatus(v))
+	}
+	var err error
+	if q.Since, err = parseDate(since); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseDate(until); err != nil {
+		return q, err
+	}
+	if q.Until > 0 {
+		q.Until = time.Unix(q.Until, 0).AddDate(0, 0, 1).Unix()
+	}
+	return q, nil
+}
+
+func printSearch(res []*gsdp.ViewMessage) {
+	matrix := [][]string{[]string{"id", "from", "sent", "type", "text"}}
+	for _, vm := range res {
+		m := vm.Msg
+		text := strings.Replace(viewText(vm), "\n", " ", -1)
+		matrix = append(matrix, []string{gsdp.IdentToString(m.MsgId), m.FromIdent.Handle + "\\" + m.FromIdent.Domain, receiptTime(m.Tstamp), m.MsgType.String(), text})
+	}
+	printOutput(matrix, viewRecords(res))
+}
+
+// Opens the local archive: the configured path, or one next to the identity.
+func openArchive(configured string, identPath string, user gsdp.LocalUser) (*gsdp.Archive, error) {
+	if len(configured) == 0 {
+		configured = identPath + ".archive"
+	}
+	return gsdp.MakeFileArchive(configured, user)
+}
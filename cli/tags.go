@@ -0,0 +1,65 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+)
+
+// Says whether ls should leave a message out: it lacks all of the tags asked
+// for, or, if none were, it has a muted tag and no pinned one. Amendments
+// carry no tags of their own and are always let through.
+func hiddenByTags(m *pb.RawMessage, pt []byte, want []string, prefs *gsdp.TagPrefs) bool {
+	switch m.MsgType {
+	case pb.MessageType_EDIT, pb.MessageType_RETRACT, pb.MessageType_REACTION:
+		return false
+	}
+	tags := gsdp.MessageTags(m, pt)
+	if len(want) > 0 {
+		return !gsdp.HasAnyTag(tags, want)
+	}
+	return prefs.IsMuted(tags) && !prefs.IsPinned(tags)
+}
+
+type tagRecord struct {
+	Tag   string `json:"tag"`
+	State string `json:"state"`
+}
+
+func printTagPrefs(prefs *gsdp.TagPrefs) {
+	matrix := make([][]string, 0)
+	records := make([]interface{}, 0)
+	for _, t := range prefs.Pinned() {
+		matrix = append(matrix, []string{"pinned", t})
+		records = append(records, &tagRecord{t, "pinned"})
+	}
+	for _, t := range prefs.Muted() {
+		matrix = append(matrix, []string{"muted", t})
+		records = append(records, &tagRecord{t, "muted"})
+	}
+	if jsonOutput() {
+		printJSON(records)
+		return
+	}
+	if len(matrix) == 0 {
+		fmt.Printf("No tags pinned or muted.\n")
+		return
+	}
+	PrintGrid(matrix)
+}
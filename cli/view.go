@@ -0,0 +1,104 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"time"
+)
+
+// Finds a handle\domain in the local store, or failing that asks the name
+// server for that domain.
+func lookupRecipient(client *gsdp.GSDPClient, ids gsdp.IdentityStore, to string) (*pb.Identity, error) {
+	pcs := strings.Split(to, "\\")
+	if len(pcs) < 2 {
+		return nil, errors.New("Give the recipient as handle\\domain")
+	}
+	if id := ids.GetIdentityForHandleDomain(pcs[0], pcs[1]); id != nil {
+		return id, nil
+	}
+	res, err := client.Name(&pb.NameInquiry{nil, nil, false, pcs[0], pcs[1]})
+	if err != nil {
+		return nil, err
+	}
+	if res.IsError || res.Name == nil {
+		return nil, errors.New("Cannot find " + to + " at nameserver.")
+	}
+	ids.AddIdentity(res.Name)
+	return res.Name, nil
+}
+
+func viewText(vm *gsdp.ViewMessage) string {
+	if vm.Retracted {
+		return "(retracted)"
+	} else if vm.Edited > 0 {
+		return vm.Text + " (edited)"
+	}
+	return vm.Text
+}
+
+// Prints messages as they stand after edits, retractions and reactions,
+// followed by what receipts say about the messages we sent.
+func printView(msgs []*gsdp.ViewMessage, receipts []*gsdp.ReceiptStatus) {
+	if jsonOutput() {
+		printJSON(append(viewRecords(msgs), receiptRecords(receipts)...))
+		return
+	}
+	matrix := make([][]string, 0)
+	for _, vm := range msgs {
+		m := vm.Msg
+		matrix = append(matrix, []string{gsdp.IdentToString(m.MsgId), m.FromIdent.Handle + "\\" + m.FromIdent.Domain, viewText(vm), strings.Join(vm.ReactionSummary(), " ")})
+	}
+	PrintGrid(matrix)
+	printReceipts(receipts)
+}
+
+// Prints each thread as a tree of replies, marking unread messages with *,
+// followed by what receipts say about the messages we sent.
+func printThreads(threads []*gsdp.Thread, receipts []*gsdp.ReceiptStatus) {
+	if jsonOutput() {
+		records := make([]interface{}, 0)
+		for i, th := range threads {
+			th.Walk(func(n *gsdp.ThreadNode, depth int) {
+				rec := makeViewRecord(n.Msg)
+				rec.Thread, rec.Depth, rec.Unread = i+1, depth, n.Unread
+				records = append(records, rec)
+			})
+		}
+		printJSON(append(records, receiptRecords(receipts)...))
+		return
+	}
+	for _, th := range threads {
+		fmt.Printf("\nThread: %d messages, %d unread, last at %s\n", th.Size, th.Unread, time.Unix(th.Updated, 0).Format("2006-01-02 15:04"))
+		matrix := make([][]string, 0)
+		th.Walk(func(n *gsdp.ThreadNode, depth int) {
+			mark := "  "
+			if n.Unread {
+				mark = "* "
+			}
+			m := n.Msg.Msg
+			from := strings.Repeat("  ", depth) + mark + m.FromIdent.Handle + "\\" + m.FromIdent.Domain
+			matrix = append(matrix, []string{from, viewText(n.Msg), gsdp.IdentToString(m.MsgId)})
+		})
+		PrintGrid(matrix)
+	}
+	printReceipts(receipts)
+}
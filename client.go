@@ -17,9 +17,13 @@
 package gsdp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	pb "github.com/jwvictor/gsdprotocol"
 	"golang.org/x/net/context"
 	"log"
+	"time"
 )
 
 const (
@@ -36,6 +40,7 @@ type GSDPClient struct {
 	user       LocalUser
 	identities IdentityStore
 	connPool   *ConnectionPool
+	sent       *Archive
 }
 
 func (l LocalUser) PrivKey() []byte {
@@ -47,7 +52,13 @@ func (l LocalUser) Ident() []byte {
 }
 
 func NewClient(lident *LocalUser, identities IdentityStore, connPool *ConnectionPool) GSDPClient {
-	return GSDPClient{*lident, identities, connPool}
+	return GSDPClient{*lident, identities, connPool, nil}
+}
+
+// KeepSent has the payloads this client sends archived in a, so that
+// replies and receipts can be matched to them later.
+func (c *GSDPClient) KeepSent(a *Archive) {
+	c.sent = a
 }
 
 func MakeLocalUser(id *pb.Identity, pk []byte) LocalUser {
@@ -67,7 +78,9 @@ func (c *GSDPClient) getConnection(id *pb.Identity) (*OpenConnection, error) {
 	return conn, e
 }
 
-func (c *GSDPClient) GetMine(purge bool) ([]*pb.RawMessage, error) {
+// GetPage fetches up to limit of our messages with a seq above afterSeq.
+// The result's NextSeq is the cursor for the next page.
+func (c *GSDPClient) GetPage(afterSeq uint64, limit int, purge bool, tags []string) (*pb.PendingData, error) {
 	oconn, err := c.getConnection(c.user.identity)
 	if err != nil {
 		return nil, err
@@ -75,44 +88,205 @@ func (c *GSDPClient) GetMine(purge bool) ([]*pb.RawMessage, error) {
 	conn := oconn.conn
 	defer c.connPool.ReleaseConnection(oconn)
 	client := pb.NewGSDPClient(conn)
-	getReq := &pb.GetRequest{c.user.identity, 0, purge, 0, []byte{}}
+	getReq := &pb.GetRequest{c.user.identity, 0, purge, time.Now().Unix(), []byte{}, afterSeq, int32(limit), tags}
+	if err := SignMessage(getReq, &getReq.ProofOfIdent, c.user.privKey); err != nil {
+		return nil, err
+	}
 	pending, err := client.GetMine(context.Background(), getReq)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	lst := make([]*pb.RawMessage, 0)
+	// Don't hand out anything that expired on its way here.
+	now := time.Now().Unix()
+	kept := make([]*pb.RawMessage, 0, len(pending.Messages))
 	for _, m := range pending.Messages {
-		lst = append(lst, m)
+		if !Expired(m, now) {
+			kept = append(kept, m)
+		}
 	}
-	return lst, nil
+	pending.Messages = kept
+	return pending, nil
 }
 
-func (c *GSDPClient) RequestPermissionsFrom(from *pb.Identity, perms *pb.UserPermissions) error {
+// GetMine fetches all of our messages, page by page. With purge, the server
+// deletes them as it hands them over; otherwise Ack them once stored.
+func (c *GSDPClient) GetMine(purge bool) ([]*pb.RawMessage, error) {
+	return c.GetMineTagged(purge, nil)
+}
+
+// GetMineTagged is GetMine for only the messages with one of tags in the
+// clear. Tags inside encrypted content are not seen by the server.
+func (c *GSDPClient) GetMineTagged(purge bool, tags []string) ([]*pb.RawMessage, error) {
+	lst := make([]*pb.RawMessage, 0)
+	cursor := uint64(0)
+	for {
+		pending, err := c.GetPage(cursor, 0, purge, tags)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range pending.Messages {
+			lst = append(lst, m)
+		}
+		if !pending.More {
+			return lst, nil
+		}
+		cursor = pending.NextSeq
+	}
+}
+
+// Ack tells our server it can delete the messages with the given seqs.
+func (c *GSDPClient) Ack(seqs []uint64) error {
+	oconn, err := c.getConnection(c.user.identity)
+	if err != nil {
+		return err
+	}
+	defer c.connPool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	req := &pb.AckRequest{c.user.identity, seqs, time.Now().Unix(), []byte{}}
+	if err := SignMessage(req, &req.ProofOfIdent, c.user.privKey); err != nil {
+		return err
+	}
+	ack, err := client.Ack(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	if ack.IsError {
+		return errors.New(ack.Error)
+	}
 	return nil
 }
 
+// Register asks our server to take us on as a local user, proving we hold
+// our private key. Only works on servers with open registration.
+func (c *GSDPClient) Register() error {
+	oconn, err := c.getConnection(c.user.identity)
+	if err != nil {
+		return err
+	}
+	defer c.connPool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	reg := &pb.Registration{c.user.identity, time.Now().Unix(), []byte{}}
+	if err := SignMessage(reg, &reg.Signature, c.user.privKey); err != nil {
+		return err
+	}
+	ack, err := client.Register(context.Background(), reg)
+	if err != nil {
+		return err
+	}
+	if ack.IsError {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+// RequestPermissionsFrom asks another user's server for permissions, signed
+// by us and stamped if that server asks for proof of work.
+func (c *GSDPClient) RequestPermissionsFrom(from *pb.Identity, perms *pb.UserPermissions) error {
+	if perms == nil {
+		perms = &pb.UserPermissions{Ident: c.user.identity}
+	}
+	oconn, err := c.getConnection(from)
+	if err != nil {
+		return err
+	}
+	defer c.connPool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	name, err := client.Name(context.Background(), &pb.NameInquiry{c.user.identity, nil, false, from.Handle, from.Domain})
+	if err != nil {
+		return err
+	}
+	req := &pb.RequestPermissions{from, perms, []byte{}, time.Now().Unix(), []byte{}}
+	if name.StampBits > 0 {
+		if name.StampBits > MaxStampBits {
+			return fmt.Errorf("Server for %s wants a %d bit stamp", from.Domain, name.StampBits)
+		}
+		StampPermissionRequest(req, int(name.StampBits))
+	}
+	if err := SignMessage(req, &req.Signature, c.user.privKey); err != nil {
+		return err
+	}
+	_, err = client.Sup(context.Background(), req)
+	return err
+}
+
 func (c *GSDPClient) SendK(perms *pb.UserPermissions) error {
 	oconn, err := c.getConnection(perms.Ident)
-	defer c.connPool.ReleaseConnection(oconn)
 	if err != nil {
 		return err
 	}
+	defer c.connPool.ReleaseConnection(oconn)
 	conn := oconn.conn
 	client := pb.NewGSDPClient(conn)
-	approval := &pb.ApprovePermissions{c.user.identity, perms, []byte{}}
+	approval := &pb.ApprovePermissions{c.user.identity, perms, []byte{}, 0}
 	client.K(context.Background(), approval)
 	return nil
 }
 
+// Say sends msg, giving it an id if it has none; sending it again is then
+// harmless. Messages from us are signed so the recipient's server knows who
+// sent them. If that server wants proof of work because we aren't an
+// established contact, the message is stamped and sent again.
 func (c *GSDPClient) Say(msg *pb.RawMessage) error {
+	return c.say(msg, true)
+}
+
+// Sends msg as Say does. Without stamp, a message the recipient's server
+// wants proof of work for is not stamped and sent again, but refused.
+func (c *GSDPClient) say(msg *pb.RawMessage, stamp bool) error {
 	oconn, err := c.getConnection(msg.ToIdent[0]) // TODO: send to ALL!!!!
-	defer c.connPool.ReleaseConnection(oconn)
 	if err != nil {
 		return err
 	}
+	defer c.connPool.ReleaseConnection(oconn)
 	conn := oconn.conn
 	client := pb.NewGSDPClient(conn)
-	client.Say(context.Background(), msg)
+	if len(msg.MsgId) == 0 {
+		msg.MsgId = NewMsgId()
+	}
+	if len(msg.Signature) == 0 && msg.FromIdent != nil && bytes.Equal(msg.FromIdent.Ident, c.user.identity.Ident) {
+		if err := SignRawMessage(msg, c.user.privKey); err != nil {
+			return err
+		}
+	}
+	ack, err := client.Say(context.Background(), msg)
+	if err != nil {
+		return err
+	}
+	if stamp && ack.IsError && ack.StampBits > 0 && len(msg.Stamp) == 0 {
+		if ack.StampBits > MaxStampBits {
+			return fmt.Errorf("Server for %s wants a %d bit stamp", msg.ToIdent[0].Domain, ack.StampBits)
+		}
+		StampMessage(msg, int(ack.StampBits))
+		if ack, err = client.Say(context.Background(), msg); err != nil {
+			return err
+		}
+	}
+	if ack.IsError {
+		return errors.New(ack.Error)
+	}
+	return nil
+}
+
+// GrantPermissions has our server take to as an established contact of
+// ours, who no longer needs to stamp what they send us.
+func (c *GSDPClient) GrantPermissions(to *pb.Identity) error {
+	oconn, err := c.getConnection(c.user.identity)
+	if err != nil {
+		return err
+	}
+	defer c.connPool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	req := &pb.ApprovePermissions{c.user.identity, &pb.UserPermissions{Ident: to}, []byte{}, time.Now().Unix()}
+	if err := SignMessage(req, &req.Signature, c.user.privKey); err != nil {
+		return err
+	}
+	ack, err := client.Grant(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	if ack.IsError {
+		return errors.New(ack.Error)
+	}
 	return nil
 }
 
@@ -124,10 +298,10 @@ func (c *GSDPClient) Name(req *pb.NameInquiry) (*pb.NameResponse, error) {
 	//h := req.RequestHandle
 	d := req.RequestDomain
 	oconn, err := c.getConnectionByDomain(d)
-	defer c.connPool.ReleaseConnection(oconn)
 	if err != nil {
 		return nil, err
 	}
+	defer c.connPool.ReleaseConnection(oconn)
 	conn := oconn.conn
 	client := pb.NewGSDPClient(conn)
 	a, b := client.Name(context.Background(), req)
@@ -0,0 +1,80 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DiffLanguage = "diff"
+)
+
+var languagesByExt = map[string]string{
+	".c":     "c",
+	".h":     "c",
+	".cc":    "c++",
+	".cpp":   "c++",
+	".hpp":   "c++",
+	".css":   "css",
+	".diff":  DiffLanguage,
+	".patch": DiffLanguage,
+	".go":    "go",
+	".html":  "html",
+	".java":  "java",
+	".js":    "javascript",
+	".json":  "json",
+	".md":    "markdown",
+	".proto": "protobuf",
+	".py":    "python",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".sh":    "shell",
+	".sql":   "sql",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+}
+
+// LanguageForFile guesses a file's language from its name, or returns "".
+func LanguageForFile(name string) string {
+	if filepath.Base(name) == "Makefile" {
+		return "make"
+	}
+	return languagesByExt[strings.ToLower(filepath.Ext(name))]
+}
+
+// MakeCodeShare shares the contents of a file, guessing its language unless
+// one is given. Code that looks like a unified diff is shared as one.
+func MakeCodeShare(filename string, code string, language string, note string, tags []string) *pb.CodeShare {
+	if len(language) == 0 {
+		language = LanguageForFile(filename)
+	}
+	if len(language) == 0 && LooksLikePatch(code) {
+		language = DiffLanguage
+	}
+	return &pb.CodeShare{code, time.Now().Unix(), note, language, nil, tags, filepath.Base(filename)}
+}
+
+// IsPatch says whether a code share is a unified diff that can be applied.
+func IsPatch(cs *pb.CodeShare) bool {
+	return strings.ToLower(cs.Language) == DiffLanguage || (len(cs.Language) == 0 && LooksLikePatch(cs.Code))
+}
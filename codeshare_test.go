@@ -0,0 +1,44 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"testing"
+)
+
+func TestLanguageForFile(t *testing.T) {
+	for name, want := range map[string]string{"main.go": "go", "src/App.JS": "javascript", "Makefile": "make", "fix.patch": DiffLanguage, "notes": ""} {
+		if got := LanguageForFile(name); got != want {
+			t.Errorf("Language for %s is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestMakeCodeShare(t *testing.T) {
+	cs := MakeCodeShare("/home/me/src/main.go", "package main\n", "", "look", []string{"web"})
+	if cs.Filename != "main.go" || cs.Language != "go" || cs.Note != "look" || IsPatch(cs) {
+		t.Errorf("Bad code share: %v", cs)
+	}
+	diff := MakeCodeShare("changes", mockPatch, "", "", nil)
+	if diff.Language != DiffLanguage || !IsPatch(diff) {
+		t.Errorf("Diff not shared as a patch: %v", diff)
+	}
+	if !IsPatch(&pb.CodeShare{Code: mockPatch}) {
+		t.Error("Unlabelled diff is not a patch")
+	}
+}
@@ -18,8 +18,10 @@ package gsdp
 
 import (
 	"errors"
+	"golang.org/x/net/context"
 	"log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 	"sync"
 	"time"
 )
@@ -30,6 +32,11 @@ const (
 	CONN_OPEN   = iota
 )
 
+const (
+	defaultIdleTimeout = 10 * time.Second
+	defaultReapFreq    = 60 * time.Second
+)
+
 type ConnPoolStatus int
 
 type OpenConnection struct {
@@ -37,31 +44,102 @@ type OpenConnection struct {
 	domain   string
 	state    ConnPoolStatus
 	lastUsed int64
+	created  int64
+}
+
+// PoolOptions controls how a ConnectionPool dials, keeps and reaps
+// connections. Zero values mean "no limit" for MaxLifetime, MaxConns and
+// DialTimeout; Keepalive is only applied if its Time is set.
+type PoolOptions struct {
+	IdleTimeout        time.Duration
+	MaxLifetime        time.Duration
+	ReapFrequency      time.Duration
+	MaxConns           int
+	DialTimeout        time.Duration
+	Port               string
+	Keepalive          keepalive.ClientParameters
+	DialOptions        []grpc.DialOption
+	UnaryInterceptors  []grpc.UnaryClientInterceptor
+	StreamInterceptors []grpc.StreamClientInterceptor
 }
 
 type ConnectionPool struct {
 	connExists map[string]bool
 	connPtrs   map[string]*OpenConnection
 	connRecvrs map[string]chan *OpenConnection
+	dialing    map[string]chan struct{} // Closed once the dial is done
 	lock       *sync.Mutex
-	reapFreq   time.Duration
+	opts       PoolOptions
+	done       chan struct{}
+	closed     bool
+}
+
+func DefaultPoolOptions() PoolOptions {
+	return PoolOptions{
+		IdleTimeout:   defaultIdleTimeout,
+		ReapFrequency: defaultReapFreq,
+		Port:          default_port,
+	}
 }
 
 func NewConnectionPool(reapF time.Duration) *ConnectionPool {
+	opts := DefaultPoolOptions()
+	opts.ReapFrequency = reapF
+	return NewConnectionPoolWithOptions(opts)
+}
+
+func NewConnectionPoolWithOptions(opts PoolOptions) *ConnectionPool {
 	ce := make(map[string]bool)
 	cp := make(map[string]*OpenConnection)
 	cr := make(map[string]chan *OpenConnection)
 	m := &sync.Mutex{}
-	p := &ConnectionPool{ce, cp, cr, m, reapF}
+	defaults := DefaultPoolOptions()
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = defaults.IdleTimeout
+	}
+	if opts.ReapFrequency == 0 {
+		opts.ReapFrequency = defaults.ReapFrequency
+	}
+	if len(opts.Port) == 0 {
+		opts.Port = defaults.Port
+	}
+	p := &ConnectionPool{ce, cp, cr, make(map[string]chan struct{}), m, opts, make(chan struct{}), false}
 	return p
 }
 
+func (p *ConnectionPool) Options() PoolOptions {
+	return p.opts
+}
+
 func (p *ConnectionPool) Start() {
 	go p.ReapForPool()
 }
 
+func (c *ConnectionPool) dialOptions() []grpc.DialOption {
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if c.opts.Keepalive.Time > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(c.opts.Keepalive))
+	}
+	if len(c.opts.UnaryInterceptors) > 0 {
+		opts = append(opts, grpc.WithChainUnaryInterceptor(c.opts.UnaryInterceptors...))
+	}
+	if len(c.opts.StreamInterceptors) > 0 {
+		opts = append(opts, grpc.WithChainStreamInterceptor(c.opts.StreamInterceptors...))
+	}
+	if c.opts.DialTimeout > 0 {
+		opts = append(opts, grpc.WithBlock())
+	}
+	return append(opts, c.opts.DialOptions...)
+}
+
 func (c *ConnectionPool) makeConnectionForDomain(domain string) (*grpc.ClientConn, error) {
-	conn, err := grpc.Dial(domain+":"+default_port, grpc.WithInsecure())
+	ctx := context.Background()
+	if c.opts.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opts.DialTimeout)
+		defer cancel()
+	}
+	conn, err := grpc.DialContext(ctx, domain+":"+c.opts.Port, c.dialOptions()...)
 	if err != nil {
 		return nil, err
 	}
@@ -69,18 +147,70 @@ func (c *ConnectionPool) makeConnectionForDomain(domain string) (*grpc.ClientCon
 }
 
 func makeNewOpenConnection(conn *grpc.ClientConn, domain string) *OpenConnection {
-	return &OpenConnection{conn, domain, CONN_OPEN, time.Now().Unix()}
+	now := time.Now().Unix()
+	return &OpenConnection{conn, domain, CONN_OPEN, now, now}
+}
+
+// Evicts the least recently used connection that is not currently checked
+// out. Returns false if every connection is in use.
+func (p *ConnectionPool) evictIdleNotThreadSafe() bool {
+	var lru *OpenConnection
+	for _, oc := range p.connPtrs {
+		if lru == nil || oc.lastUsed < lru.lastUsed {
+			ch := p.connRecvrs[oc.domain]
+			select {
+			case c := <-ch:
+				ch <- c
+				lru = oc
+			default:
+			}
+		}
+	}
+	if lru == nil {
+		return false
+	}
+	p.ReapConnectionNotThreadSafe(lru.domain)
+	return true
 }
 
 func (p *ConnectionPool) GetConnection(domain string) (*OpenConnection, error) {
 	p.lock.Lock()
+	// Someone else may be dialing the domain; wait for them, without the
+	// lock, and see what they got.
+	for wait, ok := p.dialing[domain]; ok && !p.closed; wait, ok = p.dialing[domain] {
+		p.lock.Unlock()
+		<-wait
+		p.lock.Lock()
+	}
+	if p.closed {
+		p.lock.Unlock()
+		return nil, errors.New("Connection pool is closed")
+	}
 	if b, ok := p.connExists[domain]; !(ok && b) {
 		// NOTE: in theory we could allow multiple connections by making this a counter
-		p.connExists[domain] = true
-		if cc, err := p.makeConnectionForDomain(domain); err != nil {
+		if p.opts.MaxConns > 0 && len(p.connPtrs)+len(p.dialing) >= p.opts.MaxConns && !p.evictIdleNotThreadSafe() {
+			p.lock.Unlock()
+			return nil, errors.New("Connection pool is full")
+		}
+		// Dialing can block for up to DialTimeout, which must not hold up
+		// everyone else using the pool.
+		wait := make(chan struct{})
+		p.dialing[domain] = wait
+		p.lock.Unlock()
+		cc, err := p.makeConnectionForDomain(domain)
+		p.lock.Lock()
+		delete(p.dialing, domain)
+		close(wait)
+		if err == nil && p.closed {
+			cc.Close()
+			err = errors.New("Connection pool is closed")
+		}
+		if err != nil {
+			p.lock.Unlock()
 			return nil, err
 		} else {
 			log.Printf("Making new connection for domain %s\n", domain)
+			p.connExists[domain] = true
 			oc := makeNewOpenConnection(cc, domain)
 			p.connPtrs[domain] = oc
 			oc.state = CONN_USED
@@ -92,7 +222,10 @@ func (p *ConnectionPool) GetConnection(domain string) (*OpenConnection, error) {
 	ch := p.connRecvrs[domain]
 	p.lock.Unlock() // Only lock on whether connections need to be created
 	log.Printf("Unlock for connection for %s, waiting...\n", domain)
-	x := <-ch // Blocking wait
+	x, ok := <-ch // Blocking wait
+	if !ok {
+		return nil, errors.New("Connection to " + domain + " was closed while waiting")
+	}
 	x.lastUsed = time.Now().Unix()
 	return x, nil
 }
@@ -107,9 +240,15 @@ func (p *ConnectionPool) ReleaseConnection(conn *OpenConnection) error {
 }
 
 func (p *ConnectionPool) ReapNotThreadSafe() error {
+	now := time.Now().Unix()
+	idle := int64(p.opts.IdleTimeout / time.Second)
+	life := int64(p.opts.MaxLifetime / time.Second)
 	for dom, oc := range p.connPtrs {
-		if (time.Now().Unix() - oc.lastUsed) >= 10 {
-			log.Printf("More than 10 seconds elapsed for connection to %s...\n", dom)
+		if (now - oc.lastUsed) >= idle {
+			log.Printf("More than %v elapsed for connection to %s...\n", p.opts.IdleTimeout, dom)
+			p.ReapConnectionNotThreadSafe(dom)
+		} else if life > 0 && (now-oc.created) >= life {
+			log.Printf("Connection to %s is older than %v...\n", dom, p.opts.MaxLifetime)
 			p.ReapConnectionNotThreadSafe(dom)
 		}
 	}
@@ -123,19 +262,42 @@ func (p *ConnectionPool) ReapConnectionNotThreadSafe(domain string) error {
 	close(ch)
 	delete(p.connRecvrs, domain)
 	delete(p.connPtrs, domain)
-	c.conn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
 	c.state = CONN_CLOSED
 	log.Printf("CLOSED connection to domain %s\n", c.domain)
 	return nil
 }
 
 func (p *ConnectionPool) ReapForPool() error {
-	ticker := time.NewTicker(p.reapFreq)
-	for t := range ticker.C {
-		log.Printf("Reaping connections at %v\n", t)
-		p.lock.Lock()
-		p.ReapNotThreadSafe()
-		p.lock.Unlock()
+	ticker := time.NewTicker(p.opts.ReapFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case t := <-ticker.C:
+			log.Printf("Reaping connections at %v\n", t)
+			p.lock.Lock()
+			p.ReapNotThreadSafe()
+			p.lock.Unlock()
+		case <-p.done:
+			return nil
+		}
+	}
+}
+
+// Close stops the reaper and closes every connection in the pool, waiting
+// for connections that are in use to be released first.
+func (p *ConnectionPool) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	for dom, _ := range p.connPtrs {
+		p.ReapConnectionNotThreadSafe(dom)
 	}
 	return nil
 }
@@ -17,7 +17,13 @@
 package gsdp
 
 import (
+	"errors"
 	"fmt"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -25,7 +31,7 @@ import (
 func getMockPool() *ConnectionPool {
 	td, _ := time.ParseDuration("10000ms")
 	p := NewConnectionPool(td)
-	oc := &OpenConnection{nil, "test.com", CONN_CLOSED, time.Now().Unix()}
+	oc := &OpenConnection{nil, "test.com", CONN_CLOSED, time.Now().Unix(), time.Now().Unix()}
 	p.connPtrs["test.com"] = oc
 	p.connExists["test.com"] = true
 	ch := make(chan *OpenConnection, 1) // Buffered channel of size 1
@@ -86,3 +92,107 @@ func TestPoolReleaseLogic(t *testing.T) {
 		t.Error("Couldn't get connection out second time")
 	}
 }
+
+func TestPoolClose(t *testing.T) {
+	p := getMockPool()
+	p.Start()
+	if err := p.Close(); err != nil {
+		t.Error(fmt.Sprintf("Got an error closing pool: %v", err))
+	}
+	if len(p.connPtrs) != 0 {
+		t.Error("Connections left in pool after close")
+	}
+	if _, err := p.GetConnection("test.com"); err == nil {
+		t.Error("Got a connection from a closed pool")
+	}
+	if err := p.Close(); err != nil {
+		t.Error("Second close should be a no-op")
+	}
+}
+
+func TestPoolReapsIdleConnections(t *testing.T) {
+	p := getMockPool()
+	p.opts.IdleTimeout = time.Second
+	p.ReapNotThreadSafe()
+	if len(p.connPtrs) != 1 {
+		t.Error("Reaped a fresh connection")
+	}
+	p.connPtrs["test.com"].lastUsed -= 2
+	p.ReapNotThreadSafe()
+	if len(p.connPtrs) != 0 {
+		t.Error("Idle connection was not reaped")
+	}
+}
+
+func TestPoolMaxConnsEvictsIdle(t *testing.T) {
+	p := getMockPool()
+	p.opts.MaxConns = 1
+	if !p.evictIdleNotThreadSafe() {
+		t.Error("Could not evict idle connection")
+	}
+	if _, ok := p.connPtrs["test.com"]; ok {
+		t.Error("Evicted connection still in pool")
+	}
+	p = getMockPool()
+	p.opts.MaxConns = 1
+	oc, _ := p.GetConnection("test.com")
+	if p.evictIdleNotThreadSafe() {
+		t.Error("Evicted a connection that is in use")
+	}
+	p.ReleaseConnection(oc)
+}
+
+func TestSlowDialDoesNotHoldUpThePool(t *testing.T) {
+	p := getMockPool()
+	p.opts.DialTimeout = 3 * time.Second
+	dialed, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	p.opts.DialOptions = []grpc.DialOption{grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		once.Do(func() { close(dialed) })
+		<-unblock
+		return nil, errors.New("unreachable")
+	})}
+	res := make(chan error)
+	go func() {
+		_, err := p.GetConnection("slow.com")
+		res <- err
+	}()
+	<-dialed
+
+	got := make(chan *OpenConnection)
+	go func() {
+		oc, _ := p.GetConnection("test.com")
+		got <- oc
+	}()
+	select {
+	case oc := <-got:
+		p.ReleaseConnection(oc)
+	case <-time.After(time.Second):
+		t.Fatal("Waited on another domain's dial")
+	}
+	closed := make(chan error)
+	go func() { closed <- p.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited on a dial")
+	}
+	close(unblock)
+	if err := <-res; err == nil {
+		t.Error("Got a connection from a pool closed while dialing")
+	}
+}
+
+func TestClientFailedDialDoesNotPanic(t *testing.T) {
+	p := getMockPool()
+	p.Close()
+	id, privk := NewIdentity("a", "a", "nowhere.invalid", "")
+	uu := MakeLocalUser(id, privk)
+	c := NewClient(&uu, NewInMemoryIdentStore(), p)
+	if err := c.SendK(&pb.UserPermissions{Ident: id}); err == nil {
+		t.Error("SendK through a closed pool should fail")
+	}
+	if _, err := c.Name(&pb.NameInquiry{id, nil, false, "a", "nowhere.invalid"}); err == nil {
+		t.Error("Name through a closed pool should fail")
+	}
+}
@@ -17,6 +17,8 @@
 package gsdp
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -24,6 +26,7 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/golang/protobuf/proto"
 	pb "github.com/jwvictor/gsdprotocol"
@@ -198,6 +201,98 @@ func LoadIdentity(path string) (*pb.Identity, []byte, error) {
 	return ident, privk, nil
 }
 
+// SignBytes signs the SHA-256 hash of data with a private key as stored in a
+// .priv file.
+func SignBytes(privk []byte, data []byte) ([]byte, error) {
+	key := BytesToPrivKey(privk)
+	if key == nil {
+		return nil, errors.New("Bad private key")
+	}
+	hashd := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashd[:])
+}
+
+// VerifyBytes checks a signature made by SignBytes against the public key of
+// an identity.
+func VerifyBytes(id *pb.Identity, data []byte, sig []byte) error {
+	key := BytesToPubKey(id.PubKey)
+	if key == nil {
+		return errors.New("Bad public key")
+	}
+	if !bytes.Equal(BytesToIdentHash(id.PubKey), id.Ident) {
+		return errors.New("Ident does not match public key")
+	}
+	hashd := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashd[:], sig)
+}
+
+// SignMessage signs the marshaled form of msg, with the signature field sig
+// points into left empty, and stores the signature in that field.
+func SignMessage(msg proto.Message, sig *[]byte, privk []byte) error {
+	*sig = nil
+	bs, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	signed, err := SignBytes(privk, bs)
+	if err != nil {
+		return err
+	}
+	*sig = signed
+	return nil
+}
+
+// VerifyMessage checks a signature made by SignMessage. The signature field
+// is restored before returning.
+func VerifyMessage(msg proto.Message, sig *[]byte, id *pb.Identity) error {
+	signed := *sig
+	*sig = nil
+	bs, err := proto.Marshal(msg)
+	*sig = signed
+	if err != nil {
+		return err
+	}
+	return VerifyBytes(id, bs, signed)
+}
+
+// What a sender signs of a RawMessage: everything but the signature itself,
+// the stamp, which is only added if the recipient's server asks for one, and
+// what that server fills in on delivery.
+func rawMessageSigningBytes(msg *pb.RawMessage) ([]byte, error) {
+	m := proto.Clone(msg).(*pb.RawMessage)
+	m.Signature, m.Stamp, m.Seq, m.ReceivedUtc = nil, nil, 0, 0
+	return proto.Marshal(m)
+}
+
+// SignRawMessage signs msg with its sender's key. Give the message its id
+// before signing it.
+func SignRawMessage(msg *pb.RawMessage, privk []byte) error {
+	bs, err := rawMessageSigningBytes(msg)
+	if err != nil {
+		return err
+	}
+	sig, err := SignBytes(privk, bs)
+	if err != nil {
+		return err
+	}
+	msg.Signature = sig
+	return nil
+}
+
+// VerifyRawMessage checks that msg was signed with the key behind its
+// FromIdent. This proves who holds the key, not the handle or domain the
+// identity claims.
+func VerifyRawMessage(msg *pb.RawMessage) error {
+	if msg.FromIdent == nil || len(msg.Signature) == 0 {
+		return errors.New("Message is not signed")
+	}
+	bs, err := rawMessageSigningBytes(msg)
+	if err != nil {
+		return err
+	}
+	return VerifyBytes(msg.FromIdent, bs, msg.Signature)
+}
+
 func BytesToIdentHash(pubkbs []byte) []byte {
 	hashd := sha256.Sum256(pubkbs)
 	return hashd[:]
@@ -64,7 +64,7 @@ func TestEncryptMessage(t *testing.T) {
 	txtBytes := []byte("hi there")
 	nothin := []byte{}
 	recips := []*pb.Identity{id}
-	rawm := &pb.RawMessage{id, recips, nothin, pb.MessageType_PLAIN, txtBytes, nothin, nothin, time.Now().Unix(), nothin, nothin}
+	rawm := &pb.RawMessage{id, recips, nothin, pb.MessageType_PLAIN, txtBytes, nothin, nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
 	err := DoRawMessageEncryption(txtBytes, id, rawm)
 	if err != nil {
 		t.Error(fmt.Sprintf("Got an error from encryption: %v", err))
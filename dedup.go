@@ -0,0 +1,111 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"sync"
+)
+
+const (
+	msgIdLen = 16
+
+	// Longest message id a server accepts.
+	maxMsgIdLen = 64
+
+	// How many recent message ids are remembered per mailbox.
+	dedupWindowSize = 1024
+)
+
+// NewMsgId returns a random 128-bit message id.
+func NewMsgId() []byte {
+	id := make([]byte, msgIdLen)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// ContentMsgId derives a message id from the message itself, for messages
+// sent without one.
+func ContentMsgId(msg *pb.RawMessage) []byte {
+	bs, _ := proto.Marshal(msg)
+	sum := sha256.Sum256(bs)
+	return sum[:msgIdLen]
+}
+
+type dedupBox struct {
+	senders map[string][]byte
+	order   []string
+}
+
+// A DedupWindow remembers the ids of the last messages delivered to each
+// mailbox, and who sent them, so that retried deliveries can be spotted.
+type DedupWindow struct {
+	boxes map[string]*dedupBox
+	size  int
+	lck   *sync.Mutex
+}
+
+func NewDedupWindow(size int) *DedupWindow {
+	return &DedupWindow{make(map[string]*dedupBox), size, &sync.Mutex{}}
+}
+
+// See records that msgId was delivered to box. It returns whether the id was
+// already there, and if so whether it came from someone other than sender.
+func (w *DedupWindow) See(box string, msgId []byte, sender []byte) (bool, bool) {
+	k := string(msgId)
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	b, ok := w.boxes[box]
+	if !ok {
+		b = &dedupBox{make(map[string][]byte), make([]string, 0)}
+		w.boxes[box] = b
+	}
+	if from, ok := b.senders[k]; ok {
+		return true, !bytes.Equal(from, sender)
+	}
+	b.senders[k] = sender
+	b.order = append(b.order, k)
+	if len(b.order) > w.size {
+		delete(b.senders, b.order[0])
+		b.order = b.order[1:]
+	}
+	return false, false
+}
+
+// Forget drops msgId from box's window, e.g. because delivery failed.
+func (w *DedupWindow) Forget(box string, msgId []byte) {
+	k := string(msgId)
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	b, ok := w.boxes[box]
+	if !ok {
+		return
+	}
+	delete(b.senders, k)
+	for i, o := range b.order {
+		if o == k {
+			b.order = append(b.order[:i], b.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestDedupWindowIsBounded(t *testing.T) {
+	w := NewDedupWindow(2)
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+	w.See("box", a, []byte("me"))
+	if dup, conflict := w.See("box", a, []byte("me")); !dup || conflict {
+		t.Error("Retry not spotted")
+	}
+	if dup, conflict := w.See("box", a, []byte("you")); !dup || !conflict {
+		t.Error("Id reused by another sender not spotted")
+	}
+	if dup, _ := w.See("other", a, []byte("me")); dup {
+		t.Error("Windows are not per mailbox")
+	}
+	w.See("box", b, []byte("me"))
+	w.See("box", c, []byte("me"))
+	if dup, _ := w.See("box", a, []byte("me")); dup {
+		t.Error("Window kept more ids than its size")
+	}
+}
+
+func TestSayIsIdempotent(t *testing.T) {
+	gs := getMockServer(true)
+	from, _, _ := makeAnIdentity()
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+	box := IdentToString(to.Ident)
+
+	msg := makeMockMessage(from, to)
+	for i := 0; i < 3; i++ {
+		if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+			t.Errorf("Retry %d rejected: %s", i, ack.Error)
+		}
+	}
+	if n, _ := gs.mailboxes.Stat(box); n != 1 {
+		t.Errorf("Retried message delivered %d times", n)
+	}
+	spoof := makeMockMessage(to, to)
+	spoof.MsgId = msg.MsgId
+	if ack, _ := gs.Say(context.Background(), spoof); !ack.IsError {
+		t.Error("Another sender reused a message id")
+	}
+
+	anon := makeMockMessage(from, to)
+	anon.MsgId = nil
+	gs.Say(context.Background(), anon)
+	msgs := gs.mailboxes.Get(box, false)
+	if len(msgs) != 2 || len(msgs[1].MsgId) == 0 || bytes.Equal(msgs[0].MsgId, msgs[1].MsgId) {
+		t.Error("Message without an id was not given one")
+	}
+}
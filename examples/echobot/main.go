@@ -0,0 +1,109 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+// echobot is a sample bot. It echoes plain messages, acknowledges questions
+// and triages tasks by priority. Run it against a local server with an
+// identity made by gsdpcli newid:
+//
+//	go run ./examples/echobot -id ~/.gsdp/bot -pubidpath ~/.gsdp/idents -register
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/jwvictor/gsdp"
+	"github.com/jwvictor/gsdp/bot"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	urgentPriority = 3
+)
+
+func main() {
+	idPath := flag.String("id", "", "Identity path (without .priv or .ident)")
+	idsPath := flag.String("pubidpath", "", "Public identity path (directory)")
+	cursorPath := flag.String("cursor", "", "Cursor file (default <identity>.cursor)")
+	register := flag.Bool("register", false, "Register with the server first")
+	pollFreq := flag.Duration("poll", 5*time.Second, "How often to check for mail")
+	flag.Parse()
+
+	id, privk, err := gsdp.LoadIdentity(*idPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*cursorPath) == 0 {
+		*cursorPath = *idPath + ".cursor"
+	}
+	identities := gsdp.MakeInMemoryIdentStoreFromFiles(*idsPath)
+	pool := gsdp.NewConnectionPoolWithOptions(gsdp.DefaultPoolOptions())
+	pool.Start()
+	defer pool.Close()
+	uu := gsdp.MakeLocalUser(id, privk)
+	client := gsdp.NewClient(&uu, identities, pool)
+	if *register {
+		if err := client.Register(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	opts := bot.DefaultOptions()
+	opts.CursorPath = *cursorPath
+	opts.PollFreq = *pollFreq
+	opts.Ack = true
+	opts.Identities = identities
+	b, err := bot.New(id, privk, &client, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.HandleText(func(b *bot.Bot, m *bot.Message, text string) error {
+		_, err := b.Reply(m, "echo: "+text)
+		return err
+	})
+	b.HandleQuestion(func(b *bot.Bot, m *bot.Message, question string) error {
+		_, err := b.Answer(m, "Got your question; someone will get back to you.")
+		return err
+	})
+	b.HandleTask(func(b *bot.Bot, m *bot.Message, task *pb.TaskAssign) error {
+		if task.Priority >= urgentPriority {
+			_, err := b.UpdateTask(m, pb.TaskStatus_IN_PROGRESS, "Urgent: picked up right away.")
+			return err
+		}
+		_, err := b.UpdateTask(m, pb.TaskStatus_STAGING, "Queued for the next triage.")
+		return err
+	})
+	b.HandleDefault(func(b *bot.Bot, m *bot.Message) error {
+		log.Printf("Ignoring %s from %s\\%s\n", m.Raw.MsgType, m.From().Handle, m.From().Domain)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+	fmt.Printf("Running as %s\\%s\n", id.Handle, id.Domain)
+	b.Run(ctx)
+	fmt.Printf("Stopped at seq %d.\n", b.Cursor().Seq())
+}
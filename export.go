@@ -0,0 +1,195 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io"
+	"time"
+)
+
+const (
+	maxExportRecord = 64 << 20
+)
+
+// An export is a portable copy of a user's messages: a stream of records,
+// each a uvarint length and then that many bytes. Every record is a
+// marshaled RawMessage, as it was received and still encrypted to the owner,
+// except the last, which is a signed ExportManifest.
+
+func writeRecord(w io.Writer, bs []byte) error {
+	var n [binary.MaxVarintLen64]byte
+	if _, err := w.Write(n[:binary.PutUvarint(n[:], uint64(len(bs)))]); err != nil {
+		return err
+	}
+	_, err := w.Write(bs)
+	return err
+}
+
+// WriteExport writes msgs to w as an export of owner's messages, signed by
+// signer.
+func WriteExport(w io.Writer, owner *pb.Identity, msgs []*pb.RawMessage, signer LocalUser) error {
+	h := sha256.New()
+	bw := bufio.NewWriter(w)
+	out := io.MultiWriter(bw, h)
+	for _, m := range msgs {
+		bs, err := proto.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if err := writeRecord(out, bs); err != nil {
+			return err
+		}
+	}
+	man := &pb.ExportManifest{owner, signer.identity, time.Now().Unix(), uint64(len(msgs)), h.Sum(nil), []byte{}}
+	if err := SignMessage(man, &man.Signature, signer.privKey); err != nil {
+		return err
+	}
+	bs, err := proto.Marshal(man)
+	if err != nil {
+		return err
+	}
+	if err := writeRecord(bw, bs); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadExport reads an export and checks it: the manifest must be signed by
+// the owner, or by the key keys gives for the owner's domain, and must match
+// the messages before it. With no keys, only exports signed by their owner
+// are accepted. Nothing is returned unless it all checks out.
+func ReadExport(r io.Reader, keys DomainKeys) (*pb.ExportManifest, []*pb.RawMessage, error) {
+	br := bufio.NewReader(r)
+	records := make([][]byte, 0)
+	var prefixed bytes.Buffer
+	h := sha256.New()
+	for {
+		n, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if n > maxExportRecord {
+			return nil, nil, errors.New("Export record too large")
+		}
+		bs := make([]byte, n)
+		if _, err := io.ReadFull(br, bs); err != nil {
+			return nil, nil, errors.New("Export is truncated")
+		}
+		// Only records before the last one count towards the digest, so hash
+		// each one when the next turns up.
+		if len(records) > 0 {
+			h.Write(prefixed.Bytes())
+		}
+		prefixed.Reset()
+		writeRecord(&prefixed, bs)
+		records = append(records, bs)
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("Export has no manifest")
+	}
+	man := &pb.ExportManifest{}
+	if err := proto.Unmarshal(records[len(records)-1], man); err != nil {
+		return nil, nil, err
+	}
+	if man.Owner == nil || man.Signer == nil {
+		return nil, nil, errors.New("Malformed export manifest")
+	}
+	if !bytes.Equal(man.Signer.Ident, man.Owner.Ident) {
+		if keys == nil {
+			return nil, nil, errors.New("Export not signed by its owner")
+		}
+		key, err := keys.Get(man.Owner.Domain)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(man.Signer.Ident, key.Ident) {
+			return nil, nil, errors.New("Export not signed by its owner or their server")
+		}
+	}
+	if err := VerifyMessage(man, &man.Signature, man.Signer); err != nil {
+		return nil, nil, errors.New("Bad export signature")
+	}
+	if man.MessageCount != uint64(len(records)-1) || !bytes.Equal(man.Digest, h.Sum(nil)) {
+		return nil, nil, errors.New("Export does not match its manifest")
+	}
+	msgs := make([]*pb.RawMessage, 0, len(records)-1)
+	for _, bs := range records[:len(records)-1] {
+		m := &pb.RawMessage{}
+		if err := proto.Unmarshal(bs, m); err != nil {
+			return nil, nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return man, msgs, nil
+}
+
+// Export writes everything in the archive to w, signed by user.
+func (a *Archive) Export(w io.Writer, user LocalUser) error {
+	entries := a.Entries()
+	msgs := make([]*pb.RawMessage, 0, len(entries))
+	for _, e := range entries {
+		msgs = append(msgs, e.Msg)
+	}
+	return WriteExport(w, user.identity, msgs, user)
+}
+
+// Import reads an export of user's messages into the archive, decrypting
+// them with user's key. Imports must belong to user's key, though the
+// domain may differ, so history can follow an identity to a new domain.
+// Exports signed by a server are checked against keys, as in ReadExport.
+// It returns how many messages were new, and fails without adding anything
+// if the export does not check out.
+func (a *Archive) Import(r io.Reader, user LocalUser, keys DomainKeys) (int, error) {
+	man, msgs, err := ReadExport(r, keys)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(man.Owner.Ident, user.identity.Ident) {
+		return 0, errors.New("Export belongs to someone else")
+	}
+	type opened struct {
+		msg       *pb.RawMessage
+		plaintext []byte
+	}
+	lst := make([]opened, 0, len(msgs))
+	for _, m := range msgs {
+		if m.MsgType == pb.MessageType_RECEIPT {
+			continue
+		}
+		pt, err := DoRawMessageDecryption(m, user.privKey)
+		if err != nil {
+			return 0, errors.New("Cannot decrypt message " + IdentToString(m.MsgId) + " in export")
+		}
+		lst = append(lst, opened{m, pt})
+	}
+	n := 0
+	for _, o := range lst {
+		if a.Add(o.msg, o.plaintext) {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,122 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func makeEncryptedMessage(t *testing.T, from *pb.Identity, to *pb.Identity, text string) *pb.RawMessage {
+	msg := makeMockMessage(from, to)
+	if err := DoRawMessageEncryption([]byte(text), to, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestExportImport(t *testing.T) {
+	alice, _, _ := makeAnIdentity()
+	bob, bobk, _ := makeAnIdentity()
+	me := MakeLocalUser(bob, bobk)
+	a, _ := NewArchive(me)
+	for _, text := range []string{"one", "two", "three"} {
+		msg := makeEncryptedMessage(t, alice, bob, text)
+		pt, _ := DoRawMessageDecryption(msg, bobk)
+		a.Add(msg, pt)
+	}
+	var buf bytes.Buffer
+	if err := a.Export(&buf, me); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// The same key on a new domain can take its history along.
+	moved := *bob
+	moved.Domain = "elsewhere"
+	b, _ := NewArchive(MakeLocalUser(&moved, bobk))
+	if n, err := b.Import(bytes.NewReader(data), MakeLocalUser(&moved, bobk), nil); err != nil || n != 3 {
+		t.Fatalf("Imported %d messages: %v", n, err)
+	}
+	if res := b.Search(ArchiveQuery{Text: "two"}); len(res) != 1 {
+		t.Error("Imported message not searchable")
+	}
+	if n, _ := b.Import(bytes.NewReader(data), MakeLocalUser(&moved, bobk), nil); n != 0 {
+		t.Errorf("Imported %d messages twice", n)
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)/3] ^= 1
+	if _, _, err := ReadExport(bytes.NewReader(tampered), nil); err == nil {
+		t.Error("Accepted a tampered export")
+	}
+	if _, _, err := ReadExport(bytes.NewReader(data[:len(data)-10]), nil); err == nil {
+		t.Error("Accepted a truncated export")
+	}
+	_, alicek, _ := makeAnIdentity()
+	other, _ := NewArchive(MakeLocalUser(alice, alicek))
+	if _, err := other.Import(bytes.NewReader(data), MakeLocalUser(alice, alicek), nil); err == nil {
+		t.Error("Imported someone else's export")
+	}
+}
+
+func TestAdminExportMailbox(t *testing.T) {
+	gs, as, admin := getMockAdmin(t)
+	sid, sk, _ := makeAnIdentity()
+	sid.Handle, sid.Domain = ServerHandle, "testname"
+	gs.serverClient = &GSDPClient{user: MakeLocalUser(sid, sk)}
+	user, userk, _ := makeAnIdentity()
+	user.Domain = "testname"
+	req := &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(req, req.Auth, admin)
+	as.RegisterUser(context.Background(), req)
+	gs.Say(context.Background(), makeEncryptedMessage(t, user, user, "note to self"))
+
+	req = &pb.AdminUserRequest{Auth: &pb.AdminAuth{}, Ident: user}
+	signAdminRequest(req, req.Auth, admin)
+	resp, err := as.ExportMailbox(context.Background(), req)
+	if err != nil || resp.IsError {
+		t.Fatalf("Export failed: %v %v", resp, err)
+	}
+	keys := NewDomainKeyStore(nil)
+	keys.Put("testname", sid)
+	man, msgs, err := ReadExport(bytes.NewReader(resp.Data), keys)
+	if err != nil || len(msgs) != 1 || !bytes.Equal(man.Signer.Ident, sid.Ident) {
+		t.Fatalf("Bad server export: %v %v", man, err)
+	}
+	a, _ := NewArchive(MakeLocalUser(user, userk))
+	if n, err := a.Import(bytes.NewReader(resp.Data), MakeLocalUser(user, userk), keys); err != nil || n != 1 {
+		t.Errorf("Could not import server export: %d %v", n, err)
+	}
+	if _, _, err := ReadExport(bytes.NewReader(resp.Data), nil); err == nil {
+		t.Error("Accepted a server export with no domain key to check it against")
+	}
+
+	// Anyone can make themselves a _server identity on the owner's domain;
+	// only the key the domain publishes may sign for it.
+	fid, fk, _ := makeAnIdentity()
+	fid.Handle, fid.Domain = ServerHandle, "testname"
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, user, msgs, MakeLocalUser(fid, fk)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadExport(bytes.NewReader(buf.Bytes()), keys); err == nil {
+		t.Error("Accepted an export signed by a server key the domain does not publish")
+	}
+}
@@ -0,0 +1,270 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Handle under which every server publishes its domain identity through
+	// Name.
+	ServerHandle = "_server"
+
+	domainHeader    = "gsdp-domain"
+	tstampHeader    = "gsdp-tstamp"
+	signatureHeader = "gsdp-signature-bin"
+
+	domainKeyTTL = 60 * 60
+	// Failed lookups are remembered for this long, so a stream of requests
+	// naming a domain with no key cannot each make us go and ask for one.
+	domainKeyFailTTL = 60
+)
+
+// Methods that only servers call on each other, and which must be signed.
+var federatedMethods = map[string]bool{
+	"/gsdprotocol.GSDP/K":   true,
+	"/gsdprotocol.GSDP/Btw": true,
+}
+
+// Methods that are never signed. Name is how keys are fetched in the first
+// place, so signing it would have servers asking each other for keys forever.
+var unsignedMethods = map[string]bool{
+	"/gsdprotocol.GSDP/Name": true,
+}
+
+// A DomainPolicy decides whether a server on domain may call method. It is
+// only consulted for signed requests.
+type DomainPolicy func(domain string, method string) error
+
+type ctxKey int
+
+const (
+	peerDomainKey ctxKey = iota
+)
+
+type domainKey struct {
+	ident   *pb.Identity
+	err     error
+	fetched int64
+}
+
+// DomainKeys gives the server identities domains publish, which receipts
+// and exports signed by servers are checked against; a *DomainKeyStore will
+// do.
+type DomainKeys interface {
+	Get(domain string) (*pb.Identity, error)
+}
+
+// A DomainKeyStore fetches and caches the domain identities other servers
+// publish through Name.
+type DomainKeyStore struct {
+	keys  map[string]domainKey
+	pool  *ConnectionPool
+	fetch func(string) (*pb.Identity, error)
+	lck   *sync.Mutex
+}
+
+func NewDomainKeyStore(pool *ConnectionPool) *DomainKeyStore {
+	s := &DomainKeyStore{make(map[string]domainKey), pool, nil, &sync.Mutex{}}
+	s.fetch = s.fetchByName
+	return s
+}
+
+func (s *DomainKeyStore) fetchByName(domain string) (*pb.Identity, error) {
+	oconn, err := s.pool.GetConnection(domain)
+	if err != nil {
+		return nil, err
+	}
+	defer s.pool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	res, err := client.Name(context.Background(), &pb.NameInquiry{nil, nil, false, ServerHandle, domain})
+	if err != nil {
+		return nil, err
+	}
+	if res.IsError || res.Name == nil {
+		return nil, errors.New("Domain " + domain + " publishes no server identity")
+	}
+	return res.Name, nil
+}
+
+// Put pins the identity for a domain, e.g. our own.
+func (s *DomainKeyStore) Put(domain string, id *pb.Identity) {
+	s.lck.Lock()
+	s.keys[strings.ToLower(domain)] = domainKey{id, nil, time.Now().Unix()}
+	s.lck.Unlock()
+}
+
+// Get returns the identity domain publishes, fetching it if it is not
+// cached. A failed fetch is not tried again for domainKeyFailTTL.
+func (s *DomainKeyStore) Get(domain string) (*pb.Identity, error) {
+	domain = strings.ToLower(domain)
+	now := time.Now().Unix()
+	s.lck.Lock()
+	k, ok := s.keys[domain]
+	s.lck.Unlock()
+	if ok && k.err == nil && now-k.fetched < domainKeyTTL {
+		return k.ident, nil
+	} else if ok && k.err != nil && now-k.fetched < domainKeyFailTTL {
+		return nil, k.err
+	}
+	id, err := s.fetchChecked(domain)
+	if err != nil {
+		s.lck.Lock()
+		s.keys[domain] = domainKey{nil, err, now}
+		s.lck.Unlock()
+		return nil, err
+	}
+	s.Put(domain, id)
+	return id, nil
+}
+
+func (s *DomainKeyStore) fetchChecked(domain string) (*pb.Identity, error) {
+	id, err := s.fetch(domain)
+	if err != nil {
+		return nil, err
+	}
+	if id.Handle != ServerHandle || strings.ToLower(id.Domain) != domain {
+		return nil, errors.New("Domain " + domain + " published someone else's identity")
+	}
+	if !bytes.Equal(BytesToIdentHash(id.PubKey), id.Ident) {
+		return nil, errors.New("Domain " + domain + " published a bad identity")
+	}
+	return id, nil
+}
+
+// What a server signs for a request: the method, the calling and receiving
+// domains, so a request cannot be replayed to another server, the time and
+// the request itself.
+func federationPayload(method string, domain string, to string, tstamp string, req interface{}) ([]byte, error) {
+	msg, ok := req.(proto.Message)
+	if !ok {
+		return nil, errors.New("Request is not a protobuf message")
+	}
+	bs, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(method+"\n"+strings.ToLower(domain)+"\n"+strings.ToLower(to)+"\n"+tstamp+"\n"), bs...), nil
+}
+
+// The domain a connection was made to; the pool dials domain:port.
+func targetDomain(cc *grpc.ClientConn) string {
+	host, _, err := net.SplitHostPort(cc.Target())
+	if err != nil {
+		return cc.Target()
+	}
+	return host
+}
+
+// DomainSigningInterceptor signs every outgoing request, other than Name,
+// with a server's domain key, for the domain the connection goes to.
+func DomainSigningInterceptor(serverKey *LocalUser, domain string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if unsignedMethods[method] {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		tstamp := strconv.FormatInt(time.Now().Unix(), 10)
+		payload, err := federationPayload(method, domain, targetDomain(cc), tstamp, req)
+		if err != nil {
+			return err
+		}
+		sig, err := SignBytes(serverKey.PrivKey(), payload)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, domainHeader, domain, tstampHeader, tstamp, signatureHeader, string(sig))
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// DomainVerifyingInterceptor checks signed requests from other servers to
+// ours, on domain, and records the calling domain in the context (see
+// PeerDomain). Unsigned requests to federated methods are refused. The
+// policy is applied before the caller's key is fetched, so blocked domains
+// cost nothing.
+func DomainVerifyingInterceptor(keys *DomainKeyStore, policy DomainPolicy, domain string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		domains := md.Get(domainHeader)
+		if len(domains) == 0 || unsignedMethods[info.FullMethod] {
+			if federatedMethods[info.FullMethod] {
+				return nil, errors.New("Unsigned server-to-server request")
+			}
+			return handler(ctx, req)
+		}
+		from := domains[0]
+		tstamps := md.Get(tstampHeader)
+		sigs := md.Get(signatureHeader)
+		if len(tstamps) == 0 || len(sigs) == 0 {
+			return nil, errors.New("Incomplete server signature")
+		}
+		tstamp, err := strconv.ParseInt(tstamps[0], 10, 64)
+		if err != nil || !inAuthWindow(tstamp) {
+			return nil, errors.New("Server request timestamp out of range")
+		}
+		if policy != nil {
+			if err := policy(from, info.FullMethod); err != nil {
+				return nil, err
+			}
+		}
+		id, err := keys.Get(from)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := federationPayload(info.FullMethod, from, domain, tstamps[0], req)
+		if err != nil {
+			return nil, err
+		}
+		if err := VerifyBytes(id, payload, []byte(sigs[0])); err != nil {
+			return nil, errors.New("Bad server signature from " + from)
+		}
+		return handler(context.WithValue(ctx, peerDomainKey, strings.ToLower(from)), req)
+	}
+}
+
+// PeerDomain returns the domain of the server that made a request, if the
+// request was signed by one.
+func PeerDomain(ctx context.Context) (string, bool) {
+	d, ok := ctx.Value(peerDomainKey).(string)
+	return d, ok
+}
+
+// BlockDomainsPolicy refuses every request from the given domains.
+func BlockDomainsPolicy(domains []string) DomainPolicy {
+	blocked := make(map[string]bool)
+	for _, d := range domains {
+		blocked[strings.ToLower(d)] = true
+	}
+	return func(domain string, method string) error {
+		if blocked[strings.ToLower(domain)] {
+			return errors.New("Domain " + domain + " is blocked")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"errors"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"testing"
+)
+
+const (
+	kMethod   = "/gsdprotocol.GSDP/K"
+	ourDomain = "us.com"
+)
+
+// Runs req through the signing interceptor, as sent to the server for to,
+// and returns the context the receiving server would see.
+func signedContext(t *testing.T, key *LocalUser, domain string, to string, req interface{}) context.Context {
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	// Never used to connect; the interceptor only needs its target.
+	cc, err := grpc.Dial(to+":"+default_port, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	if err := DomainSigningInterceptor(key, domain)(context.Background(), kMethod, req, nil, cc, invoker); err != nil {
+		t.Fatal(err)
+	}
+	return metadata.NewIncomingContext(context.Background(), md)
+}
+
+func getMockDomainKeys(t *testing.T) (*LocalUser, *DomainKeyStore) {
+	id, privk, err := makeAnIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id.Handle = ServerHandle
+	keys := NewDomainKeyStore(nil)
+	keys.fetch = func(domain string) (*pb.Identity, error) {
+		if domain == id.Domain {
+			return id, nil
+		}
+		return nil, errors.New("no such domain")
+	}
+	return &LocalUser{id, privk}, keys
+}
+
+func TestSignedServerRequest(t *testing.T) {
+	key, keys := getMockDomainKeys(t)
+	req := &pb.ApprovePermissions{FromIdent: key.identity}
+	var seen string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen, _ = PeerDomain(ctx)
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: kMethod}
+	verify := DomainVerifyingInterceptor(keys, nil, ourDomain)
+	if _, err := verify(signedContext(t, key, key.identity.Domain, ourDomain, req), req, info, handler); err != nil {
+		t.Errorf("Rejected a good signature: %v", err)
+	}
+	if seen != key.identity.Domain {
+		t.Errorf("Peer domain was %q", seen)
+	}
+	ctx := signedContext(t, key, key.identity.Domain, ourDomain, req)
+	tampered := &pb.ApprovePermissions{FromIdent: &pb.Identity{Handle: "someone"}}
+	if _, err := verify(ctx, tampered, info, handler); err == nil {
+		t.Error("Accepted a tampered request")
+	}
+	if _, err := verify(signedContext(t, key, "other.com", ourDomain, req), req, info, handler); err == nil {
+		t.Error("Accepted a signature claiming another domain")
+	}
+	if _, err := verify(signedContext(t, key, key.identity.Domain, "them.com", req), req, info, handler); err == nil {
+		t.Error("Accepted a request signed for another server")
+	}
+	if _, err := verify(context.Background(), req, info, handler); err == nil {
+		t.Error("Accepted an unsigned federated request")
+	}
+	blocked := DomainVerifyingInterceptor(keys, BlockDomainsPolicy([]string{key.identity.Domain}), ourDomain)
+	if _, err := blocked(signedContext(t, key, key.identity.Domain, ourDomain, req), req, info, handler); err == nil {
+		t.Error("Policy did not block domain")
+	}
+}
+
+func TestBlockedAndUnknownDomainsAreNotFetched(t *testing.T) {
+	key, keys := getMockDomainKeys(t)
+	fetches := 0
+	fetch := keys.fetch
+	keys.fetch = func(domain string) (*pb.Identity, error) {
+		fetches++
+		return fetch(domain)
+	}
+	req := &pb.ApprovePermissions{FromIdent: key.identity}
+	info := &grpc.UnaryServerInfo{FullMethod: kMethod}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	blocked := DomainVerifyingInterceptor(keys, BlockDomainsPolicy([]string{"bad.com"}), ourDomain)
+	if _, err := blocked(signedContext(t, key, "bad.com", ourDomain, req), req, info, handler); err == nil {
+		t.Error("Policy did not block domain")
+	}
+	if fetches != 0 {
+		t.Errorf("Fetched a key for a blocked domain")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := blocked(signedContext(t, key, "nokey.com", ourDomain, req), req, info, handler); err == nil {
+			t.Error("Accepted a domain with no key")
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("Fetched a missing key %d times, wanted once", fetches)
+	}
+}
+
+func TestDomainKeyStoreChecksIdentity(t *testing.T) {
+	key, keys := getMockDomainKeys(t)
+	key.identity.Handle = "notaserver"
+	if _, err := keys.Get(key.identity.Domain); err == nil {
+		t.Error("Accepted a non-server identity as a domain key")
+	}
+}
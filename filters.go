@@ -0,0 +1,182 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	maxFilterRules = 1000
+)
+
+// Block and allow rules are kept on a local user's account. A block rule
+// with handle pattern "*" and nothing else blocks everyone, which together
+// with some allow rules makes an allowlist.
+
+func checkFilterRule(r *pb.FilterRule) error {
+	if len(r.Ident) == 0 && len(r.HandlePattern) == 0 && len(r.Domain) == 0 {
+		return errors.New("Rule matches nothing: give an identity, handle pattern or domain")
+	}
+	if _, err := path.Match(r.HandlePattern, ""); err != nil {
+		return errors.New("Bad handle pattern " + r.HandlePattern)
+	}
+	return nil
+}
+
+func ruleMatches(r *pb.FilterRule, from *pb.Identity) bool {
+	if len(r.Ident) > 0 && !bytes.Equal(r.Ident, from.Ident) {
+		return false
+	}
+	if len(r.HandlePattern) > 0 {
+		if ok, _ := path.Match(r.HandlePattern, from.Handle); !ok {
+			return false
+		}
+	}
+	if len(r.Domain) > 0 && strings.ToLower(r.Domain) != strings.ToLower(from.Domain) {
+		return false
+	}
+	return true
+}
+
+// Two rules are the same if they match the same senders the same way.
+func sameRule(a *pb.FilterRule, b *pb.FilterRule) bool {
+	return a.Action == b.Action && bytes.Equal(a.Ident, b.Ident) && a.HandlePattern == b.HandlePattern && strings.ToLower(a.Domain) == strings.ToLower(b.Domain)
+}
+
+// Whether an allow rule may let a sender in. Anyone can claim an identity,
+// so a rule naming one needs the message signed with its key, and a rule
+// naming a handle or domain needs that domain to vouch for the sender.
+func allowApplies(r *pb.FilterRule, verified bool, domainVerified bool) bool {
+	if len(r.Ident) > 0 && !verified {
+		return false
+	}
+	if (len(r.HandlePattern) > 0 || len(r.Domain) > 0) && !domainVerified {
+		return false
+	}
+	return true
+}
+
+// MatchFilters returns the rule that decides what happens to a message from
+// sender, or nil if none does. Allow rules win over block rules, but only
+// for an authenticated sender: verified if the message was signed with the
+// sender's key, and domainVerified if its domain vouches for its handle too.
+func MatchFilters(rules []*pb.FilterRule, from *pb.Identity, verified bool, domainVerified bool) *pb.FilterRule {
+	if from == nil {
+		return nil
+	}
+	var block *pb.FilterRule
+	for _, r := range rules {
+		if !ruleMatches(r, from) {
+			continue
+		}
+		if r.Action == pb.FilterAction_ALLOW {
+			if allowApplies(r, verified, domainVerified) {
+				return r
+			}
+			continue
+		}
+		if block == nil {
+			block = r
+		}
+	}
+	return block
+}
+
+func (s *GSDPServer) filterFor(to *pb.Identity, from *pb.Identity, auth senderAuth) *pb.FilterRule {
+	acct := s.accounts.GetAccount(to.Ident)
+	if acct == nil {
+		return nil
+	}
+	return MatchFilters(acct.Filters, from, auth.verified, auth.domainVerified)
+}
+
+func (s *GSDPServer) Filters(ctx context.Context, in *pb.FilterRequest) (*pb.FilterList, error) {
+	acct, err := s.authenticateLocal(in, in.FromIdent, in.Tstamp, &in.ProofOfIdent)
+	if err != nil {
+		return nil, err
+	}
+	if len(in.Add) == 0 && len(in.Remove) == 0 {
+		return &pb.FilterList{false, "", acct.Filters}, nil
+	}
+	acct = proto.Clone(acct).(*pb.Account)
+	rules := make([]*pb.FilterRule, 0, len(acct.Filters)+len(in.Add))
+	for _, r := range acct.Filters {
+		keep := true
+		for _, rm := range in.Remove {
+			if sameRule(r, rm) {
+				keep = false
+			}
+		}
+		if keep {
+			rules = append(rules, r)
+		}
+	}
+	for _, r := range in.Add {
+		if err := checkFilterRule(r); err != nil {
+			return &pb.FilterList{true, err.Error(), acct.Filters}, nil
+		}
+		replaced := false
+		for i, old := range rules {
+			if sameRule(old, r) {
+				rules[i] = r
+				replaced = true
+			}
+		}
+		if !replaced {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) > maxFilterRules {
+		return &pb.FilterList{true, "too many rules", acct.Filters}, nil
+	}
+	acct.Filters = rules
+	if err := s.accounts.PutAccount(acct); err != nil {
+		return &pb.FilterList{true, err.Error(), nil}, nil
+	}
+	return &pb.FilterList{false, "", rules}, nil
+}
+
+// UpdateFilters adds and removes our block/allow rules on our server and
+// returns the rules now in force. With neither, it just lists them.
+func (c *GSDPClient) UpdateFilters(add []*pb.FilterRule, remove []*pb.FilterRule) ([]*pb.FilterRule, error) {
+	oconn, err := c.getConnection(c.user.identity)
+	if err != nil {
+		return nil, err
+	}
+	defer c.connPool.ReleaseConnection(oconn)
+	client := pb.NewGSDPClient(oconn.conn)
+	req := &pb.FilterRequest{c.user.identity, add, remove, time.Now().Unix(), []byte{}}
+	if err := SignMessage(req, &req.ProofOfIdent, c.user.privKey); err != nil {
+		return nil, err
+	}
+	lst, err := client.Filters(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	if lst.IsError {
+		return lst.Rules, errors.New(lst.Error)
+	}
+	return lst.Rules, nil
+}
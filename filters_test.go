@@ -0,0 +1,111 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func signedFilters(id *pb.Identity, privk []byte, add []*pb.FilterRule, remove []*pb.FilterRule) *pb.FilterRequest {
+	req := &pb.FilterRequest{id, add, remove, time.Now().Unix(), nil}
+	SignMessage(req, &req.ProofOfIdent, privk)
+	return req
+}
+
+func TestMatchFilters(t *testing.T) {
+	alice, _, _ := makeAnIdentity()
+	alice.Handle = "alice"
+	spammer, _, _ := makeAnIdentity()
+	spammer.Handle = "spam42"
+	rules := []*pb.FilterRule{
+		&pb.FilterRule{pb.FilterAction_BLOCK, nil, "", "TestName", true},
+		&pb.FilterRule{pb.FilterAction_ALLOW, alice.Ident, "", "", false},
+	}
+	if r := MatchFilters(rules, alice, true, false); r == nil || r.Action != pb.FilterAction_ALLOW {
+		t.Error("Allow rule did not win over a domain block")
+	}
+	if r := MatchFilters(rules, alice, false, false); r == nil || r.Action != pb.FilterAction_BLOCK {
+		t.Error("Allow rule let in someone merely claiming the identity")
+	}
+	if r := MatchFilters(rules, spammer, true, true); r == nil || r.Action != pb.FilterAction_BLOCK {
+		t.Error("Domain block did not match")
+	}
+	pattern := []*pb.FilterRule{&pb.FilterRule{pb.FilterAction_BLOCK, nil, "spam*", "", false}}
+	if MatchFilters(pattern, alice, true, true) != nil || MatchFilters(pattern, spammer, false, false) == nil {
+		t.Error("Handle pattern matched wrongly")
+	}
+	allowDomain := []*pb.FilterRule{
+		&pb.FilterRule{pb.FilterAction_BLOCK, nil, "*", "", false},
+		&pb.FilterRule{pb.FilterAction_ALLOW, nil, "", "testname", false},
+	}
+	if r := MatchFilters(allowDomain, spammer, true, false); r == nil || r.Action != pb.FilterAction_BLOCK {
+		t.Error("Domain allow rule let in a sender its domain did not vouch for")
+	}
+	if r := MatchFilters(allowDomain, spammer, true, true); r == nil || r.Action != pb.FilterAction_ALLOW {
+		t.Error("Domain allow rule did not let in a vouched-for sender")
+	}
+}
+
+func TestSayEnforcesFilters(t *testing.T) {
+	gs := getMockServer(true)
+	from, fromk, _ := makeAnIdentity()
+	from.Handle = "spam42"
+	to, privk, _ := makeAnIdentity()
+	_, otherk, _ := makeAnIdentity()
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+
+	block := &pb.FilterRule{pb.FilterAction_BLOCK, nil, "spam*", "", false}
+	if _, err := gs.Filters(context.Background(), signedFilters(to, otherk, []*pb.FilterRule{block}, nil)); err == nil {
+		t.Error("Changed filters with someone else's key")
+	}
+	if _, err := gs.Filters(context.Background(), signedFilters(to, privk, []*pb.FilterRule{&pb.FilterRule{}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if lst, _ := gs.Filters(context.Background(), signedFilters(to, privk, nil, nil)); len(lst.Rules) != 0 {
+		t.Error("Accepted a rule that matches nothing")
+	}
+	gs.Filters(context.Background(), signedFilters(to, privk, []*pb.FilterRule{block}, nil))
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); !ack.IsError {
+		t.Error("Blocked sender got through")
+	}
+	silent := &pb.FilterRule{pb.FilterAction_BLOCK, nil, "spam*", "", true}
+	gs.Filters(context.Background(), signedFilters(to, privk, []*pb.FilterRule{silent}, nil))
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); ack.IsError {
+		t.Errorf("Silent block was visible: %s", ack.Error)
+	}
+	if n, _ := gs.mailboxes.Stat(IdentToString(to.Ident)); n != 0 {
+		t.Errorf("%d blocked messages delivered", n)
+	}
+	gs.Filters(context.Background(), signedFilters(to, privk, nil, []*pb.FilterRule{block}))
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); ack.IsError {
+		t.Errorf("Unblocked sender rejected: %s", ack.Error)
+	}
+
+	everyone := &pb.FilterRule{pb.FilterAction_BLOCK, nil, "*", "", false}
+	allow := &pb.FilterRule{pb.FilterAction_ALLOW, from.Ident, "", "", false}
+	gs.Filters(context.Background(), signedFilters(to, privk, []*pb.FilterRule{everyone, allow}, nil))
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); !ack.IsError {
+		t.Error("Unsigned message got in by claiming an allowed identity")
+	}
+	if ack, _ := gs.Say(context.Background(), makeSignedMessage(from, fromk, to)); ack.IsError {
+		t.Errorf("Allowed sender rejected: %s", ack.Error)
+	}
+}
@@ -0,0 +1,171 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	identsBucket = []byte("idents")
+	namesBucket  = []byte("names")
+)
+
+// A BoltIdentStore keeps identities in a single bolt database file, with
+// buckets indexing them by ident and by handle and domain.
+type BoltIdentStore struct {
+	db *bolt.DB
+}
+
+func MakeBoltIdentStore(path string) (*BoltIdentStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(identsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(namesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltIdentStore{db}, nil
+}
+
+func (s *BoltIdentStore) Close() error {
+	return s.db.Close()
+}
+
+func getIdentityTx(tx *bolt.Tx, ident []byte) *pb.Identity {
+	bs := tx.Bucket(identsBucket).Get(ident)
+	if bs == nil {
+		return nil
+	}
+	id := &pb.Identity{}
+	if err := proto.Unmarshal(bs, id); err != nil {
+		return nil
+	}
+	return id
+}
+
+// Deletes the name id had, unless it has since been taken by another ident.
+func deleteNameTx(tx *bolt.Tx, id *pb.Identity) error {
+	k := []byte(nameKey(id.Handle, id.Domain))
+	if !bytes.Equal(tx.Bucket(namesBucket).Get(k), id.Ident) {
+		return nil
+	}
+	return tx.Bucket(namesBucket).Delete(k)
+}
+
+// Names are never taken from the ident that has them, as in the in-memory
+// store.
+func putIdentityTx(tx *bolt.Tx, id *pb.Identity) error {
+	if err := checkName(id.Handle, id.Domain); err != nil {
+		return err
+	}
+	if k := tx.Bucket(namesBucket).Get([]byte(nameKey(id.Handle, id.Domain))); k != nil && !bytes.Equal(k, id.Ident) {
+		return errors.New("Name " + nameKey(id.Handle, id.Domain) + " belongs to another identity")
+	}
+	bs, err := proto.Marshal(id)
+	if err != nil {
+		return err
+	}
+	if old := getIdentityTx(tx, id.Ident); old != nil {
+		if err := deleteNameTx(tx, old); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(identsBucket).Put(id.Ident, bs); err != nil {
+		return err
+	}
+	return tx.Bucket(namesBucket).Put([]byte(nameKey(id.Handle, id.Domain)), id.Ident)
+}
+
+func (s *BoltIdentStore) GetIdentityForHandleDomain(handle string, domain string) *pb.Identity {
+	var id *pb.Identity
+	s.db.View(func(tx *bolt.Tx) error {
+		ident := tx.Bucket(namesBucket).Get([]byte(nameKey(handle, domain)))
+		if ident != nil {
+			id = getIdentityTx(tx, ident)
+		}
+		return nil
+	})
+	return id
+}
+
+func (s *BoltIdentStore) GetIdentityForIdent(ident []byte) *pb.Identity {
+	var id *pb.Identity
+	s.db.View(func(tx *bolt.Tx) error {
+		id = getIdentityTx(tx, ident)
+		return nil
+	})
+	return id
+}
+
+func (s *BoltIdentStore) AddIdentity(id *pb.Identity) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if old := getIdentityTx(tx, id.Ident); old != nil && proto.Equal(old, id) {
+			return nil
+		}
+		return putIdentityTx(tx, id)
+	})
+}
+
+func (s *BoltIdentStore) UpdateIdentity(id *pb.Identity) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if getIdentityTx(tx, id.Ident) == nil {
+			return errors.New("No such identity")
+		}
+		return putIdentityTx(tx, id)
+	})
+}
+
+func (s *BoltIdentStore) RemoveIdentity(ident []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		old := getIdentityTx(tx, ident)
+		if old == nil {
+			return errors.New("No such identity")
+		}
+		if err := deleteNameTx(tx, old); err != nil {
+			return err
+		}
+		return tx.Bucket(identsBucket).Delete(ident)
+	})
+}
+
+func (s *BoltIdentStore) ListIdentities() []*pb.Identity {
+	ids := make([]*pb.Identity, 0)
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(identsBucket).ForEach(func(k []byte, v []byte) error {
+			id := &pb.Identity{}
+			if err := proto.Unmarshal(v, id); err == nil {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	return ids
+}
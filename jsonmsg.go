@@ -0,0 +1,146 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+)
+
+// A JSONIdent is an identity as it appears in JSON, with its ident in
+// base64.
+type JSONIdent struct {
+	Handle string `json:"handle"`
+	Domain string `json:"domain"`
+	Ident  string `json:"ident,omitempty"`
+}
+
+// A JSONMessage is a decrypted message for programs that speak JSON rather
+// than protobuf. Recipients are handle\domain strings, ids are base64, and
+// Payload holds the structured content of types that have one, with
+// protobuf field names.
+type JSONMessage struct {
+	MsgId      string          `json:"msg_id,omitempty"`
+	From       *JSONIdent      `json:"from,omitempty"`
+	To         []string        `json:"to,omitempty"`
+	Type       string          `json:"type"`
+	Tstamp     int64           `json:"tstamp,omitempty"`
+	Received   int64           `json:"received_utc,omitempty"`
+	Text       string          `json:"text,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	ReMsgId    string          `json:"re_msg_id,omitempty"`
+	BlockId    string          `json:"block_id,omitempty"`
+	Tags       []string        `json:"tags,omitempty"`
+	ExpiresUtc int64           `json:"expires_utc,omitempty"`
+}
+
+func MakeJSONIdent(id *pb.Identity) *JSONIdent {
+	if id == nil {
+		return nil
+	}
+	return &JSONIdent{id.Handle, id.Domain, IdentToString(id.Ident)}
+}
+
+func encodeId(bs []byte) string {
+	if len(bs) == 0 {
+		return ""
+	}
+	return IdentToString(bs)
+}
+
+func payloadJSON(p proto.Message) (json.RawMessage, error) {
+	m := jsonpb.Marshaler{OrigName: true}
+	s, err := m.MarshalToString(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(s), nil
+}
+
+// MakeJSONMessage converts a message and its plaintext to JSON. Receipts
+// are not encrypted, so their plaintext is ignored; they are only parsed,
+// not checked against the message they are for (see OpenReceipt).
+func MakeJSONMessage(msg *pb.RawMessage, plaintext []byte) (*JSONMessage, error) {
+	j := &JSONMessage{
+		MsgId:      encodeId(msg.MsgId),
+		From:       MakeJSONIdent(msg.FromIdent),
+		Type:       msg.MsgType.String(),
+		Tstamp:     msg.Tstamp,
+		Received:   msg.ReceivedUtc,
+		ReMsgId:    encodeId(msg.ReMsgId),
+		BlockId:    encodeId(msg.BlockId),
+		Tags:       msg.Tags,
+		ExpiresUtc: msg.ExpiresUtc,
+	}
+	for _, to := range msg.ToIdent {
+		j.To = append(j.To, to.Handle+"\\"+to.Domain)
+	}
+	var p proto.Message
+	var err error
+	if msg.MsgType == pb.MessageType_RECEIPT {
+		p, err = ParseReceipt(msg)
+	} else {
+		j.Text = PayloadText(msg.MsgType, plaintext)
+		p, err = OpenPayload(msg.MsgType, plaintext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		if j.Payload, err = payloadJSON(p); err != nil {
+			return nil, err
+		}
+	}
+	return j, nil
+}
+
+// MessageType parses the message's type, which is PLAIN if not given.
+func (j *JSONMessage) MessageType() (pb.MessageType, error) {
+	if len(j.Type) == 0 {
+		return pb.MessageType_PLAIN, nil
+	}
+	v, ok := pb.MessageType_value[strings.ToUpper(j.Type)]
+	if !ok {
+		return 0, errors.New("Unknown message type " + j.Type)
+	}
+	return pb.MessageType(v), nil
+}
+
+// Content returns what is to be encrypted for the message: the marshaled
+// payload for structured types, and the text otherwise.
+func (j *JSONMessage) Content() ([]byte, error) {
+	kind, err := j.MessageType()
+	if err != nil {
+		return nil, err
+	}
+	p := newPayload(kind)
+	if p == nil {
+		return []byte(j.Text), nil
+	}
+	if len(j.Payload) == 0 {
+		return nil, errors.New("A " + kind.String() + " message needs a payload")
+	}
+	if err := jsonpb.Unmarshal(bytes.NewReader(j.Payload), p); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(p)
+}
@@ -0,0 +1,79 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"encoding/json"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"testing"
+)
+
+func TestJSONMessageRoundTrip(t *testing.T) {
+	from, _ := NewIdentity("Alice", "alice", "testname", "")
+	to, _ := NewIdentity("Bob", "bob", "testname", "")
+	task := &pb.TaskAssign{"Build broke", 100, "main is red", 0, 3, nil, 0, []string{"ci"}}
+	pt, err := proto.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &pb.RawMessage{from, []*pb.Identity{to}, nil, pb.MessageType_TASK_ASSIGN, nil, NewMsgId(), nil, 100, nil, nil, nil, 7, 105, false, 0, nil, []string{"ci"}}
+	j, err := MakeJSONMessage(msg, pt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Type != "TASK_ASSIGN" || j.From.Handle != "alice" || j.Received != 105 || len(j.To) != 1 || j.To[0] != "bob\\testname" {
+		t.Fatalf("Bad message fields: %+v", j)
+	}
+	if !strings.Contains(string(j.Payload), `"project_tags"`) {
+		t.Errorf("Payload should use protobuf field names: %s", j.Payload)
+	}
+
+	// What is printed can be read back and sent again unchanged.
+	bs, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := &JSONMessage{}
+	if err := json.Unmarshal(bs, back); err != nil {
+		t.Fatal(err)
+	}
+	content, err := back.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := &pb.TaskAssign{}
+	if err := proto.Unmarshal(content, got); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, task) {
+		t.Errorf("Got %v, want %v", got, task)
+	}
+}
+
+func TestJSONMessagePlain(t *testing.T) {
+	from, _ := NewIdentity("Alice", "alice", "testname", "")
+	msg := &pb.RawMessage{from, nil, nil, pb.MessageType_PLAIN, nil, NewMsgId(), nil, 100, nil, nil, nil, 0, 0, false, 0, nil, nil}
+	j, err := MakeJSONMessage(msg, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Text != "hello" || j.Payload != nil {
+		t.Errorf("Plain message should only have text: %+v", j)
+	}
+}
@@ -17,30 +17,42 @@
 package gsdp
 
 import (
+	"errors"
+	"github.com/golang/protobuf/proto"
 	pb "github.com/jwvictor/gsdprotocol"
 	"io/ioutil"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 type IdentityStore interface {
 	GetIdentityForHandleDomain(string, string) *pb.Identity
+	GetIdentityForIdent([]byte) *pb.Identity
 	AddIdentity(*pb.Identity) error
+	UpdateIdentity(*pb.Identity) error
+	RemoveIdentity([]byte) error
+	ListIdentities() []*pb.Identity
 }
 
 type PrivateKeyStore interface {
 	GetKeyFor([]byte) *[]byte
 }
 
+// An InMemoryIdentStore indexes identities by ident and by handle and
+// domain. If SrcPath is set, each identity is also kept as a .ident file.
 type InMemoryIdentStore struct {
-	Idents  []*pb.Identity
+	byIdent map[string]*pb.Identity
+	byName  map[string]string
 	SrcPath string
 	lck     *sync.Mutex
 }
 
 type FilePrivateKeyStore struct {
-	Idents []LocalUser
-	lck    *sync.Mutex
+	Idents  []LocalUser
+	SrcPath string
+	lck     *sync.Mutex
 }
 
 type SingleKeyStore struct {
@@ -48,7 +60,7 @@ type SingleKeyStore struct {
 	PrivateKey []byte
 }
 
-func MakeFilePrivateKeyStore(path string) *FilePrivateKeyStore {
+func loadPrivateKeys(path string) []LocalUser {
 	ids := make([]LocalUser, 0)
 	files, _ := ioutil.ReadDir(path)
 	for _, f := range files {
@@ -61,8 +73,25 @@ func MakeFilePrivateKeyStore(path string) *FilePrivateKeyStore {
 			}
 		}
 	}
+	return ids
+}
+
+func MakeFilePrivateKeyStore(path string) *FilePrivateKeyStore {
 	m := &sync.Mutex{}
-	return &FilePrivateKeyStore{ids, m}
+	return &FilePrivateKeyStore{loadPrivateKeys(path), path, m}
+}
+
+// Reload rereads the key directory and swaps in the new set of keys.
+func (s *FilePrivateKeyStore) Reload() error {
+	ids := loadPrivateKeys(s.SrcPath)
+	s.lck.Lock()
+	s.Idents = ids
+	s.lck.Unlock()
+	return nil
+}
+
+func (s *FilePrivateKeyStore) Watch(pollFreq time.Duration) *DirWatcher {
+	return WatchDir(s.SrcPath, ".priv", pollFreq, s.Reload)
 }
 
 func SameBytes(x []byte, y []byte) bool {
@@ -83,32 +112,187 @@ func (s *SingleKeyStore) GetKeyFor(bs []byte) *[]byte {
 	}
 }
 
+// Handles and domains come from peers, and end up in index keys and file
+// names: they must not be able to collide there or leave the directory.
+// With no "__" in a handle, nor a trailing "_", and no "_" in a domain, the
+// "__" between them in a file name is the only one there is.
+func checkName(handle string, domain string) error {
+	if strings.ContainsAny(handle, "\\/\x00") || strings.Contains(handle, "__") || strings.HasSuffix(handle, "_") {
+		return errors.New("Bad handle " + handle)
+	}
+	if strings.ContainsAny(domain, "\\/\x00_") {
+		return errors.New("Bad domain " + domain)
+	}
+	return nil
+}
+
+// Key for the by-name index. Handles are case sensitive, domains are not.
+func nameKey(handle string, domain string) string {
+	return handle + "\\" + strings.ToLower(domain)
+}
+
+func identFileBase(id *pb.Identity) string {
+	return id.Handle + "__" + id.Domain
+}
+
+func NewInMemoryIdentStore() *InMemoryIdentStore {
+	m := &sync.Mutex{}
+	return &InMemoryIdentStore{make(map[string]*pb.Identity), make(map[string]string), "", m}
+}
+
 func MakeInMemoryIdentStoreFromFiles(path string) *InMemoryIdentStore {
-	ids := make([]*pb.Identity, 0)
-	files, _ := ioutil.ReadDir(path)
+	s := NewInMemoryIdentStore()
+	s.SrcPath = path
+	s.Reload()
+	return s
+}
+
+// Reload rereads the identity directory and swaps in the new indexes, so
+// lookups see either the old or the new set of identities, never a mix.
+func (s *InMemoryIdentStore) Reload() error {
+	fresh := NewInMemoryIdentStore()
+	files, err := ioutil.ReadDir(s.SrcPath)
+	if err != nil {
+		return err
+	}
 	for _, f := range files {
 		fn := f.Name()
 		if strings.HasSuffix(fn, ".ident") {
-			pfn := path + "/" + fn[:len(fn)-6]
+			pfn := s.SrcPath + "/" + fn[:len(fn)-6]
 			newid, err := LoadPublicIdentity(pfn)
-			if err == nil {
-				ids = append(ids, newid)
+			if err == nil && checkName(newid.Handle, newid.Domain) == nil {
+				fresh.putNotThreadSafe(newid)
 			}
 		}
 	}
-	m := &sync.Mutex{}
-	return &InMemoryIdentStore{ids, path, m}
+	s.lck.Lock()
+	s.byIdent = fresh.byIdent
+	s.byName = fresh.byName
+	s.lck.Unlock()
+	return nil
+}
+
+func (s *InMemoryIdentStore) Watch(pollFreq time.Duration) *DirWatcher {
+	return WatchDir(s.SrcPath, ".ident", pollFreq, s.Reload)
+}
+
+// Whether id still has its name, rather than another ident having taken it.
+// Its file is then also still its own.
+func (s *InMemoryIdentStore) ownsNameNotThreadSafe(id *pb.Identity) bool {
+	return s.byName[nameKey(id.Handle, id.Domain)] == IdentToString(id.Ident)
 }
 
+func (s *InMemoryIdentStore) putNotThreadSafe(id *pb.Identity) {
+	k := IdentToString(id.Ident)
+	if old, ok := s.byIdent[k]; ok && s.ownsNameNotThreadSafe(old) {
+		delete(s.byName, nameKey(old.Handle, old.Domain))
+	}
+	s.byIdent[k] = id
+	s.byName[nameKey(id.Handle, id.Domain)] = k
+}
+
+// AddIdentity adds or replaces an identity. Adding an identity that is
+// already known with the same contents is a no-op.
 func (s *InMemoryIdentStore) AddIdentity(id *pb.Identity) error {
 	s.lck.Lock()
-	s.Idents = append(s.Idents, id)
-	idPath := s.SrcPath + "/" + id.Handle + "__" + id.Domain
-	SaveIdentity(id, nil, idPath)
-	s.lck.Unlock()
+	defer s.lck.Unlock()
+	old, ok := s.byIdent[IdentToString(id.Ident)]
+	if ok && proto.Equal(old, id) {
+		return nil
+	}
+	return s.saveNotThreadSafe(old, id)
+}
+
+func (s *InMemoryIdentStore) UpdateIdentity(id *pb.Identity) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	old, ok := s.byIdent[IdentToString(id.Ident)]
+	if !ok {
+		return errors.New("No such identity")
+	}
+	return s.saveNotThreadSafe(old, id)
+}
+
+// A name stays with the ident it was first given to until that ident is
+// removed, so nobody can take over a name by presenting a new key for it.
+func (s *InMemoryIdentStore) saveNotThreadSafe(old *pb.Identity, id *pb.Identity) error {
+	if err := checkName(id.Handle, id.Domain); err != nil {
+		return err
+	}
+	if k, ok := s.byName[nameKey(id.Handle, id.Domain)]; ok && k != IdentToString(id.Ident) {
+		return errors.New("Name " + nameKey(id.Handle, id.Domain) + " belongs to another identity")
+	}
+	if len(s.SrcPath) > 0 {
+		if old != nil && identFileBase(old) != identFileBase(id) && s.ownsNameNotThreadSafe(old) {
+			os.Remove(s.SrcPath + "/" + identFileBase(old) + ".ident")
+		}
+		if err := SaveIdentity(id, nil, s.SrcPath+"/"+identFileBase(id)); err != nil {
+			return err
+		}
+	}
+	s.putNotThreadSafe(id)
+	return nil
+}
+
+func (s *InMemoryIdentStore) RemoveIdentity(ident []byte) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	k := IdentToString(ident)
+	old, ok := s.byIdent[k]
+	if !ok {
+		return errors.New("No such identity")
+	}
+	delete(s.byIdent, k)
+	if s.ownsNameNotThreadSafe(old) {
+		delete(s.byName, nameKey(old.Handle, old.Domain))
+		if len(s.SrcPath) > 0 {
+			os.Remove(s.SrcPath + "/" + identFileBase(old) + ".ident")
+		}
+	}
 	return nil
 }
 
+func (s *InMemoryIdentStore) ListIdentities() []*pb.Identity {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	ids := make([]*pb.Identity, 0, len(s.byIdent))
+	for _, v := range s.byIdent {
+		ids = append(ids, v)
+	}
+	return ids
+}
+
+func (s *InMemoryIdentStore) GetIdentityForIdent(ident []byte) *pb.Identity {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.byIdent[IdentToString(ident)]
+}
+
+// CopyIdentities adds every identity in src to dst.
+func CopyIdentities(dst IdentityStore, src IdentityStore) error {
+	for _, id := range src.ListIdentities() {
+		if err := dst.AddIdentity(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncIdentities brings dst up to date with a source that held before and
+// now holds after: what was in before but is gone from after is removed, and
+// then everything in after is added, so a name given a new key in the source
+// moves to it. Identities dst got from elsewhere are left alone.
+func SyncIdentities(dst IdentityStore, before IdentityStore, after IdentityStore) error {
+	for _, id := range before.ListIdentities() {
+		if after.GetIdentityForIdent(id.Ident) == nil && dst.GetIdentityForIdent(id.Ident) != nil {
+			if err := dst.RemoveIdentity(id.Ident); err != nil {
+				return err
+			}
+		}
+	}
+	return CopyIdentities(dst, after)
+}
+
 func (s *FilePrivateKeyStore) GetKeyFor(bs []byte) *[]byte {
 	s.lck.Lock()
 	for _, v := range s.Idents {
@@ -124,12 +308,9 @@ func (s *FilePrivateKeyStore) GetKeyFor(bs []byte) *[]byte {
 
 func (s *InMemoryIdentStore) GetIdentityForHandleDomain(handle string, domain string) *pb.Identity {
 	s.lck.Lock()
-	for _, v := range s.Idents {
-		if v.Handle == handle && strings.ToLower(v.Domain) == strings.ToLower(domain) {
-			s.lck.Unlock()
-			return v
-		}
+	defer s.lck.Unlock()
+	if k, ok := s.byName[nameKey(handle, domain)]; ok {
+		return s.byIdent[k]
 	}
-	s.lck.Unlock()
 	return nil
 }
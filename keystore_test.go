@@ -0,0 +1,179 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func checkIdentityStore(t *testing.T, s IdentityStore) {
+	id, _, _ := makeAnIdentity()
+	s.AddIdentity(id)
+	s.AddIdentity(id)
+	if len(s.ListIdentities()) != 1 {
+		t.Error("Adding the same identity twice should not duplicate it")
+	}
+	if got := s.GetIdentityForHandleDomain(id.Handle, "TestName"); got == nil || !SameBytes(got.Ident, id.Ident) {
+		t.Error("Lookup by handle and domain failed")
+	}
+	if got := s.GetIdentityForIdent(id.Ident); got == nil || got.Handle != id.Handle {
+		t.Error("Lookup by ident failed")
+	}
+	moved := proto.Clone(id).(*pb.Identity)
+	moved.Domain = "elsewhere.com"
+	if err := s.UpdateIdentity(moved); err != nil {
+		t.Error("Update failed")
+	}
+	if s.GetIdentityForHandleDomain(id.Handle, id.Domain) != nil {
+		t.Error("Old name still resolves after update")
+	}
+	if s.GetIdentityForHandleDomain(id.Handle, "elsewhere.com") == nil {
+		t.Error("New name does not resolve after update")
+	}
+	if err := s.RemoveIdentity(id.Ident); err != nil {
+		t.Error("Remove failed")
+	}
+	if s.GetIdentityForIdent(id.Ident) != nil || len(s.ListIdentities()) != 0 {
+		t.Error("Identity still present after remove")
+	}
+	if s.UpdateIdentity(id) == nil {
+		t.Error("Updated an unknown identity")
+	}
+
+	// A name stays with its key: a new key cannot take it over.
+	newer, _, _ := makeAnIdentity()
+	s.AddIdentity(id)
+	if s.AddIdentity(newer) == nil {
+		t.Error("A new key took over a name")
+	}
+	if got := s.GetIdentityForHandleDomain(id.Handle, id.Domain); got == nil || !SameBytes(got.Ident, id.Ident) {
+		t.Error("Name moved to a new key")
+	}
+	renamed := proto.Clone(newer).(*pb.Identity)
+	renamed.Handle = "renamed"
+	s.AddIdentity(renamed)
+	renamed.Handle = id.Handle
+	if s.UpdateIdentity(renamed) == nil {
+		t.Error("Renamed a key to a name that is taken")
+	}
+	// Once the old key is gone the name is free again.
+	s.RemoveIdentity(id.Ident)
+	if err := s.AddIdentity(newer); err != nil {
+		t.Errorf("Name not freed by removing its key: %v", err)
+	}
+
+	// Names that could pass for others in a key or file name, or lead out
+	// of the directory.
+	for _, n := range [][2]string{{"a\\b", "c"}, {"a", "b__c"}, {"a__b", "c"}, {"a_", "_b"}, {"../x", "c"}, {"a", "../../etc"}} {
+		bad, _, _ := makeAnIdentity()
+		bad.Handle, bad.Domain = n[0], n[1]
+		if s.AddIdentity(bad) == nil {
+			t.Errorf("Took handle %q and domain %q", n[0], n[1])
+		}
+	}
+	if len(s.ListIdentities()) != 1 {
+		t.Error("Kept an identity with a bad name")
+	}
+}
+
+func TestInMemoryIdentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkIdentityStore(t, MakeInMemoryIdentStoreFromFiles(dir))
+}
+
+func TestBoltIdentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := MakeBoltIdentStore(dir + "/idents.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	checkIdentityStore(t, s)
+}
+
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 50 && !cond(); i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	return cond()
+}
+
+func TestIdentStoreWatchesDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ids := MakeInMemoryIdentStoreFromFiles(dir)
+	keys := MakeFilePrivateKeyStore(dir)
+	w1 := ids.Watch(time.Millisecond * 100)
+	defer w1.Stop()
+	w2 := keys.Watch(time.Millisecond * 100)
+	defer w2.Stop()
+	id, privk, _ := makeAnIdentity()
+	SaveIdentity(id, privk, dir+"/"+id.Handle+"__"+id.Domain)
+	if !waitFor(func() bool { return ids.GetIdentityForIdent(id.Ident) != nil }) {
+		t.Error("Added identity was not picked up")
+	}
+	if !waitFor(func() bool { return keys.GetKeyFor(id.Ident) != nil }) {
+		t.Error("Added private key was not picked up")
+	}
+	os.Remove(dir + "/" + id.Handle + "__" + id.Domain + ".priv")
+	os.Remove(dir + "/" + id.Handle + "__" + id.Domain + ".ident")
+	if !waitFor(func() bool { return ids.GetIdentityForIdent(id.Ident) == nil }) {
+		t.Error("Removed identity is still present")
+	}
+	if !waitFor(func() bool { return keys.GetKeyFor(id.Ident) == nil }) {
+		t.Error("Removed private key is still present")
+	}
+}
+
+func TestSyncIdentitiesRemovesWhatIsGone(t *testing.T) {
+	kept, _, _ := makeAnIdentity()
+	gone, _, _ := makeAnIdentity()
+	gone.Handle = "gone"
+	other, _, _ := makeAnIdentity()
+	other.Handle = "other"
+	before, after, dst := NewInMemoryIdentStore(), NewInMemoryIdentStore(), NewInMemoryIdentStore()
+	before.AddIdentity(kept)
+	before.AddIdentity(gone)
+	after.AddIdentity(kept)
+	CopyIdentities(dst, before)
+	dst.AddIdentity(other)
+	if err := SyncIdentities(dst, before, after); err != nil {
+		t.Fatal(err)
+	}
+	if dst.GetIdentityForIdent(gone.Ident) != nil {
+		t.Error("Identity gone from the source was kept")
+	}
+	if dst.GetIdentityForIdent(kept.Ident) == nil || dst.GetIdentityForIdent(other.Ident) == nil {
+		t.Error("Sync removed identities still in use")
+	}
+}
@@ -0,0 +1,155 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"container/list"
+	pb "github.com/jwvictor/gsdprotocol"
+	"sync"
+	"time"
+)
+
+const (
+	// Once a limiter tracks this many keys, the least recently used one is
+	// dropped for each new one.
+	maxBuckets = 10000
+)
+
+// A RateLimit allows Rate events per second on average, in bursts of up to
+// Burst. A zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// UserLimits override the server-wide limits for one user. Zero values fall
+// back to the server-wide ones.
+type UserLimits struct {
+	SenderRate  RateLimit
+	MaxMessages int64
+	MaxBytes    int64
+}
+
+// Limits are the rate limits and mailbox quotas a server enforces. Users are
+// keyed by handle\domain. Quotas set by an admin on an account take
+// precedence over these.
+type Limits struct {
+	SenderRate  RateLimit
+	DomainRate  RateLimit
+	MaxMessages int64
+	MaxBytes    int64
+	Users       map[string]UserLimits
+}
+
+type tokenBucket struct {
+	key    string
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// A RateLimiter keeps one token bucket per key, for at most max keys. The
+// least recently used bucket is the one dropped, which has usually long
+// refilled, so that forgetting it lets nobody off.
+type RateLimiter struct {
+	buckets map[string]*list.Element
+	order   *list.List // Of *tokenBucket, most recently used first
+	max     int
+	lck     *sync.Mutex
+}
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{make(map[string]*list.Element), list.New(), maxBuckets, &sync.Mutex{}}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > float64(b.limit.Burst) {
+		b.tokens = float64(b.limit.Burst)
+	}
+	b.last = now
+}
+
+// Allow takes a token from the bucket for key, if there is one. The bucket
+// keeps l as its limit from then on.
+func (r *RateLimiter) Allow(key string, l RateLimit) bool {
+	if l.Rate <= 0 {
+		return true
+	}
+	if l.Burst < 1 {
+		l.Burst = 1
+	}
+	now := time.Now()
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	var b *tokenBucket
+	if e, ok := r.buckets[key]; ok {
+		r.order.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+		b.refill(now)
+		b.limit = l
+		if b.tokens > float64(l.Burst) {
+			b.tokens = float64(l.Burst)
+		}
+	} else {
+		for r.order.Len() >= r.max {
+			r.evictNotThreadSafe()
+		}
+		b = &tokenBucket{key, l, float64(l.Burst), now}
+		r.buckets[key] = r.order.PushFront(b)
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+func (r *RateLimiter) evictNotThreadSafe() {
+	e := r.order.Back()
+	r.order.Remove(e)
+	delete(r.buckets, e.Value.(*tokenBucket).key)
+}
+
+func (l *Limits) forUser(handle string, domain string) UserLimits {
+	u := UserLimits{l.SenderRate, l.MaxMessages, l.MaxBytes}
+	if o, ok := l.Users[nameKey(handle, domain)]; ok {
+		if o.SenderRate.Rate > 0 {
+			u.SenderRate = o.SenderRate
+		}
+		if o.MaxMessages > 0 {
+			u.MaxMessages = o.MaxMessages
+		}
+		if o.MaxBytes > 0 {
+			u.MaxBytes = o.MaxBytes
+		}
+	}
+	return u
+}
+
+// Quota for a local user's mailbox: the account's own if an admin set one,
+// otherwise the configured limits.
+func (l *Limits) quotaFor(id *pb.Identity, acct *pb.Account) (int64, int64) {
+	u := l.forUser(id.Handle, id.Domain)
+	if acct != nil && acct.MaxMessages > 0 {
+		u.MaxMessages = acct.MaxMessages
+	}
+	if acct != nil && acct.MaxBytes > 0 {
+		u.MaxBytes = acct.MaxBytes
+	}
+	return u.MaxMessages, u.MaxBytes
+}
@@ -0,0 +1,159 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurst(t *testing.T) {
+	r := NewRateLimiter()
+	l := RateLimit{1, 3}
+	for i := 0; i < 3; i++ {
+		if !r.Allow("a", l) {
+			t.Errorf("Denied request %d within burst", i)
+		}
+	}
+	if r.Allow("a", l) {
+		t.Error("Allowed request beyond burst")
+	}
+	if !r.Allow("b", l) {
+		t.Error("Buckets are not separate per key")
+	}
+	if !r.Allow("a", RateLimit{}) {
+		t.Error("Zero rate should be unlimited")
+	}
+}
+
+func TestRateLimiterForgetsLeastRecentlyUsed(t *testing.T) {
+	r := NewRateLimiter()
+	r.max = 3
+	l := RateLimit{0.001, 1}
+	for _, k := range []string{"a", "b", "c"} {
+		r.Allow(k, l)
+	}
+	// Using a keeps its bucket, so b is the one to go.
+	if r.Allow("a", l) {
+		t.Error("Allowed request beyond burst")
+	}
+	r.Allow("d", l)
+	if len(r.buckets) != 3 || r.order.Len() != 3 {
+		t.Errorf("Tracking %d keys, wanted 3", len(r.buckets))
+	}
+	if _, ok := r.buckets["b"]; ok {
+		t.Error("Kept a bucket that was not the least recently used")
+	}
+	if r.Allow("a", l) {
+		t.Error("Bucket in use was dropped")
+	}
+	if !r.Allow("b", l) {
+		t.Error("Dropped bucket was not started afresh")
+	}
+}
+
+func makeMockMessage(from *pb.Identity, to *pb.Identity) *pb.RawMessage {
+	nothin := []byte{}
+	return &pb.RawMessage{from, []*pb.Identity{to}, nothin, pb.MessageType_PLAIN, []byte("hi"), NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+}
+
+func TestSayEnforcesLimits(t *testing.T) {
+	from, _, _ := makeAnIdentity()
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{
+		Identities: NewInMemoryIdentStore(),
+		Limits: Limits{
+			SenderRate:  RateLimit{0.001, 2},
+			MaxMessages: 100,
+			Users:       map[string]UserLimits{nameKey(to.Handle, to.Domain): UserLimits{MaxMessages: 1}},
+		},
+	})
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); ack.IsError {
+		t.Errorf("First message rejected: %s", ack.Error)
+	}
+	ack, _ := gs.Say(context.Background(), makeMockMessage(from, to))
+	if !ack.IsError || !strings.Contains(ack.Error, "mailbox full") {
+		t.Errorf("Per-user quota not enforced: %v", ack)
+	}
+	ack, _ = gs.Say(context.Background(), makeMockMessage(from, to))
+	if !ack.IsError || !strings.Contains(ack.Error, "rate limit") {
+		t.Errorf("Sender rate limit not enforced: %v", ack)
+	}
+}
+
+func makeSignedMessage(from *pb.Identity, privk []byte, to *pb.Identity) *pb.RawMessage {
+	msg := makeMockMessage(from, to)
+	SignRawMessage(msg, privk)
+	return msg
+}
+
+func TestRateLimitsNeedVerifiedSenders(t *testing.T) {
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{
+		Identities: NewInMemoryIdentStore(),
+		Limits:     Limits{SenderRate: RateLimit{0.001, 1}, DomainRate: RateLimit{0.001, 2}},
+	})
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+
+	// Unsigned messages share a bucket however often the sender changes
+	// identity, and never touch the bucket of the domain they name.
+	for i := 0; i < 2; i++ {
+		from, _, _ := makeAnIdentity()
+		from.Domain = "victim.com"
+		ack, _ := gs.Say(context.Background(), makeMockMessage(from, to))
+		if i == 0 && ack.IsError {
+			t.Fatalf("First message rejected: %s", ack.Error)
+		}
+		if i == 1 && (!ack.IsError || !strings.Contains(ack.Error, "rate limit")) {
+			t.Errorf("Rotating identities got around the sender limit: %v", ack)
+		}
+	}
+	if !gs.domainLimiter.Allow("victim.com", gs.limits.DomainRate) {
+		t.Error("Unsigned messages were charged to the domain they named")
+	}
+
+	// Signed senders get their own bucket, but their domain is unverified,
+	// so they still share the address's domain bucket.
+	a, ak, _ := makeAnIdentity()
+	if ack, _ := gs.Say(context.Background(), makeSignedMessage(a, ak, to)); ack.IsError {
+		t.Errorf("Verified sender shared the unsigned bucket: %s", ack.Error)
+	}
+	b, bk, _ := makeAnIdentity()
+	if ack, _ := gs.Say(context.Background(), makeSignedMessage(b, bk, to)); !ack.IsError || !strings.Contains(ack.Error, "domain") {
+		t.Errorf("Unverified domain escaped the per-address domain limit: %v", ack)
+	}
+
+	msg := makeSignedMessage(a, ak, to)
+	StampMessage(msg, 1)
+	if auth := gs.authenticateSender(context.Background(), msg); !auth.verified || auth.domainVerified {
+		t.Errorf("Wrong authentication for a signed, stamped remote sender: %+v", auth)
+	}
+	msg.Tstamp++
+	if gs.authenticateSender(context.Background(), msg).verified {
+		t.Error("Verified a message changed after signing")
+	}
+}
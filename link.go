@@ -0,0 +1,226 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"errors"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	linkFetchTimeout  = 10 * time.Second
+	maxLinkPageBytes  = 1 << 20
+	maxThumbnailBytes = 256 * 1024
+	maxLinkTitleLen   = 200
+	maxLinkDescLen    = 1000
+)
+
+// A LinkFetcher gets what is at a URL, returning its content type as well.
+// The sender's client uses one to build link previews; tests stub it.
+type LinkFetcher interface {
+	Fetch(rawurl string) ([]byte, string, error)
+}
+
+// An HTTPLinkFetcher fetches over HTTP, reading at most MaxBytes.
+type HTTPLinkFetcher struct {
+	Client   *http.Client
+	MaxBytes int64
+}
+
+func NewHTTPLinkFetcher() *HTTPLinkFetcher {
+	return &HTTPLinkFetcher{&http.Client{Timeout: linkFetchTimeout}, maxLinkPageBytes}
+}
+
+func (f *HTTPLinkFetcher) Fetch(rawurl string) ([]byte, string, error) {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "gsdp-link-preview")
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.New("Fetching " + rawurl + ": " + resp.Status)
+	}
+	bs, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxBytes))
+	if err != nil {
+		return nil, "", err
+	}
+	return bs, resp.Header.Get("Content-Type"), nil
+}
+
+// A LinkPreview is what the sender saw at a URL: its title, description
+// and, if the page named one, a small image.
+type LinkPreview struct {
+	Url           string
+	Title         string
+	Description   string
+	Thumbnail     []byte
+	ThumbnailType string
+}
+
+// Only http and https links are previewed or sent.
+func checkLinkURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, errors.New("Not an http or https URL: " + rawurl)
+	}
+	return u, nil
+}
+
+// Collapses whitespace and cuts s to at most n bytes, on a character
+// boundary.
+func cleanLinkText(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// Pulls the title, description and image URL out of a page, preferring
+// Open Graph tags to <title> and <meta name="description">.
+func scanLinkPage(page []byte) (string, string, string) {
+	var title, ogTitle, desc, ogDesc, image string
+	z := html.NewTokenizer(strings.NewReader(string(page)))
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if len(ogTitle) > 0 {
+				title = ogTitle
+			}
+			if len(ogDesc) > 0 {
+				desc = ogDesc
+			}
+			return title, desc, image
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+			switch t.Data {
+			case "title":
+				inTitle = len(title) == 0
+			case "meta":
+				attrs := make(map[string]string)
+				for _, a := range t.Attr {
+					attrs[strings.ToLower(a.Key)] = a.Val
+				}
+				key := strings.ToLower(attrs["property"])
+				if len(key) == 0 {
+					key = strings.ToLower(attrs["name"])
+				}
+				switch key {
+				case "og:title":
+					ogTitle = attrs["content"]
+				case "og:description":
+					ogDesc = attrs["content"]
+				case "description":
+					desc = attrs["content"]
+				case "og:image":
+					image = attrs["content"]
+				}
+			}
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+		case html.EndTagToken:
+			if t := z.Token(); t.Data == "title" {
+				inTitle = false
+			}
+		}
+	}
+}
+
+// FetchLinkPreview builds a preview of rawurl with f. A page that is not
+// HTML gets a preview with just its URL, and a thumbnail that cannot be
+// fetched, or is not a small image, is left out.
+func FetchLinkPreview(f LinkFetcher, rawurl string) (*LinkPreview, error) {
+	u, err := checkLinkURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p := &LinkPreview{Url: u.String()}
+	page, contentType, err := f.Fetch(p.Url)
+	if err != nil {
+		return nil, err
+	}
+	switch mt := mediaType(contentType); {
+	case strings.HasPrefix(mt, "image/") && len(page) <= maxThumbnailBytes:
+		p.Thumbnail, p.ThumbnailType = page, mt
+		return p, nil
+	case mt != "text/html" && mt != "application/xhtml+xml":
+		return p, nil
+	}
+	title, desc, image := scanLinkPage(page)
+	p.Title = cleanLinkText(title, maxLinkTitleLen)
+	p.Description = cleanLinkText(desc, maxLinkDescLen)
+	if len(image) == 0 {
+		return p, nil
+	}
+	iu, err := u.Parse(strings.TrimSpace(image))
+	if err != nil {
+		return p, nil
+	}
+	if _, err := checkLinkURL(iu.String()); err != nil {
+		return p, nil
+	}
+	thumb, contentType, err := f.Fetch(iu.String())
+	if mt := mediaType(contentType); err == nil && strings.HasPrefix(mt, "image/") && len(thumb) <= maxThumbnailBytes {
+		p.Thumbnail, p.ThumbnailType = thumb, mt
+	}
+	return p, nil
+}
+
+// SendLink sends a preview to to as a LINK message, sending its thumbnail
+// first, if any, as a RICH_MEDIA message the link refers to.
+func (c *GSDPClient) SendLink(p *LinkPreview, note string, tags []string, to *pb.Identity) (*pb.RawMessage, error) {
+	if _, err := checkLinkURL(p.Url); err != nil {
+		return nil, err
+	}
+	link := &pb.Link{p.Url, p.Title, p.Description, note, time.Now().Unix(), nil, "", tags}
+	if len(p.Thumbnail) > 0 {
+		thumb, err := c.sendContent(pb.MessageType_RICH_MEDIA, p.Thumbnail, to)
+		if err != nil {
+			return nil, err
+		}
+		link.ThumbnailMsgId, link.ThumbnailType = thumb.MsgId, p.ThumbnailType
+	}
+	return c.SendPayload(pb.MessageType_LINK, link, to)
+}
@@ -0,0 +1,118 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"testing"
+)
+
+type mockFetch struct {
+	body        string
+	contentType string
+}
+
+// A stub fetcher that serves canned pages and remembers what was asked for.
+type mockLinkFetcher struct {
+	pages   map[string]mockFetch
+	fetched []string
+}
+
+func (f *mockLinkFetcher) Fetch(rawurl string) ([]byte, string, error) {
+	f.fetched = append(f.fetched, rawurl)
+	p, ok := f.pages[rawurl]
+	if !ok {
+		return nil, "", errors.New("404 Not Found")
+	}
+	return []byte(p.body), p.contentType, nil
+}
+
+const mockPage = `<html><head>
+<title>  Plain
+  title </title>
+<meta name="description" content="Plain description">
+<meta property="og:title" content="Graph title">
+<meta property="og:image" content="/img/thumb.png">
+</head><body><title>Not this</title></body></html>`
+
+func TestFetchLinkPreview(t *testing.T) {
+	f := &mockLinkFetcher{pages: map[string]mockFetch{
+		"https://example.com/post":          {mockPage, "text/html; charset=utf-8"},
+		"https://example.com/img/thumb.png": {"\x89PNG...", "image/png"},
+		"https://example.com/file.zip":      {"PK...", "application/zip"},
+	}}
+	p, err := FetchLinkPreview(f, " https://example.com/post ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Url != "https://example.com/post" || p.Title != "Graph title" || p.Description != "Plain description" {
+		t.Errorf("Bad preview: %v", p)
+	}
+	if string(p.Thumbnail) != "\x89PNG..." || p.ThumbnailType != "image/png" {
+		t.Errorf("Bad thumbnail: %v", p)
+	}
+
+	p, err = FetchLinkPreview(f, "https://example.com/file.zip")
+	if err != nil || len(p.Title) > 0 || len(p.Thumbnail) > 0 {
+		t.Errorf("Bad preview of a download: %v %v", p, err)
+	}
+	if _, err := FetchLinkPreview(f, "https://example.com/missing"); err == nil {
+		t.Error("Previewed a page that could not be fetched")
+	}
+	for _, u := range []string{"file:///etc/passwd", "javascript:alert(1)", "example.com"} {
+		if _, err := FetchLinkPreview(f, u); err == nil {
+			t.Errorf("Previewed %s", u)
+		}
+	}
+	for _, u := range f.fetched {
+		if !strings.HasPrefix(u, "https://example.com/") {
+			t.Errorf("Fetched %s", u)
+		}
+	}
+}
+
+func TestFetchLinkPreviewSkipsBadThumbnail(t *testing.T) {
+	page := `<title>Big</title><meta property="og:image" content="https://cdn.example.com/big.png">`
+	f := &mockLinkFetcher{pages: map[string]mockFetch{
+		"https://example.com/":            {page, "text/html"},
+		"https://cdn.example.com/big.png": {strings.Repeat("x", maxThumbnailBytes+1), "image/png"},
+	}}
+	p, err := FetchLinkPreview(f, "https://example.com/")
+	if err != nil || p.Title != "Big" || len(p.Thumbnail) > 0 {
+		t.Errorf("Bad preview: %v %v", p, err)
+	}
+	if title := cleanLinkText(strings.Repeat("é", maxLinkTitleLen), maxLinkTitleLen); len(title) != maxLinkTitleLen {
+		t.Errorf("Bad cut title length %d", len(title))
+	}
+}
+
+func TestLinkPayloadText(t *testing.T) {
+	link := &pb.Link{Url: "https://example.com/", Title: "Example", Note: "see this", ProjectTags: []string{"web"}}
+	bs, _ := proto.Marshal(link)
+	if got := PayloadText(pb.MessageType_LINK, bs); got != "see this\nExample\nhttps://example.com/" {
+		t.Errorf("Bad link text: %q", got)
+	}
+	if tags := PayloadTags(pb.MessageType_LINK, bs); len(tags) != 1 || tags[0] != "web" {
+		t.Errorf("Bad link tags: %v", tags)
+	}
+	if got := PayloadText(pb.MessageType_RICH_MEDIA, []byte("\x89PNG")); got != "(media, 4 bytes)" {
+		t.Errorf("Bad media text: %q", got)
+	}
+}
@@ -0,0 +1,459 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mailboxSuffix    = ".mbox"
+	mailboxLogSuffix = ".mlog"
+	// A mailbox's log is folded back into its file once it holds this many
+	// records.
+	mailboxCompactAfter = 1024
+	mailboxDelivered    = byte(1)
+	mailboxAcked        = byte(2)
+)
+
+// A MailboxStore holds messages for local users until they are picked up.
+// Mailboxes are keyed by IdentToString of the owner's ident. Deliver stores
+// a copy of the message, numbered one above the mailbox's last seq.
+type MailboxStore interface {
+	Deliver(string, *pb.RawMessage) error
+	Get(string, bool) []*pb.RawMessage
+	After(string, uint64) []*pb.RawMessage
+	Ack(string, []uint64) int
+	Expire(int64) int
+	Stat(string) (int64, int64)
+	List() []string
+	Flush() error
+}
+
+type mailbox struct {
+	msgs    []*pb.RawMessage
+	lastSeq uint64
+	logged  int
+}
+
+type InMemoryMailboxStore struct {
+	boxes map[string]*mailbox
+	lck   *sync.Mutex
+}
+
+// A FileMailboxStore keeps mailboxes in memory, backed by one file per
+// mailbox under SrcPath. Every delivery and deletion is appended to the
+// mailbox's log and synced before it returns, so a crash loses nothing; the
+// log is folded into the mailbox file when it grows, and when flushed.
+type FileMailboxStore struct {
+	InMemoryMailboxStore
+	SrcPath string
+}
+
+func NewInMemoryMailboxStore() *InMemoryMailboxStore {
+	return &InMemoryMailboxStore{make(map[string]*mailbox), &sync.Mutex{}}
+}
+
+func (s *InMemoryMailboxStore) boxNotThreadSafe(id string) *mailbox {
+	b, ok := s.boxes[id]
+	if !ok {
+		b = &mailbox{make([]*pb.RawMessage, 0), 0, 0}
+		s.boxes[id] = b
+	}
+	return b
+}
+
+func (s *InMemoryMailboxStore) Deliver(id string, msg *pb.RawMessage) error {
+	s.lck.Lock()
+	s.deliverNotThreadSafe(id, msg)
+	s.lck.Unlock()
+	return nil
+}
+
+// Stores a copy of msg and returns it.
+func (s *InMemoryMailboxStore) deliverNotThreadSafe(id string, msg *pb.RawMessage) *pb.RawMessage {
+	msg = proto.Clone(msg).(*pb.RawMessage)
+	msg.ReceivedUtc = time.Now().Unix()
+	b := s.boxNotThreadSafe(id)
+	b.lastSeq++
+	msg.Seq = b.lastSeq
+	b.msgs = append(b.msgs, msg)
+	return msg
+}
+
+func (s *InMemoryMailboxStore) Get(id string, purge bool) []*pb.RawMessage {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	b, ok := s.boxes[id]
+	if !ok {
+		return make([]*pb.RawMessage, 0)
+	}
+	msgs := b.msgs
+	if purge {
+		b.msgs = make([]*pb.RawMessage, 0)
+	}
+	return msgs
+}
+
+// After returns the messages in a mailbox with a seq above seq, in order.
+func (s *InMemoryMailboxStore) After(id string, seq uint64) []*pb.RawMessage {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	b, ok := s.boxes[id]
+	if !ok {
+		return make([]*pb.RawMessage, 0)
+	}
+	i := sort.Search(len(b.msgs), func(i int) bool { return b.msgs[i].Seq > seq })
+	return append([]*pb.RawMessage{}, b.msgs[i:]...)
+}
+
+// Ack deletes the messages with the given seqs and returns how many it found.
+func (s *InMemoryMailboxStore) Ack(id string, seqs []uint64) int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.ackNotThreadSafe(id, seqs)
+}
+
+func (s *InMemoryMailboxStore) ackNotThreadSafe(id string, seqs []uint64) int {
+	acked := make(map[uint64]bool)
+	for _, q := range seqs {
+		acked[q] = true
+	}
+	b, ok := s.boxes[id]
+	if !ok {
+		return 0
+	}
+	kept := make([]*pb.RawMessage, 0, len(b.msgs))
+	for _, m := range b.msgs {
+		if !acked[m.Seq] {
+			kept = append(kept, m)
+		}
+	}
+	n := len(b.msgs) - len(kept)
+	b.msgs = kept
+	return n
+}
+
+// Expired says whether msg has an expiry time and it is past at now.
+func Expired(msg *pb.RawMessage, now int64) bool {
+	return msg.ExpiresUtc > 0 && msg.ExpiresUtc <= now
+}
+
+// Expire deletes every message that has expired at now, and returns how many
+// there were.
+func (s *InMemoryMailboxStore) Expire(now int64) int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	n := 0
+	for _, seqs := range s.expireNotThreadSafe(now) {
+		n += len(seqs)
+	}
+	return n
+}
+
+// Deletes what has expired at now, returning the seqs deleted per mailbox.
+func (s *InMemoryMailboxStore) expireNotThreadSafe(now int64) map[string][]uint64 {
+	gone := make(map[string][]uint64)
+	for id, b := range s.boxes {
+		kept := make([]*pb.RawMessage, 0, len(b.msgs))
+		for _, m := range b.msgs {
+			if Expired(m, now) {
+				gone[id] = append(gone[id], m.Seq)
+			} else {
+				kept = append(kept, m)
+			}
+		}
+		b.msgs = kept
+	}
+	return gone
+}
+
+// Stat returns the number of messages in a mailbox and their total size.
+func (s *InMemoryMailboxStore) Stat(id string) (int64, int64) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	b, ok := s.boxes[id]
+	if !ok {
+		return 0, 0
+	}
+	size := int64(0)
+	for _, m := range b.msgs {
+		size += int64(proto.Size(m))
+	}
+	return int64(len(b.msgs)), size
+}
+
+func (s *InMemoryMailboxStore) List() []string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	ids := make([]string, 0, len(s.boxes))
+	for id, _ := range s.boxes {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (s *InMemoryMailboxStore) Flush() error {
+	return nil
+}
+
+func mailboxFileName(id string) string {
+	bs, _ := base64.StdEncoding.DecodeString(id)
+	return base64.URLEncoding.EncodeToString(bs) + mailboxSuffix
+}
+
+func mailboxLogName(id string) string {
+	bs, _ := base64.StdEncoding.DecodeString(id)
+	return base64.URLEncoding.EncodeToString(bs) + mailboxLogSuffix
+}
+
+func MakeFileMailboxStore(path string) (*FileMailboxStore, error) {
+	s := &FileMailboxStore{*NewInMemoryMailboxStore(), path}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		fn := f.Name()
+		if !strings.HasSuffix(fn, mailboxSuffix) {
+			continue
+		}
+		bs, err := base64.URLEncoding.DecodeString(fn[:len(fn)-len(mailboxSuffix)])
+		if err != nil {
+			continue
+		}
+		fh, err := os.Open(path + "/" + fn)
+		if err != nil {
+			return nil, err
+		}
+		barr := LoadBytes(fh)
+		fh.Close()
+		box := &pb.PendingData{}
+		if err := proto.Unmarshal(barr, box); err != nil {
+			return nil, err
+		}
+		// Mailboxes written before seqs existed get numbered now.
+		if box.NextSeq == 0 {
+			for i, m := range box.Messages {
+				m.Seq = uint64(i + 1)
+			}
+			box.NextSeq = uint64(len(box.Messages))
+		}
+		s.boxes[IdentToString(bs)] = &mailbox{box.Messages, box.NextSeq, 0}
+	}
+	// A mailbox may only have a log, if it was never written out.
+	for _, f := range files {
+		fn := f.Name()
+		if !strings.HasSuffix(fn, mailboxLogSuffix) {
+			continue
+		}
+		bs, err := base64.URLEncoding.DecodeString(fn[:len(fn)-len(mailboxLogSuffix)])
+		if err != nil {
+			continue
+		}
+		if err := s.replayNotThreadSafe(IdentToString(bs), path+"/"+fn); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Applies a mailbox's log on top of what its file held. Records are a kind,
+// a length and a message; a record cut short by a crash is ignored. Anything
+// the file already has is skipped, as the log outlives the file being
+// rewritten if we crash in between.
+func (s *FileMailboxStore) replayNotThreadSafe(id string, fn string) error {
+	bs, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	b := s.boxNotThreadSafe(id)
+	for len(bs) >= 5 {
+		kind, n := bs[0], int(binary.BigEndian.Uint32(bs[1:5]))
+		if len(bs) < 5+n {
+			break
+		}
+		rec := bs[5 : 5+n]
+		bs = bs[5+n:]
+		switch kind {
+		case mailboxDelivered:
+			m := &pb.RawMessage{}
+			if err := proto.Unmarshal(rec, m); err != nil {
+				return err
+			}
+			if m.Seq > b.lastSeq {
+				b.msgs = append(b.msgs, m)
+				b.lastSeq = m.Seq
+			}
+		case mailboxAcked:
+			ack := &pb.AckRequest{}
+			if err := proto.Unmarshal(rec, ack); err != nil {
+				return err
+			}
+			s.ackNotThreadSafe(id, ack.Seqs)
+		}
+	}
+	return nil
+}
+
+func (s *FileMailboxStore) appendNotThreadSafe(id string, kind byte, rec proto.Message) error {
+	bs, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 5, 5+len(bs))
+	buf[0] = kind
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(bs)))
+	buf = append(buf, bs...)
+	fh, err := os.OpenFile(s.SrcPath+"/"+mailboxLogName(id), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(buf); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	// The record is safe now, so failing to compact is not an error.
+	b := s.boxNotThreadSafe(id)
+	if b.logged++; b.logged >= mailboxCompactAfter {
+		if err := s.writeNotThreadSafe(id); err != nil {
+			log.Printf("Cannot compact mailbox %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+func (s *FileMailboxStore) logAckNotThreadSafe(id string, seqs []uint64) error {
+	return s.appendNotThreadSafe(id, mailboxAcked, &pb.AckRequest{nil, seqs, 0, nil})
+}
+
+// Writes out a mailbox and empties its log. Empty mailboxes are still
+// written, so that their seqs carry on where they left off.
+func (s *FileMailboxStore) writeNotThreadSafe(id string) error {
+	b := s.boxNotThreadSafe(id)
+	bs, err := proto.Marshal(&pb.PendingData{nil, 0, b.msgs, b.lastSeq, false})
+	if err != nil {
+		return err
+	}
+	fn := s.SrcPath + "/" + mailboxFileName(id)
+	tmp := fn + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fn); err != nil {
+		return err
+	}
+	b.logged = 0
+	if err := os.Remove(s.SrcPath + "/" + mailboxLogName(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileMailboxStore) Deliver(id string, msg *pb.RawMessage) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	msg = s.deliverNotThreadSafe(id, msg)
+	if err := s.appendNotThreadSafe(id, mailboxDelivered, msg); err != nil {
+		b := s.boxes[id]
+		if n := len(b.msgs); n > 0 && b.msgs[n-1] == msg {
+			b.msgs = b.msgs[:n-1]
+		}
+		return err
+	}
+	return nil
+}
+
+// Get with purge may lose the purged messages' deletion if it cannot be
+// logged; they are then handed out again after a restart.
+func (s *FileMailboxStore) Get(id string, purge bool) []*pb.RawMessage {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	b, ok := s.boxes[id]
+	if !ok {
+		return make([]*pb.RawMessage, 0)
+	}
+	msgs := b.msgs
+	if purge && len(msgs) > 0 {
+		seqs := make([]uint64, 0, len(msgs))
+		for _, m := range msgs {
+			seqs = append(seqs, m.Seq)
+		}
+		s.ackNotThreadSafe(id, seqs)
+		if err := s.logAckNotThreadSafe(id, seqs); err != nil {
+			log.Printf("Cannot record purge of mailbox %s: %v", id, err)
+		}
+	}
+	return msgs
+}
+
+func (s *FileMailboxStore) Ack(id string, seqs []uint64) int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	n := s.ackNotThreadSafe(id, seqs)
+	if n > 0 {
+		if err := s.logAckNotThreadSafe(id, seqs); err != nil {
+			log.Printf("Cannot record ack in mailbox %s: %v", id, err)
+		}
+	}
+	return n
+}
+
+func (s *FileMailboxStore) Expire(now int64) int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	n := 0
+	for id, seqs := range s.expireNotThreadSafe(now) {
+		n += len(seqs)
+		if err := s.logAckNotThreadSafe(id, seqs); err != nil {
+			log.Printf("Cannot record expiry in mailbox %s: %v", id, err)
+		}
+	}
+	return n
+}
+
+// Flush folds every mailbox's log into its file.
+func (s *FileMailboxStore) Flush() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	for id := range s.boxes {
+		if err := s.writeNotThreadSafe(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"fmt"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileMailboxFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, _, _ := makeAnIdentity()
+	key := IdentToString(id.Ident)
+	s, err := MakeFileMailboxStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nothin := []byte{}
+	msg := &pb.RawMessage{id, []*pb.Identity{id}, nothin, pb.MessageType_PLAIN, []byte("hi"), nothin, nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+	s.Deliver(key, msg)
+	if err := s.Flush(); err != nil {
+		t.Error(fmt.Sprintf("Got an error flushing: %v", err))
+	}
+	s2, err := MakeFileMailboxStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := s2.Get(key, true)
+	if len(msgs) != 1 || string(msgs[0].MessageContent) != "hi" {
+		t.Error("Flushed mailbox did not load back")
+	}
+	s2.Flush()
+	s3, _ := MakeFileMailboxStore(dir)
+	if len(s3.Get(key, false)) != 0 {
+		t.Error("Purged mailbox still on disk")
+	}
+}
+
+func TestMailboxSeqsSurviveFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, _, _ := makeAnIdentity()
+	key := IdentToString(id.Ident)
+	s, _ := MakeFileMailboxStore(dir)
+	for i := 0; i < 3; i++ {
+		s.Deliver(key, makeMockMessage(id, id))
+	}
+	if n := s.Ack(key, []uint64{1, 3, 7}); n != 2 {
+		t.Errorf("Acked %d messages, wanted 2", n)
+	}
+	msgs := s.After(key, 0)
+	if len(msgs) != 1 || msgs[0].Seq != 2 {
+		t.Errorf("Wrong messages left after ack: %v", msgs)
+	}
+	s.Ack(key, []uint64{2})
+	s.Flush()
+	s2, _ := MakeFileMailboxStore(dir)
+	s2.Deliver(key, makeMockMessage(id, id))
+	if msgs := s2.After(key, 3); len(msgs) != 1 || msgs[0].Seq != 4 {
+		t.Errorf("Seqs started over after a flush: %v", msgs)
+	}
+}
+
+func TestFileMailboxSurvivesACrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	id, _, _ := makeAnIdentity()
+	key := IdentToString(id.Ident)
+	s, _ := MakeFileMailboxStore(dir)
+	for i := 0; i < 3; i++ {
+		if err := s.Deliver(key, makeMockMessage(id, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Ack(key, []uint64{2})
+	// Never flushed, and the last record was cut short.
+	fh, _ := os.OpenFile(dir+"/"+mailboxLogName(key), os.O_APPEND|os.O_WRONLY, 0600)
+	fh.Write([]byte{mailboxDelivered, 0, 0, 1})
+	fh.Close()
+	s2, err := MakeFileMailboxStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := s2.After(key, 0)
+	if len(msgs) != 2 || msgs[0].Seq != 1 || msgs[1].Seq != 3 {
+		t.Errorf("Wrong messages after a crash: %v", msgs)
+	}
+	if _, err := os.Stat(dir + "/" + mailboxLogName(key)); !os.IsNotExist(err) {
+		t.Error("Log not folded into the mailbox on load")
+	}
+	s2.Deliver(key, makeMockMessage(id, id))
+	if msgs := s2.After(key, 3); len(msgs) != 1 || msgs[0].Seq != 4 {
+		t.Errorf("Seqs started over after a crash: %v", msgs)
+	}
+}
+
+func TestMailboxExpiry(t *testing.T) {
+	s := NewInMemoryMailboxStore()
+	id, _, _ := makeAnIdentity()
+	key := IdentToString(id.Ident)
+	keep := makeMockMessage(id, id)
+	gone := makeMockMessage(id, id)
+	gone.ExpiresUtc = time.Now().Unix() + 60
+	s.Deliver(key, keep)
+	s.Deliver(key, gone)
+	if n := s.Expire(time.Now().Unix()); n != 0 {
+		t.Errorf("Expired %d messages early", n)
+	}
+	if n := s.Expire(time.Now().Unix() + 120); n != 1 {
+		t.Errorf("Expired %d messages, wanted 1", n)
+	}
+	if msgs := s.After(key, 0); len(msgs) != 1 || msgs[0].ExpiresUtc != 0 {
+		t.Error("Wrong message expired")
+	}
+}
@@ -0,0 +1,330 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	devNull = "/dev/null"
+)
+
+// A Hunk is one @@ section of a unified diff. Lines keep their leading ' ',
+// '-' or '+'.
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []string
+	// Set by "\ No newline at end of file" after the last old or new line.
+	OldNoEOL bool
+	NewNoEOL bool
+}
+
+// A FilePatch is the part of a unified diff for one file. OldPath is
+// /dev/null for a new file, and NewPath for a deleted one.
+type FilePatch struct {
+	OldPath string
+	NewPath string
+	Hunks   []*Hunk
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// LooksLikePatch says whether text contains a unified diff.
+func LooksLikePatch(text string) bool {
+	ps, err := ParsePatch(text)
+	return err == nil && len(ps) > 0
+}
+
+// Takes the path from a ---/+++ line, dropping any timestamp after a tab.
+func patchPath(line string) string {
+	p := strings.TrimSpace(line[4:])
+	if i := strings.Index(p, "\t"); i >= 0 {
+		p = p[:i]
+	}
+	return p
+}
+
+func atoiOr(s string, def int) int {
+	if len(s) == 0 {
+		return def
+	}
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// ParsePatch parses a unified diff, as made by diff -u or git diff. Lines
+// outside of file sections, such as commit messages, are skipped.
+func ParsePatch(text string) ([]*FilePatch, error) {
+	lines := strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n")
+	patches := make([]*FilePatch, 0)
+	var fp *FilePatch
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+			fp = &FilePatch{patchPath(line), patchPath(lines[i+1]), make([]*Hunk, 0)}
+			patches = append(patches, fp)
+			i++
+			continue
+		}
+		m := hunkHeaderRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if fp == nil {
+			return nil, errors.New("Hunk before any file header")
+		}
+		h := &Hunk{atoiOr(m[1], 0), atoiOr(m[2], 1), atoiOr(m[3], 0), atoiOr(m[4], 1), make([]string, 0), false, false}
+		oldLeft, newLeft := h.OldLines, h.NewLines
+		last := byte(' ')
+		for i+1 < len(lines) && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(lines[i+1], "\\")) {
+			i++
+			l := lines[i]
+			if strings.HasPrefix(l, "\\") {
+				// No newline at end of file, for whichever side the last
+				// line was on.
+				h.OldNoEOL = h.OldNoEOL || last != '+'
+				h.NewNoEOL = h.NewNoEOL || last != '-'
+				continue
+			}
+			if len(l) == 0 {
+				// Some tools drop the space from empty context lines.
+				l = " "
+			}
+			switch l[0] {
+			case ' ':
+				oldLeft--
+				newLeft--
+			case '-':
+				oldLeft--
+			case '+':
+				newLeft--
+			default:
+				return nil, fmt.Errorf("Bad line in hunk for %s: %q", fp.NewPath, l)
+			}
+			if oldLeft < 0 || newLeft < 0 {
+				return nil, errors.New("Hunk longer than its header says in " + fp.NewPath)
+			}
+			last = l[0]
+			h.Lines = append(h.Lines, l)
+		}
+		if oldLeft > 0 || newLeft > 0 {
+			return nil, errors.New("Hunk cut short in " + fp.NewPath)
+		}
+		fp.Hunks = append(fp.Hunks, h)
+	}
+	return patches, nil
+}
+
+func splitLines(content string) ([]string, bool) {
+	if len(content) == 0 {
+		return []string{}, true
+	}
+	eol := strings.HasSuffix(content, "\n")
+	lines := strings.Split(content, "\n")
+	if eol {
+		lines = lines[:len(lines)-1]
+	}
+	return lines, eol
+}
+
+func matchesAt(lines []string, want []string, at int) bool {
+	if at < 0 || at+len(want) > len(lines) {
+		return false
+	}
+	for i, w := range want {
+		if lines[at+i] != w {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply applies the patch to a file's content. Hunks that do not match where
+// they say are looked for nearby, as patch(1) does, but never before the
+// previous hunk.
+func (fp *FilePatch) Apply(content string) (string, error) {
+	lines, eol := splitLines(content)
+	out := make([]string, 0, len(lines))
+	pos, offset := 0, 0
+	for _, h := range fp.Hunks {
+		old := make([]string, 0, len(h.Lines))
+		for _, l := range h.Lines {
+			if l[0] != '+' {
+				old = append(old, l[1:])
+			}
+		}
+		want := h.OldStart - 1 + offset
+		if h.OldLines == 0 {
+			want = h.OldStart + offset
+		}
+		at := -1
+		for d := 0; at < 0 && (want-d >= pos || want+d <= len(lines)); d++ {
+			if want-d >= pos && matchesAt(lines, old, want-d) {
+				at = want - d
+			} else if want+d >= pos && matchesAt(lines, old, want+d) {
+				at = want + d
+			}
+		}
+		if at < 0 {
+			return "", fmt.Errorf("Hunk at line %d does not apply to %s", h.OldStart, fp.NewPath)
+		}
+		offset = at - (want - offset)
+		out = append(out, lines[pos:at]...)
+		for _, l := range h.Lines {
+			if l[0] != '-' {
+				out = append(out, l[1:])
+			}
+		}
+		pos = at + len(old)
+		if pos == len(lines) {
+			eol = !h.NewNoEOL
+		}
+	}
+	out = append(out, lines[pos:]...)
+	if len(out) == 0 {
+		return "", nil
+	}
+	res := strings.Join(out, "\n")
+	if eol {
+		res += "\n"
+	}
+	return res, nil
+}
+
+// Drops the first strip components of a patch path and checks that what is
+// left stays inside the directory the patch is applied in.
+func stripPatchPath(p string, strip int) (string, error) {
+	pcs := strings.Split(p, "/")
+	if strip >= len(pcs) {
+		return "", errors.New("Cannot strip " + strconv.Itoa(strip) + " components from " + p)
+	}
+	rel := filepath.Clean(filepath.FromSlash(strings.Join(pcs[strip:], "/")))
+	if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("Patch path outside the tree: " + p)
+	}
+	return rel, nil
+}
+
+// Resolves rel under dir through any symlinks on the way, refusing it if
+// they lead outside dir. What does not exist yet is taken as it is.
+func resolveInTree(dir string, rel string) (string, error) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := filepath.Join(root, rel), ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", errors.New("Patch path is a broken link: " + rel)
+	}
+	real = filepath.Join(real, rest)
+	if r, err := filepath.Rel(root, real); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errors.New("Patch path links outside the tree: " + rel)
+	}
+	return real, nil
+}
+
+// ApplyPatches applies patches to the files under dir, stripping strip
+// leading components from their paths as patch -p does. Paths that lead
+// outside dir, also through symlinks, are refused. Either every file is
+// patched or, if any hunk fails, none is. It returns the files changed; with
+// dryRun, nothing is written.
+func ApplyPatches(dir string, patches []*FilePatch, strip int, dryRun bool) ([]string, error) {
+	type result struct {
+		path    string
+		real    string
+		content string
+		remove  bool
+	}
+	results := make([]result, 0, len(patches))
+	for _, fp := range patches {
+		name := fp.NewPath
+		if name == devNull {
+			name = fp.OldPath
+		}
+		rel, err := stripPatchPath(name, strip)
+		if err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, rel)
+		real, err := resolveInTree(dir, rel)
+		if err != nil {
+			return nil, err
+		}
+		old := ""
+		if fp.OldPath == devNull {
+			if _, err := os.Lstat(real); err == nil {
+				return nil, errors.New("Patch creates " + rel + ", which already exists")
+			}
+		} else {
+			bs, err := ioutil.ReadFile(real)
+			if err != nil {
+				return nil, err
+			}
+			old = string(bs)
+		}
+		content, err := fp.Apply(old)
+		if err != nil {
+			return nil, err
+		}
+		if fp.NewPath == devNull && len(content) > 0 {
+			return nil, errors.New("Patch deletes " + rel + ", but it has other content")
+		}
+		results = append(results, result{path, real, content, fp.NewPath == devNull})
+	}
+	changed := make([]string, 0, len(results))
+	for _, r := range results {
+		changed = append(changed, r.path)
+		if dryRun {
+			continue
+		}
+		var err error
+		if r.remove {
+			err = os.Remove(r.real)
+		} else if err = os.MkdirAll(filepath.Dir(r.real), 0755); err == nil {
+			mode := os.FileMode(0644)
+			if fi, e := os.Stat(r.real); e == nil {
+				mode = fi.Mode()
+			}
+			err = ioutil.WriteFile(r.real, []byte(r.content), mode)
+		}
+		if err != nil {
+			return changed, err
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,188 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const mockPatch = `commit message lines are skipped
+--- a/greet.txt
++++ b/greet.txt
+@@ -2,3 +2,3 @@
+ two
+-three
++THREE
+ four
+--- /dev/null
++++ b/new.txt
+@@ -0,0 +1 @@
++brand new
+\ No newline at end of file
+--- a/old.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-going away
+`
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readTestFile(dir string, name string) string {
+	bs, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "<" + err.Error() + ">"
+	}
+	return string(bs)
+}
+
+func TestParsePatch(t *testing.T) {
+	ps, err := ParsePatch(mockPatch)
+	if err != nil || len(ps) != 3 {
+		t.Fatalf("Bad parse: %v %v", ps, err)
+	}
+	if ps[0].OldPath != "a/greet.txt" || len(ps[0].Hunks) != 1 || len(ps[0].Hunks[0].Lines) != 4 {
+		t.Errorf("Bad first file: %v", ps[0])
+	}
+	if ps[1].OldPath != devNull || !ps[1].Hunks[0].NewNoEOL || ps[1].Hunks[0].OldNoEOL {
+		t.Errorf("Bad new file: %v", ps[1])
+	}
+	if ps[2].NewPath != devNull {
+		t.Errorf("Bad deleted file: %v", ps[2])
+	}
+	if _, err := ParsePatch("--- a/x\n+++ b/x\n@@ -1,2 +1,2 @@\n-one\n"); err == nil {
+		t.Error("Parsed a hunk cut short")
+	}
+	if LooksLikePatch("just some text\n") {
+		t.Error("Plain text looks like a patch")
+	}
+}
+
+func TestPatchApplyWithOffset(t *testing.T) {
+	ps, _ := ParsePatch(mockPatch)
+	// Two lines were added above the hunk since the diff was made.
+	out, err := ps[0].Apply("zero\nhalf\none\ntwo\nthree\nfour\nfive\n")
+	if err != nil || out != "zero\nhalf\none\ntwo\nTHREE\nfour\nfive\n" {
+		t.Errorf("Bad apply: %q %v", out, err)
+	}
+	if _, err := ps[0].Apply("one\ntwo\nthree hundred\nfour\n"); err == nil {
+		t.Error("Applied a hunk that does not match")
+	}
+}
+
+func TestApplyPatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestFiles(t, dir, map[string]string{"greet.txt": "one\ntwo\nthree\nfour\n", "old.txt": "going away\n"})
+	ps, _ := ParsePatch(mockPatch)
+
+	changed, err := ApplyPatches(dir, ps, 1, true)
+	if err != nil || len(changed) != 3 || readTestFile(dir, "greet.txt") != "one\ntwo\nthree\nfour\n" {
+		t.Fatalf("Bad dry run: %v %v", changed, err)
+	}
+	if _, err := ApplyPatches(dir, ps, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(dir, "greet.txt"); got != "one\ntwo\nTHREE\nfour\n" {
+		t.Errorf("Bad patched file: %q", got)
+	}
+	if got := readTestFile(dir, "new.txt"); got != "brand new" {
+		t.Errorf("Bad created file: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("Deleted file still there: %v", err)
+	}
+}
+
+func TestApplyPatchesAllOrNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// greet.txt would patch cleanly, but old.txt has changed.
+	writeTestFiles(t, dir, map[string]string{"greet.txt": "one\ntwo\nthree\nfour\n", "old.txt": "still here\n"})
+	ps, _ := ParsePatch(mockPatch)
+	if _, err := ApplyPatches(dir, ps, 1, false); err == nil {
+		t.Fatal("Applied a patch with a failing hunk")
+	}
+	if readTestFile(dir, "greet.txt") != "one\ntwo\nthree\nfour\n" || readTestFile(dir, "old.txt") != "still here\n" {
+		t.Error("Failed patch changed files")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new.txt")); !os.IsNotExist(err) {
+		t.Error("Failed patch created a file")
+	}
+
+	escape, _ := ParsePatch("--- /dev/null\n+++ b/../escaped.txt\n@@ -0,0 +1 @@\n+gotcha\n")
+	if _, err := ApplyPatches(dir, escape, 1, false); err == nil {
+		t.Error("Applied a patch outside the tree")
+	}
+	abs, _ := ParsePatch("--- /dev/null\n+++ /tmp/escaped.txt\n@@ -0,0 +1 @@\n+gotcha\n")
+	if _, err := ApplyPatches(dir, abs, 0, false); err == nil {
+		t.Error("Applied a patch to an absolute path")
+	}
+}
+
+func TestApplyPatchesStaysInTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outside, err := ioutil.TempDir("", "gsdp-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	writeTestFiles(t, outside, map[string]string{"greet.txt": "one\ntwo\nthree\nfour\n"})
+	os.Symlink(outside, filepath.Join(dir, "out"))
+	os.Symlink(filepath.Join(outside, "greet.txt"), filepath.Join(dir, "greet.txt"))
+
+	viaDir, _ := ParsePatch("--- /dev/null\n+++ b/out/new.txt\n@@ -0,0 +1 @@\n+gotcha\n")
+	if _, err := ApplyPatches(dir, viaDir, 1, false); err == nil {
+		t.Error("Created a file through a link out of the tree")
+	}
+	viaFile, _ := ParsePatch(mockPatch)
+	if _, err := ApplyPatches(dir, viaFile[:1], 1, false); err == nil {
+		t.Error("Patched a file through a link out of the tree")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) || readTestFile(outside, "greet.txt") != "one\ntwo\nthree\nfour\n" {
+		t.Error("Files outside the tree were touched")
+	}
+
+	// Links that stay inside the tree are fine.
+	os.Mkdir(filepath.Join(dir, "src"), 0755)
+	os.Symlink("src", filepath.Join(dir, "lib"))
+	inside, _ := ParsePatch("--- /dev/null\n+++ b/lib/new.txt\n@@ -0,0 +1 @@\n+fine\n")
+	if _, err := ApplyPatches(dir, inside, 1, false); err != nil {
+		t.Errorf("Refused a link inside the tree: %v", err)
+	}
+	if got := readTestFile(dir, "src/new.txt"); got != "fine\n" {
+		t.Errorf("Bad file through an inside link: %q", got)
+	}
+}
@@ -0,0 +1,136 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"strings"
+	"time"
+)
+
+// Returns an empty payload for structured message types, or nil.
+func newPayload(msgType pb.MessageType) proto.Message {
+	switch msgType {
+	case pb.MessageType_CODE_SHARE:
+		return &pb.CodeShare{}
+	case pb.MessageType_TASK_ASSIGN:
+		return &pb.TaskAssign{}
+	case pb.MessageType_INVITATION:
+		return &pb.Invitation{}
+	case pb.MessageType_PERSONAL_NOTE:
+		return &pb.PersonalNote{}
+	case pb.MessageType_RSVP:
+		return &pb.Rsvp{}
+	case pb.MessageType_LINK:
+		return &pb.Link{}
+	}
+	return nil
+}
+
+// OpenPayload unmarshals the plaintext of a structured message. It returns
+// nil for message types whose plaintext is just text.
+func OpenPayload(msgType pb.MessageType, plaintext []byte) (proto.Message, error) {
+	p := newPayload(msgType)
+	if p == nil {
+		return nil, nil
+	}
+	if err := proto.Unmarshal(plaintext, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func joinNonEmpty(strs ...string) string {
+	lst := make([]string, 0, len(strs))
+	for _, s := range strs {
+		if len(s) > 0 {
+			lst = append(lst, s)
+		}
+	}
+	return strings.Join(lst, "\n")
+}
+
+// PayloadText returns the human-readable text of a message: the plaintext
+// itself, or the text fields of a structured payload.
+func PayloadText(msgType pb.MessageType, plaintext []byte) string {
+	if msgType == pb.MessageType_RICH_MEDIA {
+		return fmt.Sprintf("(media, %d bytes)", len(plaintext))
+	}
+	p, err := OpenPayload(msgType, plaintext)
+	if err != nil || p == nil {
+		return string(plaintext)
+	}
+	switch p := p.(type) {
+	case *pb.CodeShare:
+		return joinNonEmpty(p.Note, p.Code)
+	case *pb.TaskAssign:
+		return joinNonEmpty(p.Subject, p.Description)
+	case *pb.Invitation:
+		return joinNonEmpty(p.Subject, p.Note)
+	case *pb.PersonalNote:
+		return joinNonEmpty(p.Subject, p.Note)
+	case *pb.Rsvp:
+		return joinNonEmpty(strings.ToLower(p.Response.String()), p.Note)
+	case *pb.Link:
+		return joinNonEmpty(p.Note, p.Title, p.Url, p.Description)
+	}
+	return ""
+}
+
+// PayloadTags returns the project tags of a structured payload, if it has
+// any.
+func PayloadTags(msgType pb.MessageType, plaintext []byte) []string {
+	p, err := OpenPayload(msgType, plaintext)
+	if err != nil {
+		return nil
+	}
+	switch p := p.(type) {
+	case *pb.CodeShare:
+		return p.ProjectTags
+	case *pb.TaskAssign:
+		return p.ProjectTags
+	case *pb.Link:
+		return p.ProjectTags
+	}
+	return nil
+}
+
+// SendPayload encrypts a structured payload of the given type to to, sends
+// it, and returns the message as sent. It is archived if the client keeps
+// what it sends.
+func (c *GSDPClient) SendPayload(kind pb.MessageType, payload proto.Message, to *pb.Identity) (*pb.RawMessage, error) {
+	bs, err := proto.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.sendContent(kind, bs, to)
+}
+
+func (c *GSDPClient) sendContent(kind pb.MessageType, content []byte, to *pb.Identity) (*pb.RawMessage, error) {
+	nothin := []byte{}
+	msg := &pb.RawMessage{c.user.identity, []*pb.Identity{to}, nothin, kind, nothin, NewMsgId(), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}
+	if err := DoRawMessageEncryption(content, to, msg); err != nil {
+		return nil, err
+	}
+	err := c.Say(msg)
+	if err == nil && c.sent != nil {
+		c.sent.Add(msg, content)
+	}
+	return msg, err
+}
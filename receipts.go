@@ -0,0 +1,215 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"log"
+	"time"
+)
+
+// The delivery and read state of one message for one recipient, as told by
+// the receipts that came back for it.
+type ReceiptStatus struct {
+	MsgId     []byte
+	Recipient *pb.Identity
+	Delivered int64
+	Read      int64
+}
+
+// Receipts get ids derived from what they acknowledge, so that sending one
+// twice (e.g. every time a message is listed) delivers it only once.
+func receiptMsgId(kind pb.ReceiptType, orig *pb.RawMessage, recipient *pb.Identity) []byte {
+	h := sha256.New()
+	h.Write([]byte(kind.String() + "\n"))
+	h.Write(orig.MsgId)
+	h.Write(recipient.Ident)
+	return h.Sum(nil)[:msgIdLen]
+}
+
+// MakeReceipt builds a signed receipt of the given kind for orig, on behalf of
+// recipient, to go back to orig's sender.
+func MakeReceipt(kind pb.ReceiptType, orig *pb.RawMessage, recipient *pb.Identity, signer LocalUser) (*pb.RawMessage, error) {
+	if orig.FromIdent == nil || len(orig.MsgId) == 0 {
+		return nil, errors.New("Message has no sender or id to acknowledge")
+	}
+	r := &pb.Receipt{orig.MsgId, kind, recipient, time.Now().Unix(), []byte{}}
+	if err := SignMessage(r, &r.Signature, signer.privKey); err != nil {
+		return nil, err
+	}
+	bs, err := proto.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	nothin := []byte{}
+	return &pb.RawMessage{signer.identity, []*pb.Identity{orig.FromIdent}, nothin, pb.MessageType_RECEIPT, bs, receiptMsgId(kind, orig, recipient), nothin, time.Now().Unix(), nothin, nothin, nothin, 0, 0, false, 0, nothin, nil}, nil
+}
+
+// ParseReceipt returns the receipt in a RECEIPT message, checking only that
+// it is signed by the key of the message's sender. It says nothing about
+// whether the sender may vouch for the receipt; use OpenReceipt for that.
+func ParseReceipt(msg *pb.RawMessage) (*pb.Receipt, error) {
+	if msg.MsgType != pb.MessageType_RECEIPT || msg.FromIdent == nil {
+		return nil, errors.New("Not a receipt")
+	}
+	r := &pb.Receipt{}
+	if err := proto.Unmarshal(msg.MessageContent, r); err != nil {
+		return nil, err
+	}
+	signer := msg.FromIdent
+	if r.Recipient == nil || !bytes.Equal(BytesToIdentHash(signer.PubKey), signer.Ident) {
+		return nil, errors.New("Malformed receipt")
+	}
+	if err := VerifyMessage(r, &r.Signature, signer); err != nil {
+		return nil, errors.New("Bad receipt signature")
+	}
+	return r, nil
+}
+
+// OpenReceipt checks a RECEIPT message against sent, the message it is for,
+// and returns the receipt in it. The recipient must be one sent was
+// encrypted to. Read receipts must be signed by that recipient, and delivery
+// receipts by the server whose key the recipient's domain publishes.
+func OpenReceipt(msg *pb.RawMessage, sent *pb.RawMessage, keys DomainKeys) (*pb.Receipt, error) {
+	r, err := ParseReceipt(msg)
+	if err != nil {
+		return nil, err
+	}
+	if sent == nil || len(sent.MsgId) == 0 || !bytes.Equal(sent.MsgId, r.MsgId) {
+		return nil, errors.New("Receipt for a message we did not send")
+	}
+	var to *pb.Identity
+	for _, id := range sent.ToIdent {
+		if bytes.Equal(id.Ident, r.Recipient.Ident) {
+			to = id
+		}
+	}
+	if to == nil {
+		return nil, errors.New("Receipt from someone the message was not sent to")
+	}
+	signer := msg.FromIdent
+	switch r.Kind {
+	case pb.ReceiptType_DELIVERED:
+		key, err := keys.Get(to.Domain)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(signer.Ident, key.Ident) {
+			return nil, errors.New("Delivery receipt not from the recipient's server")
+		}
+	case pb.ReceiptType_READ:
+		if !bytes.Equal(signer.Ident, to.Ident) {
+			return nil, errors.New("Read receipt not from the recipient")
+		}
+	default:
+		return nil, errors.New("Unknown receipt kind")
+	}
+	r.Recipient = to
+	return r, nil
+}
+
+// SummarizeReceipts goes through msgs for receipts for messages in sent and
+// returns what they say about each message and recipient, in the order
+// first seen. Receipts that do not check out are skipped.
+func SummarizeReceipts(msgs []*pb.RawMessage, sent *Archive, keys DomainKeys) []*ReceiptStatus {
+	byKey := make(map[string]*ReceiptStatus)
+	lst := make([]*ReceiptStatus, 0)
+	for _, m := range msgs {
+		if m.MsgType != pb.MessageType_RECEIPT {
+			continue
+		}
+		pr, err := ParseReceipt(m)
+		if err != nil {
+			continue
+		}
+		r, err := OpenReceipt(m, sent.Message(pr.MsgId), keys)
+		if err != nil {
+			continue
+		}
+		k := string(r.MsgId) + "\n" + string(r.Recipient.Ident)
+		st, ok := byKey[k]
+		if !ok {
+			st = &ReceiptStatus{r.MsgId, r.Recipient, 0, 0}
+			byKey[k] = st
+			lst = append(lst, st)
+		}
+		if r.Kind == pb.ReceiptType_READ {
+			st.Read = r.Tstamp
+		} else {
+			st.Delivered = r.Tstamp
+		}
+	}
+	return lst
+}
+
+// SendReadReceipt tells the sender of msg that we have read it, if they
+// asked to be told.
+func (c *GSDPClient) SendReadReceipt(msg *pb.RawMessage) error {
+	if !msg.WantReceipts || msg.MsgType == pb.MessageType_RECEIPT {
+		return nil
+	}
+	r, err := MakeReceipt(pb.ReceiptType_READ, msg, c.user.identity, c.user)
+	if err != nil {
+		return err
+	}
+	return c.Say(r)
+}
+
+// Sends the sender of a message we just delivered to id a delivery receipt,
+// straight into their mailbox if they are ours. Only senders who signed the
+// message, and whose domain vouches for them, get one, so nobody can have
+// receipts sent to someone else or to a server of their choosing. Those
+// for other servers wait in a bounded queue and are dropped if it is full,
+// and are never stamped: a server that wants proof of work for them does
+// not get them.
+func (s *GSDPServer) sendDeliveryReceipt(id *pb.Identity, in *pb.RawMessage, auth senderAuth) {
+	if s.serverClient == nil || !auth.domainVerified || !in.WantReceipts || in.MsgType == pb.MessageType_RECEIPT {
+		return
+	}
+	r, err := MakeReceipt(pb.ReceiptType_DELIVERED, in, id, s.serverClient.user)
+	if err != nil {
+		log.Printf("Cannot make delivery receipt: %v", err)
+		return
+	}
+	if s.accounts.GetAccount(in.FromIdent.Ident) != nil {
+		s.deliverTo(in.FromIdent, r)
+		return
+	}
+	select {
+	case s.receipts <- r:
+	default:
+		log.Printf("Receipt queue full, dropping delivery receipt to %s", in.FromIdent.Domain)
+	}
+}
+
+// Sends queued delivery receipts to other servers until done is closed.
+func (s *GSDPServer) sendReceipts(done chan struct{}) {
+	for {
+		select {
+		case r := <-s.receipts:
+			if err := s.serverClient.say(r, false); err != nil {
+				log.Printf("Cannot send delivery receipt to %s: %v", r.ToIdent[0].Domain, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
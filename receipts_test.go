@@ -0,0 +1,140 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestReceipts(t *testing.T) {
+	sid, sk, _ := makeAnIdentity()
+	sid.Handle = ServerHandle
+	key := MakeLocalUser(sid, sk)
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{ServerKey: &key, Domain: "testname", Identities: NewInMemoryIdentStore()})
+	defer gs.connectionPool.Close()
+	from, fromk, _ := makeAnIdentity()
+	to, tok, _ := makeAnIdentity()
+	to.Handle = "recip"
+	for _, id := range []*pb.Identity{from, to} {
+		gs.knownUsers.AddIdentity(id)
+		gs.accounts.PutAccount(&pb.Account{Ident: id})
+	}
+
+	msg := makeMockMessage(from, to)
+	msg.WantReceipts = true
+	SignRawMessage(msg, fromk)
+	gs.Say(context.Background(), msg)
+	got := gs.mailboxes.Get(IdentToString(from.Ident), false)
+	if len(got) != 1 {
+		t.Fatalf("Sender got %d messages, wanted a delivery receipt", len(got))
+	}
+	keys := NewDomainKeyStore(nil)
+	keys.Put("testname", sid)
+	if r, err := OpenReceipt(got[0], msg, keys); err != nil || r.Kind != pb.ReceiptType_DELIVERED {
+		t.Errorf("Bad delivery receipt: %v %v", r, err)
+	}
+
+	// Anyone can call themselves _server; only the published key counts.
+	oid, ok, _ := makeAnIdentity()
+	oid.Handle = ServerHandle
+	fakeDelivered, _ := MakeReceipt(pb.ReceiptType_DELIVERED, msg, to, MakeLocalUser(oid, ok))
+	if _, err := OpenReceipt(fakeDelivered, msg, keys); err == nil {
+		t.Error("Accepted a delivery receipt not signed with the domain's key")
+	}
+
+	read, _ := MakeReceipt(pb.ReceiptType_READ, msg, to, MakeLocalUser(to, tok))
+	forged, _ := MakeReceipt(pb.ReceiptType_READ, msg, to, key)
+	if _, err := OpenReceipt(forged, msg, keys); err == nil {
+		t.Error("Accepted a read receipt not from the recipient")
+	}
+	// A read receipt signed by whoever it names, but for someone the
+	// message never went to.
+	stranger, strangerk, _ := makeAnIdentity()
+	selfSigned, _ := MakeReceipt(pb.ReceiptType_READ, msg, stranger, MakeLocalUser(stranger, strangerk))
+	if _, err := OpenReceipt(selfSigned, msg, keys); err == nil {
+		t.Error("Accepted a read receipt from someone the message was not sent to")
+	}
+	if _, err := OpenReceipt(read, makeMockMessage(from, to), keys); err == nil {
+		t.Error("Accepted a receipt for another message")
+	}
+
+	sent, _ := NewArchive(MakeLocalUser(from, fromk))
+	sts := SummarizeReceipts(append(got, read, forged, selfSigned, fakeDelivered), sent, keys)
+	if len(sts) != 0 {
+		t.Errorf("Summarized receipts for messages we did not send: %v", sts)
+	}
+	sent.Add(msg, []byte("hi"))
+	sts = SummarizeReceipts(append(got, read, forged, selfSigned, fakeDelivered), sent, keys)
+	if len(sts) != 1 || sts[0].Delivered == 0 || sts[0].Read == 0 {
+		t.Errorf("Bad receipt summary: %v", sts)
+	}
+
+	plain := makeMockMessage(from, to)
+	SignRawMessage(plain, fromk)
+	gs.Say(context.Background(), plain)
+	unsigned := makeMockMessage(from, to)
+	unsigned.WantReceipts = true
+	gs.Say(context.Background(), unsigned)
+	if n, _ := gs.mailboxes.Stat(IdentToString(from.Ident)); n != 1 {
+		t.Error("Got a receipt without asking for one, or for an unsigned message")
+	}
+}
+
+func TestRemoteReceiptsAreQueued(t *testing.T) {
+	sid, sk, _ := makeAnIdentity()
+	sid.Handle = ServerHandle
+	key := MakeLocalUser(sid, sk)
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{ServerKey: &key, Domain: "testname", Identities: NewInMemoryIdentStore()})
+	defer gs.connectionPool.Close()
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+
+	// Without its server vouching for the sender, nothing goes to the
+	// domain the message claims to be from.
+	from, fromk, _ := makeAnIdentity()
+	from.Domain = "remote.com"
+	msg := makeMockMessage(from, to)
+	msg.WantReceipts = true
+	SignRawMessage(msg, fromk)
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Fatalf("Say failed: %s", ack.Error)
+	}
+	if len(gs.receipts) != 0 {
+		t.Error("Queued a receipt for a sender no server vouched for")
+	}
+
+	// The sender has no account here, so receipts wait for a worker; with
+	// none running, those past the queue's size are dropped, not blocked on.
+	ctx := context.WithValue(context.Background(), peerDomainKey, "remote.com")
+	for i := 0; i < receiptQueueSize+10; i++ {
+		msg := makeMockMessage(from, to)
+		msg.WantReceipts = true
+		SignRawMessage(msg, fromk)
+		if ack, _ := gs.Say(ctx, msg); ack.IsError {
+			t.Fatalf("Say failed: %s", ack.Error)
+		}
+	}
+	if len(gs.receipts) != receiptQueueSize {
+		t.Errorf("Queued %d receipts, wanted %d", len(gs.receipts), receiptQueueSize)
+	}
+}
@@ -17,86 +17,249 @@
 package gsdp
 
 import (
+	"bytes"
+	"github.com/golang/protobuf/proto"
 	pb "github.com/jwvictor/gsdprotocol"
 	"log"
 	"errors"
 	"fmt"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/reflection"
 	"net"
-	"sync"
+	"net/http"
+	"strings"
+	"time"
 )
 
 const (
 	port = ":50051"
+
+	// Most messages GetMine returns at once.
+	maxPageSize = 1000
+
+	// How often expired messages are swept out of mailboxes.
+	expirySweepFrequency = time.Minute
+
+	// Delivery receipts waiting to go to other servers, and how many are
+	// sent at once.
+	receiptQueueSize = 256
+	receiptWorkers   = 4
 )
 
 type GSDPServer struct {
-	localUsers    map[string]LocalUser
 	ongoingBlocks map[string][]*pb.RawMessage
-	knownUsers      IdentityStore
-	updateBuffer    map[string][]*pb.RawMessage
-	clients         map[string]*GSDPClient
-	privateKeyStore PrivateKeyStore
-	bufMutex        *sync.Mutex
-	connectionPool  *ConnectionPool
+	knownUsers     IdentityStore
+	mailboxes      MailboxStore
+	accounts       AccountStore
+	serverClient   *GSDPClient
+	serverIdent    *pb.Identity
+	domain         string
+	openReg        bool
+	connectionPool *ConnectionPool
+	domainKeys     *DomainKeyStore
+	limits         Limits
+	senderLimiter  *RateLimiter
+	domainLimiter  *RateLimiter
+	stampBits      int32
+	dedup          *DedupWindow
+	spentStamps    *SpentStamps
+	bridge         *Bridge
+	receipts       chan *pb.RawMessage
+}
+
+// ServerOptions holds the stores and settings a GSDPServer runs with. The
+// server only ever sees users' public identities; ServerKey is the server's
+// domain identity, published through Name and used to sign requests to other
+// servers, which go through a pool built from PoolOptions. The admin service is
+// only started if AdminPort is set; it serves TLS with AdminTLSCert and
+// AdminTLSKey, and without them only listens on loopback. With OpenRegistration, anyone holding
+// the key for an identity on Domain may register it themselves. StampBits is
+// the proof-of-work asked of senders our users haven't granted permissions;
+// SpentStamps, if given, keeps the stamps used across restarts.
+// The HTTP bridge for BridgeServices is only started if BridgePort is set;
+// it serves TLS with BridgeTLSCert and BridgeTLSKey, and without them only
+// listens on loopback. Webhooks set over the bridge are kept in
+// BridgeWebhooks.
+type ServerOptions struct {
+	ServerKey        *LocalUser
+	Domain           string
+	Identities       IdentityStore
+	Mailboxes        MailboxStore
+	Accounts         AccountStore
+	PoolOptions      PoolOptions
+	DomainPolicy     DomainPolicy
+	Limits           Limits
+	AdminPort        string
+	AdminTLSCert     string
+	AdminTLSKey      string
+	Admins           []*pb.Identity
+	OpenRegistration bool
+	StampBits        int
+	SpentStamps      *SpentStamps
+	BridgePort       string
+	BridgeTLSCert    string
+	BridgeTLSKey     string
+	BridgeServices   []*BridgeService
+	BridgeWebhooks   *WebhookStore
+}
+
+// A Server is a running GSDP server that can be shut down.
+type Server struct {
+	grpcServer  *grpc.Server
+	gsdp        *GSDPServer
+	lis         net.Listener
+	adminServer *grpc.Server
+	adminLis    net.Listener
+	bridgeHTTP  *http.Server
+	bridgeLis   net.Listener
+	done        chan struct{}
 }
 
 func (s *GSDPServer) Sup(ctx context.Context, in *pb.RequestPermissions) (*pb.UserPermissions, error) {
-	// Immediately accept and return good permissions.
-	s.knownUsers.AddIdentity(in.RequestedPermissions.Ident)
-	newperms := &pb.UserPermissions{in.ToIdent, "promiscuous", 100, true, true, true, true, true, true}
+	if in.ToIdent == nil || in.RequestedPermissions == nil || in.RequestedPermissions.Ident == nil {
+		return nil, errors.New("Incomplete permissions request")
+	}
+	from := in.RequestedPermissions.Ident
+	// Granting permissions makes a lasting contact, so only the holder of
+	// the key may ask for them.
+	if !inAuthWindow(in.Tstamp) || VerifyMessage(in, &in.Signature, from) != nil {
+		return nil, errors.New("Permissions request not signed by the requester")
+	}
+	auth := senderAuth{true, s.vouchesFor(ctx, from)}
 	toid := s.knownUsers.GetIdentityForHandleDomain(in.ToIdent.Handle, in.ToIdent.Domain)
-	if toid != nil {
-		client, err2 := s.getClient(toid.Ident)
-		if err2 != nil {
-			return nil, errors.New("Cannot contact server regarding permissions")
-		}
-		// Immediately respond ok
-		client.SendK(in.RequestedPermissions)
-	} else {
+	if toid == nil {
 		return nil, errors.New("Unknown user")
 	}
-	return newperms, nil
+	if rule := s.filterFor(toid, from, auth); rule != nil && rule.Action == pb.FilterAction_BLOCK {
+		if rule.Silent {
+			return nil, errors.New("Unknown user")
+		}
+		return nil, errors.New("Blocked by user")
+	}
+	if s.needsStamp(toid, from, auth) {
+		res := permissionsStampResource(in)
+		if !stampInWindow(in.Tstamp) || !CheckStamp(res, in.Stamp, int(s.stampBits)) {
+			return nil, fmt.Errorf("Proof-of-work stamp of %d bits required", s.stampBits)
+		}
+		if !s.spentStamps.Spend(spentStampKey(res, in.Stamp), in.Tstamp) {
+			return nil, errors.New("Proof-of-work stamp already used")
+		}
+	}
+	// Only remember who asked if their domain vouches for the name they
+	// gave; anyone can make a key and call it anything.
+	if auth.domainVerified {
+		s.knownUsers.AddIdentity(from)
+	}
+	// Nothing is granted until the user grants it; until then the requester
+	// is no contact and still pays stamps.
+	return &pb.UserPermissions{Ident: in.ToIdent, SetName: "requested"}, nil
 }
 
 func (s *GSDPServer) tryGetPermissions(me *pb.Identity, handle string, domain string) *pb.Identity {
 	return nil
 }
 
-func (s *GSDPServer) getClient(ident []byte) (*GSDPClient, error) {
-	if _, ok := s.clients[IdentToString(ident)]; !ok {
-		if lu, okk := s.localUsers[IdentToString(ident)]; okk {
-			cc := NewClient(&lu, s.knownUsers, s.connectionPool)
-			c := &cc
-			s.clients[IdentToString(ident)] = c
+// Checks that a request comes from the holder of a registered local user's
+// private key. Returns the user's account.
+func (s *GSDPServer) authenticateLocal(in proto.Message, from *pb.Identity, tstamp int64, proof *[]byte) (*pb.Account, error) {
+	if from == nil {
+		return nil, errors.New("No identity given")
+	}
+	acct := s.accounts.GetAccount(from.Ident)
+	if acct == nil {
+		return nil, errors.New("No such local user")
+	}
+	if !inAuthWindow(tstamp) {
+		return nil, errors.New("Request timestamp out of range")
+	}
+	if err := VerifyMessage(in, proof, acct.Ident); err != nil {
+		return nil, errors.New("Bad proof of identity")
+	}
+	if acct.Suspended {
+		return nil, errors.New("Account suspended")
+	}
+	return acct, nil
+}
+
+// Gives id its name for a new local account. A name another local account
+// has is not given up; one some other key only had from elsewhere is.
+func (s *GSDPServer) claimName(id *pb.Identity) error {
+	if other := s.knownUsers.GetIdentityForHandleDomain(id.Handle, id.Domain); other != nil && !bytes.Equal(other.Ident, id.Ident) {
+		if s.accounts.GetAccount(other.Ident) != nil {
+			return errors.New("handle is taken")
 		}
+		if err := s.knownUsers.RemoveIdentity(other.Ident); err != nil {
+			return err
+		}
+	}
+	return s.knownUsers.AddIdentity(id)
+}
+
+func (s *GSDPServer) Register(ctx context.Context, in *pb.Registration) (*pb.MessageAck, error) {
+	if !s.openReg {
+		return &pb.MessageAck{true, "registration is closed, ask an admin", 0}, nil
+	}
+	if in.Ident == nil || strings.ToLower(in.Ident.Domain) != strings.ToLower(s.domain) {
+		return &pb.MessageAck{true, "identity is not on this domain", 0}, nil
+	}
+	if !inAuthWindow(in.Tstamp) {
+		return &pb.MessageAck{true, "request timestamp out of range", 0}, nil
+	}
+	if err := VerifyMessage(in, &in.Signature, in.Ident); err != nil {
+		return &pb.MessageAck{true, "bad proof of possession", 0}, nil
 	}
-	return s.clients[IdentToString(ident)], nil
+	if s.accounts.GetAccount(in.Ident.Ident) != nil {
+		return &pb.MessageAck{false, "already registered", 0}, nil
+	}
+	if err := s.claimName(in.Ident); err != nil {
+		return &pb.MessageAck{true, err.Error(), 0}, nil
+	}
+	if err := s.accounts.PutAccount(&pb.Account{in.Ident, false, 0, 0, time.Now().Unix(), nil, nil}); err != nil {
+		return &pb.MessageAck{true, err.Error(), 0}, nil
+	}
+	return &pb.MessageAck{false, "OK", 0}, nil
 }
 
 func (s *GSDPServer) GetMine(ctx context.Context, in *pb.GetRequest) (*pb.PendingData, error) {
-	id := IdentToString(in.FromIdent.Ident)
-	if _, ok := s.localUsers[id]; !ok {
-		fmt.Printf("Never heard of %s -- adding user.\n", id)
-		pk := s.privateKeyStore.GetKeyFor(in.FromIdent.Ident)
-		if pk != nil {
-			s.localUsers[id] = LocalUser{in.FromIdent, *pk}
-		} else {
-			fmt.Printf("No such local users, assuming remote client. This needs to be authenticated.\n") // TODO: AUTH
-		}
+	if _, err := s.authenticateLocal(in, in.FromIdent, in.Tstamp, &in.ProofOfIdent); err != nil {
+		return nil, err
+	}
+	box := IdentToString(in.FromIdent.Ident)
+	limit := int(in.Limit)
+	if limit <= 0 || limit > maxPageSize {
+		limit = maxPageSize
 	}
 	msgs := make([]*pb.RawMessage, 0)
-	s.bufMutex.Lock()
-	if bmsgs, ok := s.updateBuffer[id]; ok {
-		msgs = bmsgs
-		if in.Purge {
-			s.updateBuffer[id] = make([]*pb.RawMessage, 0)
+	next, more := in.AfterSeq, false
+	now := time.Now().Unix()
+	for _, m := range s.mailboxes.After(box, in.AfterSeq) {
+		if len(msgs) == limit {
+			more = true
+			break
+		}
+		next = m.Seq
+		if m.ReceivedUtc >= in.SinceUtc && !Expired(m, now) && (len(in.Tags) == 0 || HasAnyTag(m.Tags, in.Tags)) {
+			msgs = append(msgs, m)
+		}
+	}
+	if in.Purge {
+		seqs := make([]uint64, 0, len(msgs))
+		for _, m := range msgs {
+			seqs = append(seqs, m.Seq)
 		}
+		s.mailboxes.Ack(box, seqs)
 	}
-	s.bufMutex.Unlock()
-	return &pb.PendingData{in.FromIdent, in.SinceUtc, msgs}, nil
+	return &pb.PendingData{in.FromIdent, in.SinceUtc, msgs, next, more}, nil
+}
+
+func (s *GSDPServer) Ack(ctx context.Context, in *pb.AckRequest) (*pb.MessageAck, error) {
+	if _, err := s.authenticateLocal(in, in.FromIdent, in.Tstamp, &in.ProofOfIdent); err != nil {
+		return nil, err
+	}
+	n := s.mailboxes.Ack(IdentToString(in.FromIdent.Ident), in.Seqs)
+	return &pb.MessageAck{false, fmt.Sprintf("%d deleted", n), 0}, nil
 }
 
 func (s *GSDPServer) LeaveBlock(ctx context.Context, in *pb.BlockLeaveRequest) (*pb.BlockStatusChangeResponse, error) {
@@ -109,28 +272,177 @@ func (s *GSDPServer) StartBlock(ctx context.Context, in *pb.BlockStartRequest) (
 
 func (s *GSDPServer) K(ctx context.Context, in *pb.ApprovePermissions) (*pb.UserPermissions, error) {
 	bs := []byte{1, 2, 3}
-	fmt.Printf("Got approval! %v\n", in)
+	domain, _ := PeerDomain(ctx)
+	fmt.Printf("Got approval from %s! %v\n", domain, in)
 	return &pb.UserPermissions{&pb.Identity{bs, "@test", " ", "", bs, ""}, "custom", 4, true, false, true, true, true, true}, nil
 }
 
 func (s *GSDPServer) Btw(ctx context.Context, in *pb.ApprovePermissions) (*pb.MessageAck, error) {
-	return &pb.MessageAck{true, "big prob"}, nil
+	return &pb.MessageAck{true, "big prob", 0}, nil
 }
 
 func (s *GSDPServer) deliverTo(id *pb.Identity, in *pb.RawMessage) (*pb.MessageAck, error) {
 	idk := IdentToString(id.Ident)
-	s.bufMutex.Lock()
-	buf, ok := s.updateBuffer[idk]
-	if ok {
-		s.updateBuffer[idk] = append(buf, in)
-	} else {
-		s.updateBuffer[idk] = []*pb.RawMessage{in}
+	acct := s.accounts.GetAccount(id.Ident)
+	// Only our own users and bridge services have mailboxes here; anyone
+	// else we know of, e.g. from a permissions request, is someone else's.
+	if acct == nil && (s.bridge == nil || s.bridge.byIdent[idk] == nil) {
+		return &pb.MessageAck{true, "no such local user", 0}, nil
+	}
+	if acct != nil && acct.Suspended {
+		return &pb.MessageAck{true, "recipient account suspended", 0}, nil
+	}
+	// A message we already have is a retry, so it is acknowledged again but
+	// not delivered twice.
+	if dup, conflict := s.dedup.See(idk, in.MsgId, in.FromIdent.Ident); dup {
+		if conflict {
+			return &pb.MessageAck{true, "duplicate message id", 0}, nil
+		}
+		return &pb.MessageAck{false, "", 0}, nil
+	}
+	maxMsgs, maxBytes := s.limits.quotaFor(id, acct)
+	count, size := s.mailboxes.Stat(idk)
+	if maxMsgs > 0 && count >= maxMsgs {
+		s.dedup.Forget(idk, in.MsgId)
+		return &pb.MessageAck{true, fmt.Sprintf("recipient mailbox full (%d messages)", maxMsgs), 0}, nil
+	}
+	if maxBytes > 0 && size+int64(proto.Size(in)) > maxBytes {
+		s.dedup.Forget(idk, in.MsgId)
+		return &pb.MessageAck{true, fmt.Sprintf("recipient mailbox full (%d bytes)", maxBytes), 0}, nil
+	}
+	if err := s.mailboxes.Deliver(idk, in); err != nil {
+		s.dedup.Forget(idk, in.MsgId)
+		return &pb.MessageAck{true, err.Error(), 0}, err
+	}
+	if s.bridge != nil {
+		s.bridge.notify(id, in)
+	}
+	return &pb.MessageAck{false, "", 0}, nil
+}
+
+// What the server could check about who sent a message. A sender is
+// verified if the message is signed with the key behind its FromIdent. Its
+// handle and domain are only vouched for if it is one of ours, or the
+// message came signed by the server for its domain.
+type senderAuth struct {
+	verified       bool
+	domainVerified bool
+}
+
+func (s *GSDPServer) authenticateSender(ctx context.Context, in *pb.RawMessage) senderAuth {
+	if in.FromIdent == nil || VerifyRawMessage(in) != nil {
+		return senderAuth{}
+	}
+	return senderAuth{true, s.vouchesFor(ctx, in.FromIdent)}
+}
+
+// Whether the handle and domain of an identity whose key has been checked
+// are vouched for: by the server of its domain having signed the request, or
+// by us, for our users, our own identity and our bridge services.
+func (s *GSDPServer) vouchesFor(ctx context.Context, from *pb.Identity) bool {
+	if d, ok := PeerDomain(ctx); ok && d == strings.ToLower(from.Domain) {
+		return true
+	}
+	if strings.ToLower(from.Domain) != strings.ToLower(s.domain) {
+		return false
+	}
+	if acct := s.accounts.GetAccount(from.Ident); acct != nil && acct.Ident.Handle == from.Handle {
+		return true
+	}
+	if s.serverIdent != nil && bytes.Equal(from.Ident, s.serverIdent.Ident) {
+		return true
+	}
+	if s.bridge != nil {
+		_, ok := s.bridge.byIdent[IdentToString(from.Ident)]
+		return ok
 	}
-	s.bufMutex.Unlock()
-	return &pb.MessageAck{false, ""}, nil
+	return false
+}
+
+// The host a request came from, which unauthenticated traffic is charged to.
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// Takes a token for the sender and for the domain the message came from.
+// Only verified senders get a bucket of their own, and only a domain that
+// signed the request or vouches for the sender is charged; everything else
+// is charged to the address it came from.
+func (s *GSDPServer) checkRate(ctx context.Context, from *pb.Identity, auth senderAuth) *pb.MessageAck {
+	if from == nil {
+		return &pb.MessageAck{true, "no sender identity", 0}
+	}
+	addr := "addr:" + peerAddr(ctx)
+	sender, u := addr, s.limits.forUser("", "")
+	if auth.verified {
+		sender = IdentToString(from.Ident)
+	}
+	if auth.domainVerified {
+		u = s.limits.forUser(from.Handle, from.Domain)
+	}
+	if !s.senderLimiter.Allow(sender, u.SenderRate) {
+		return &pb.MessageAck{true, "rate limit exceeded for sender " + from.Handle + "\\" + from.Domain, 0}
+	}
+	domain, ok := PeerDomain(ctx)
+	if !ok && auth.domainVerified {
+		domain, ok = strings.ToLower(from.Domain), true
+	}
+	if !ok {
+		domain = addr
+	}
+	if !s.domainLimiter.Allow(domain, s.limits.DomainRate) {
+		return &pb.MessageAck{true, "rate limit exceeded for domain " + domain, 0}
+	}
+	return nil
 }
 
 func (s *GSDPServer) Say(ctx context.Context, in *pb.RawMessage) (*pb.MessageAck, error) {
+	if in.FromIdent != nil {
+		if acct := s.accounts.GetAccount(in.FromIdent.Ident); acct != nil && acct.Suspended {
+			return &pb.MessageAck{true, "sender account suspended", 0}, nil
+		}
+	}
+	auth := s.authenticateSender(ctx, in)
+	if ack := s.checkRate(ctx, in.FromIdent, auth); ack != nil {
+		return ack, nil
+	}
+	if Expired(in, time.Now().Unix()) {
+		return &pb.MessageAck{true, "message already expired", 0}, nil
+	}
+	res := messageStampResource(in)
+	stamped := s.stampBits > 0 && stampInWindow(in.Tstamp) && CheckStamp(res, in.Stamp, int(s.stampBits))
+	if len(in.MsgId) == 0 {
+		in.MsgId = ContentMsgId(in)
+	} else if len(in.MsgId) > maxMsgIdLen {
+		return &pb.MessageAck{true, "message id too long", 0}, nil
+	}
+	if err := checkTags(in.Tags); err != nil {
+		return &pb.MessageAck{true, err.Error(), 0}, nil
+	}
+	// A stamp covers one message, so one seen before is that message again:
+	// a retry, or a replay, and either way already delivered. If the
+	// message is refused after all, the stamp is given back so that a retry
+	// is not taken for delivered.
+	stampKey := ""
+	if stamped {
+		stampKey = spentStampKey(res, in.Stamp)
+		if !s.spentStamps.Spend(stampKey, in.Tstamp) {
+			return &pb.MessageAck{false, "OK", 0}, nil
+		}
+	}
+	refuse := func(ack *pb.MessageAck, err error) (*pb.MessageAck, error) {
+		if stamped {
+			s.spentStamps.Forget(stampKey)
+		}
+		return ack, err
+	}
 	for _, r := range in.ToIdent {
 		toid := s.knownUsers.GetIdentityForHandleDomain(r.Handle, r.Domain)
 		ok := (toid != nil)
@@ -138,47 +450,217 @@ func (s *GSDPServer) Say(ctx context.Context, in *pb.RawMessage) (*pb.MessageAck
 			// TODO: need to get such identity from name server and
 			// add it to the local store
 			//perms := s.tryGetPermissions(in.FromIdent, r.Handle, r.Domain)
-			return &pb.MessageAck{true, "could not resolve user"}, nil
+			return refuse(&pb.MessageAck{true, "could not resolve user", 0}, nil)
 		}
-		s.deliverTo(toid, in)
+		if rule := s.filterFor(toid, in.FromIdent, auth); rule != nil && rule.Action == pb.FilterAction_BLOCK {
+			if rule.Silent {
+				continue
+			}
+			return refuse(&pb.MessageAck{true, "blocked by recipient", 0}, nil)
+		}
+		if !stamped && s.needsStamp(toid, in.FromIdent, auth) {
+			return &pb.MessageAck{true, fmt.Sprintf("proof-of-work stamp of %d bits required", s.stampBits), s.stampBits}, nil
+		}
+		if ack, err := s.deliverTo(toid, in); err != nil || ack.IsError {
+			return refuse(ack, err)
+		}
+		s.sendDeliveryReceipt(toid, in, auth)
 	}
-	return &pb.MessageAck{false, "OK"}, nil
+	return &pb.MessageAck{false, "OK", 0}, nil
 }
 
 func (s *GSDPServer) Name(ctx context.Context, in *pb.NameInquiry) (*pb.NameResponse, error) {
-	fmt.Printf("Looking up %s in %v \n", in.RequestHandle, s.localUsers)
-	if u, ok := s.localUsers[in.RequestHandle]; ok {
-		return &pb.NameResponse{false, u.identity, ""}, nil
+	fmt.Printf("Looking up %s\\%s\n", in.RequestHandle, in.RequestDomain)
+	// The domain key is only ever ours, never a user who took its name.
+	if in.RequestHandle == ServerHandle {
+		if s.serverIdent == nil || strings.ToLower(in.RequestDomain) != strings.ToLower(s.domain) {
+			return &pb.NameResponse{true, nil, "", s.stampBits}, nil
+		}
+		return &pb.NameResponse{false, s.serverIdent, "", s.stampBits}, nil
 	} else if theid := s.knownUsers.GetIdentityForHandleDomain(in.RequestHandle, in.RequestDomain); theid != nil {
-		return &pb.NameResponse{false, theid, ""}, nil
+		return &pb.NameResponse{false, theid, "", s.stampBits}, nil
 	} else {
-		return &pb.NameResponse{true, nil, ""}, nil
+		return &pb.NameResponse{true, nil, "", s.stampBits}, nil
 	}
 }
 
-func (s *GSDPServer) Initialize(pks PrivateKeyStore, idStore IdentityStore, connPool *ConnectionPool) error {
-	s.localUsers = make(map[string]LocalUser)
-	s.knownUsers = idStore
-	s.updateBuffer = make(map[string][]*pb.RawMessage)
-	s.bufMutex = &sync.Mutex{}
-	s.connectionPool = connPool
-	s.privateKeyStore = pks
+func (s *GSDPServer) Initialize(opts ServerOptions) error {
+	s.knownUsers = opts.Identities
+	s.mailboxes = opts.Mailboxes
+	if s.mailboxes == nil {
+		s.mailboxes = NewInMemoryMailboxStore()
+	}
+	s.accounts = opts.Accounts
+	if s.accounts == nil {
+		s.accounts = NewInMemoryAccountStore()
+	}
+	s.domain = opts.Domain
+	s.openReg = opts.OpenRegistration
+	s.limits = opts.Limits
+	s.stampBits = int32(opts.StampBits)
+	s.mailboxes.Expire(time.Now().Unix())
+	s.dedup = NewDedupWindow(dedupWindowSize)
+	s.spentStamps = opts.SpentStamps
+	if s.spentStamps == nil {
+		s.spentStamps = NewSpentStamps()
+	}
+	for _, box := range s.mailboxes.List() {
+		for _, m := range s.mailboxes.Get(box, false) {
+			if m.FromIdent != nil {
+				s.dedup.See(box, m.MsgId, m.FromIdent.Ident)
+			}
+		}
+	}
+	s.senderLimiter = NewRateLimiter()
+	s.domainLimiter = NewRateLimiter()
+	s.receipts = make(chan *pb.RawMessage, receiptQueueSize)
+	popts := opts.PoolOptions
+	if opts.ServerKey != nil {
+		popts.UnaryInterceptors = append(popts.UnaryInterceptors, DomainSigningInterceptor(opts.ServerKey, opts.Domain))
+	}
+	s.connectionPool = NewConnectionPoolWithOptions(popts)
+	s.domainKeys = NewDomainKeyStore(s.connectionPool)
+	if opts.ServerKey != nil {
+		s.serverIdent = opts.ServerKey.identity
+		s.domainKeys.Put(opts.Domain, opts.ServerKey.identity)
+		c := NewClient(opts.ServerKey, s.knownUsers, s.connectionPool)
+		s.serverClient = &c
+	}
 	return nil
 }
 
-func Serve(port string, pks PrivateKeyStore, idStore IdentityStore, cp *ConnectionPool) {
+func NewServer(port string, opts ServerOptions) (*Server, error) {
 	lis, err := net.Listen("tcp", port)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		return nil, err
 	}
-	s := grpc.NewServer()
-	gs := GSDPServer{}
-	gs.Initialize(pks, idStore, cp)
-	pb.RegisterGSDPServer(s, &gs)
+	gs := &GSDPServer{}
+	gs.Initialize(opts)
+	gs.connectionPool.Start()
+	s := grpc.NewServer(grpc.UnaryInterceptor(DomainVerifyingInterceptor(gs.domainKeys, opts.DomainPolicy, opts.Domain)))
+	pb.RegisterGSDPServer(s, gs)
 	// Register reflection service on gRPC server.
 	reflection.Register(s)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("failed to serve: %v", err)
+	srv := &Server{s, gs, lis, nil, nil, nil, nil, make(chan struct{})}
+	if len(opts.AdminPort) > 0 {
+		alis, aopts, err := listenAdmin(opts.AdminPort, opts.AdminTLSCert, opts.AdminTLSKey)
+		if err != nil {
+			lis.Close()
+			gs.connectionPool.Close()
+			return nil, err
+		}
+		as := grpc.NewServer(aopts...)
+		pb.RegisterGSDPAdminServer(as, newAdminServer(gs, opts.Admins))
+		srv.adminServer = as
+		srv.adminLis = alis
+	}
+	if len(opts.BridgePort) > 0 {
+		blis, err := listenBridge(opts.BridgePort, opts.BridgeTLSCert, opts.BridgeTLSKey)
+		var b *Bridge
+		if err == nil {
+			if b, err = NewBridge(gs, opts.BridgeServices, opts.BridgeWebhooks); err != nil {
+				blis.Close()
+			}
+		}
+		if err != nil {
+			lis.Close()
+			if srv.adminLis != nil {
+				srv.adminLis.Close()
+			}
+			gs.connectionPool.Close()
+			return nil, err
+		}
+		srv.bridgeHTTP = &http.Server{Handler: b}
+		srv.bridgeLis = blis
+	}
+	return srv, nil
+}
+
+func (s *Server) sweepExpired() {
+	t := time.NewTicker(expirySweepFrequency)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if n := s.gsdp.mailboxes.Expire(time.Now().Unix()); n > 0 {
+				log.Printf("Dropped %d expired messages", n)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Serve blocks accepting connections until the server is stopped.
+func (s *Server) Serve() error {
+	go s.sweepExpired()
+	if s.gsdp.serverClient != nil {
+		for i := 0; i < receiptWorkers; i++ {
+			go s.gsdp.sendReceipts(s.done)
+		}
+	}
+	if s.adminServer != nil {
+		go func() {
+			if err := s.adminServer.Serve(s.adminLis); err != nil {
+				log.Printf("admin service failed: %v", err)
+			}
+		}()
 	}
+	if s.bridgeHTTP != nil {
+		go func() {
+			if err := s.bridgeHTTP.Serve(s.bridgeLis); err != nil && err != http.ErrServerClosed {
+				log.Printf("HTTP bridge failed: %v", err)
+			}
+		}()
+	}
+	return s.grpcServer.Serve(s.lis)
 }
 
+// GracefulStop stops accepting new RPCs and waits for in-flight ones to
+// finish, or until ctx is done, at which point they are cut off. Either way
+// the server's outbound connections are closed and the mailbox store flushed.
+func (s *Server) GracefulStop(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		if s.bridgeHTTP != nil {
+			s.bridgeHTTP.Shutdown(ctx)
+			s.gsdp.bridge.Stop()
+		}
+		if s.adminServer != nil {
+			s.adminServer.GracefulStop()
+		}
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if s.adminServer != nil {
+			s.adminServer.Stop()
+		}
+		s.grpcServer.Stop()
+		<-stopped
+		err = ctx.Err()
+	}
+	close(s.done)
+	s.gsdp.connectionPool.Close()
+	s.gsdp.mailboxes.Expire(time.Now().Unix())
+	if ferr := s.gsdp.mailboxes.Flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+func Serve(port string, opts ServerOptions) error {
+	s, err := NewServer(port, opts)
+	if err != nil {
+		log.Printf("failed to listen: %v", err)
+		return err
+	}
+	if err := s.Serve(); err != nil {
+		log.Printf("failed to serve: %v", err)
+		return err
+	}
+	return nil
+}
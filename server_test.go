@@ -0,0 +1,167 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"testing"
+	"time"
+)
+
+func getMockServer(openReg bool) *GSDPServer {
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{Identities: NewInMemoryIdentStore(), Domain: "testname", OpenRegistration: openReg})
+	return gs
+}
+
+func signedGet(id *pb.Identity, privk []byte) *pb.GetRequest {
+	get := &pb.GetRequest{FromIdent: id, Tstamp: time.Now().Unix()}
+	SignMessage(get, &get.ProofOfIdent, privk)
+	return get
+}
+
+func TestRegisterNeedsProofOfPossession(t *testing.T) {
+	gs := getMockServer(true)
+	id, privk, _ := makeAnIdentity()
+	_, otherk, _ := makeAnIdentity()
+	reg := &pb.Registration{id, time.Now().Unix(), nil}
+	SignMessage(reg, &reg.Signature, otherk)
+	if ack, _ := gs.Register(context.Background(), reg); !ack.IsError {
+		t.Error("Registered without holding the key")
+	}
+	SignMessage(reg, &reg.Signature, privk)
+	if ack, _ := gs.Register(context.Background(), reg); ack.IsError {
+		t.Errorf("Registration failed: %s", ack.Error)
+	}
+	if gs.accounts.GetAccount(id.Ident) == nil {
+		t.Error("No account after registration")
+	}
+	closed := getMockServer(false)
+	if ack, _ := closed.Register(context.Background(), reg); !ack.IsError {
+		t.Error("Registered on a closed server")
+	}
+}
+
+func TestGetMineNeedsProofOfIdent(t *testing.T) {
+	gs := getMockServer(true)
+	id, privk, _ := makeAnIdentity()
+	_, otherk, _ := makeAnIdentity()
+	if _, err := gs.GetMine(context.Background(), signedGet(id, privk)); err == nil {
+		t.Error("Got mail for an unregistered user")
+	}
+	gs.accounts.PutAccount(&pb.Account{Ident: id})
+	if _, err := gs.GetMine(context.Background(), signedGet(id, otherk)); err == nil {
+		t.Error("Got mail with someone else's key")
+	}
+	stale := &pb.GetRequest{FromIdent: id, Tstamp: time.Now().Unix() - 2*authWindow}
+	SignMessage(stale, &stale.ProofOfIdent, privk)
+	if _, err := gs.GetMine(context.Background(), stale); err == nil {
+		t.Error("Accepted a stale request")
+	}
+	if _, err := gs.GetMine(context.Background(), signedGet(id, privk)); err != nil {
+		t.Errorf("Rejected a good request: %v", err)
+	}
+}
+
+func TestGetMinePagesAndAcks(t *testing.T) {
+	gs := getMockServer(true)
+	id, privk, _ := makeAnIdentity()
+	gs.knownUsers.AddIdentity(id)
+	gs.accounts.PutAccount(&pb.Account{Ident: id})
+	for i := 0; i < 5; i++ {
+		gs.Say(context.Background(), makeMockMessage(id, id))
+	}
+	get := signedGet(id, privk)
+	get.Limit = 2
+	get.AfterSeq = 1
+	SignMessage(get, &get.ProofOfIdent, privk)
+	page, err := gs.GetMine(context.Background(), get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Seq != 2 || page.NextSeq != 3 || !page.More {
+		t.Errorf("Bad page: %d messages, next %d, more %v", len(page.Messages), page.NextSeq, page.More)
+	}
+	ack := &pb.AckRequest{id, []uint64{2, 3}, time.Now().Unix(), nil}
+	SignMessage(ack, &ack.ProofOfIdent, privk)
+	if res, err := gs.Ack(context.Background(), ack); err != nil || res.IsError {
+		t.Errorf("Ack failed: %v %v", res, err)
+	}
+	page, _ = gs.GetMine(context.Background(), signedGet(id, privk))
+	if len(page.Messages) != 3 || page.More {
+		t.Errorf("Got %d messages after acking 2 of 5", len(page.Messages))
+	}
+}
+
+func TestExpiredMessagesAreDropped(t *testing.T) {
+	gs := getMockServer(true)
+	id, privk, _ := makeAnIdentity()
+	gs.knownUsers.AddIdentity(id)
+	gs.accounts.PutAccount(&pb.Account{Ident: id})
+	late := makeMockMessage(id, id)
+	late.ExpiresUtc = time.Now().Unix() - 1
+	if ack, _ := gs.Say(context.Background(), late); !ack.IsError {
+		t.Error("Accepted a message that had already expired")
+	}
+	soon := makeMockMessage(id, id)
+	soon.ExpiresUtc = time.Now().Unix() + 60
+	if ack, _ := gs.Say(context.Background(), soon); ack.IsError {
+		t.Fatalf("Rejected a message that had not expired: %s", ack.Error)
+	}
+	// Runs out while waiting in the mailbox.
+	for _, m := range gs.mailboxes.After(IdentToString(id.Ident), 0) {
+		m.ExpiresUtc = time.Now().Unix() - 1
+	}
+	if page, _ := gs.GetMine(context.Background(), signedGet(id, privk)); len(page.Messages) != 0 {
+		t.Error("Served an expired message")
+	}
+}
+
+func TestSupCannotTakeOverNames(t *testing.T) {
+	sid, sk, _ := makeAnIdentity()
+	sid.Handle = ServerHandle
+	key := MakeLocalUser(sid, sk)
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{ServerKey: &key, Domain: "testname", Identities: NewInMemoryIdentStore()})
+	defer gs.connectionPool.Close()
+	alice, _, _ := makeAnIdentity()
+	alice.Handle = "alice"
+	gs.knownUsers.AddIdentity(alice)
+	gs.accounts.PutAccount(&pb.Account{Ident: alice})
+
+	// A fresh key calling itself alice, and one calling itself the server.
+	for _, handle := range []string{"alice", ServerHandle} {
+		fake, fakek, _ := makeAnIdentity()
+		fake.Handle = handle
+		req := &pb.RequestPermissions{alice, &pb.UserPermissions{Ident: fake}, nil, time.Now().Unix(), nil}
+		SignMessage(req, &req.Signature, fakek)
+		gs.Sup(context.Background(), req)
+		if gs.knownUsers.GetIdentityForIdent(fake.Ident) != nil {
+			t.Errorf("Remembered an unvouched requester calling itself %s", handle)
+		}
+	}
+	if res, _ := gs.Name(context.Background(), &pb.NameInquiry{RequestHandle: "alice", RequestDomain: "testname"}); res.IsError || !SameBytes(res.Name.Ident, alice.Ident) {
+		t.Error("Name no longer finds alice")
+	}
+	if res, _ := gs.Name(context.Background(), &pb.NameInquiry{RequestHandle: ServerHandle, RequestDomain: "testname"}); res.IsError || !SameBytes(res.Name.Ident, sid.Ident) {
+		t.Error("Name no longer finds the server key")
+	}
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(alice, alice)); ack.IsError {
+		t.Errorf("Mail to alice refused: %s", ack.Error)
+	}
+}
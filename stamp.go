@@ -0,0 +1,328 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Clients refuse to do more work than this for a single stamp.
+	MaxStampBits = 32
+
+	// How old a stamped message or request may be, in seconds.
+	stampWindow = 24 * 60 * 60
+
+	// How often spent stamps that have run out are forgotten, in seconds.
+	spentStampPruneFreq = 60
+
+	// A spent stamp on disk: its key, then when it runs out.
+	spentStampRecordLen = sha256.Size + 8
+)
+
+// Proof-of-work stamps work like hashcash: a stamp is a nonce such that
+// sha256(resource || nonce) starts with some number of zero bits. The
+// resource ties the stamp to one message, so it can't be reused.
+
+func leadingZeroBits(h []byte) int {
+	n := 0
+	for _, b := range h {
+		if b == 0 {
+			n += 8
+			continue
+		}
+		for b&0x80 == 0 {
+			n++
+			b <<= 1
+		}
+		break
+	}
+	return n
+}
+
+func stampHash(resource []byte, stamp []byte) []byte {
+	h := sha256.New()
+	h.Write(resource)
+	h.Write(stamp)
+	return h.Sum(nil)
+}
+
+// MintStamp finds a stamp with at least bits leading zero bits for resource.
+func MintStamp(resource []byte, bits int) []byte {
+	stamp := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.BigEndian.PutUint64(stamp, i)
+		if leadingZeroBits(stampHash(resource, stamp)) >= bits {
+			return stamp
+		}
+	}
+}
+
+func CheckStamp(resource []byte, stamp []byte, bits int) bool {
+	if len(stamp) == 0 {
+		return false
+	}
+	return leadingZeroBits(stampHash(resource, stamp)) >= bits
+}
+
+func stampInWindow(tstamp int64) bool {
+	d := time.Now().Unix() - tstamp
+	return d <= stampWindow && d >= -authWindow
+}
+
+// A SpentStamps remembers the stamps that have been used until they would
+// be refused as too old anyway, so that no stamp pays for more than one
+// message or request. If SrcPath is set, every change is appended to that
+// file, which is compacted as stamps run out, so a restart forgets nothing.
+type SpentStamps struct {
+	spent     map[string]int64
+	SrcPath   string
+	lastPrune int64
+	lck       *sync.Mutex
+}
+
+func NewSpentStamps() *SpentStamps {
+	return &SpentStamps{make(map[string]int64), "", 0, &sync.Mutex{}}
+}
+
+// MakeFileSpentStamps loads the spent stamps kept at path, which need not
+// exist yet.
+func MakeFileSpentStamps(path string) (*SpentStamps, error) {
+	s := NewSpentStamps()
+	s.SrcPath = path
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Records are a key and when it runs out; zero means it was forgotten.
+	// A record cut short by a crash is ignored.
+	for ; len(bs) >= spentStampRecordLen; bs = bs[spentStampRecordLen:] {
+		k := string(bs[:sha256.Size])
+		if expires := int64(binary.BigEndian.Uint64(bs[sha256.Size:spentStampRecordLen])); expires > 0 {
+			s.spent[k] = expires
+		} else {
+			delete(s.spent, k)
+		}
+	}
+	s.pruneNotThreadSafe(time.Now().Unix())
+	return s, nil
+}
+
+// The key a stamp is remembered by: its hash, which covers what it was for.
+func spentStampKey(resource []byte, stamp []byte) string {
+	return string(stampHash(resource, stamp))
+}
+
+func spentStampRecord(key string, expires int64) []byte {
+	rec := make([]byte, spentStampRecordLen)
+	copy(rec, key)
+	binary.BigEndian.PutUint64(rec[sha256.Size:], uint64(expires))
+	return rec
+}
+
+func (s *SpentStamps) appendNotThreadSafe(key string, expires int64) error {
+	if len(s.SrcPath) == 0 {
+		return nil
+	}
+	fh, err := os.OpenFile(s.SrcPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fh.Write(spentStampRecord(key, expires)); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Sync(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// Spend records a stamp made at tstamp as used, returning false if it
+// already was, or if it cannot be recorded.
+func (s *SpentStamps) Spend(key string, tstamp int64) bool {
+	now := time.Now().Unix()
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if now-s.lastPrune >= spentStampPruneFreq {
+		s.pruneNotThreadSafe(now)
+	}
+	if _, ok := s.spent[key]; ok {
+		return false
+	}
+	expires := tstamp + stampWindow
+	if err := s.appendNotThreadSafe(key, expires); err != nil {
+		log.Printf("Cannot record spent stamp: %v", err)
+		return false
+	}
+	s.spent[key] = expires
+	return true
+}
+
+// Forget un-spends a stamp, e.g. because what it paid for was not delivered.
+func (s *SpentStamps) Forget(key string) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if _, ok := s.spent[key]; !ok {
+		return
+	}
+	delete(s.spent, key)
+	if err := s.appendNotThreadSafe(key, 0); err != nil {
+		log.Printf("Cannot forget spent stamp: %v", err)
+	}
+}
+
+// Drops stamps that have run out, and rewrites the file without them.
+func (s *SpentStamps) pruneNotThreadSafe(now int64) {
+	s.lastPrune = now
+	pruned := false
+	for k, expires := range s.spent {
+		if expires < now {
+			delete(s.spent, k)
+			pruned = true
+		}
+	}
+	if !pruned || len(s.SrcPath) == 0 {
+		return
+	}
+	bs := make([]byte, 0, len(s.spent)*spentStampRecordLen)
+	for k, expires := range s.spent {
+		bs = append(bs, spentStampRecord(k, expires)...)
+	}
+	tmp := s.SrcPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		log.Printf("Cannot compact spent stamps: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.SrcPath); err != nil {
+		log.Printf("Cannot compact spent stamps: %v", err)
+	}
+}
+
+func stampResource(kind string, from *pb.Identity, to []*pb.Identity, tstamp int64, id []byte, content []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(kind + "\n")
+	if from != nil {
+		buf.Write(from.Ident)
+	}
+	for _, t := range to {
+		buf.WriteString("\n" + nameKey(t.Handle, t.Domain))
+	}
+	binary.Write(&buf, binary.BigEndian, tstamp)
+	binary.Write(&buf, binary.BigEndian, int32(len(id)))
+	buf.Write(id)
+	sum := sha256.Sum256(content)
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func messageStampResource(msg *pb.RawMessage) []byte {
+	return stampResource("msg", msg.FromIdent, msg.ToIdent, msg.Tstamp, msg.MsgId, msg.MessageContent)
+}
+
+func permissionsStampResource(req *pb.RequestPermissions) []byte {
+	var from *pb.Identity
+	if req.RequestedPermissions != nil {
+		from = req.RequestedPermissions.Ident
+	}
+	var to []*pb.Identity
+	if req.ToIdent != nil {
+		to = []*pb.Identity{req.ToIdent}
+	}
+	return stampResource("sup", from, to, req.Tstamp, nil, nil)
+}
+
+// StampMessage attaches a stamp of the given difficulty to msg. Do this after
+// encryption and after giving the message its id, as the stamp covers both.
+func StampMessage(msg *pb.RawMessage, bits int) {
+	msg.Stamp = MintStamp(messageStampResource(msg), bits)
+}
+
+func StampPermissionRequest(req *pb.RequestPermissions, bits int) {
+	req.Stamp = MintStamp(permissionsStampResource(req), bits)
+}
+
+func hasContact(acct *pb.Account, ident []byte) bool {
+	for _, c := range acct.Contacts {
+		if bytes.Equal(c, ident) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a message from sender to a local user needs a stamp, i.e. whether
+// the user has neither granted the sender permissions nor allowed them. Only
+// a verified sender can be exempt, as anyone can claim someone else's
+// identity.
+func (s *GSDPServer) needsStamp(to *pb.Identity, from *pb.Identity, auth senderAuth) bool {
+	if s.stampBits <= 0 {
+		return false
+	}
+	acct := s.accounts.GetAccount(to.Ident)
+	if acct == nil || from == nil || !auth.verified {
+		return true
+	}
+	if r := MatchFilters(acct.Filters, from, auth.verified, auth.domainVerified); r != nil && r.Action == pb.FilterAction_ALLOW {
+		return false
+	}
+	return !hasContact(acct, from.Ident)
+}
+
+// Grant records that a local user grants permissions to someone, which
+// makes them an established contact, and lets their server know.
+func (s *GSDPServer) Grant(ctx context.Context, in *pb.ApprovePermissions) (*pb.MessageAck, error) {
+	acct, err := s.authenticateLocal(in, in.FromIdent, in.Tstamp, &in.Signature)
+	if err != nil {
+		return nil, err
+	}
+	if in.GrantedPermissions == nil || in.GrantedPermissions.Ident == nil {
+		return &pb.MessageAck{true, "no one to grant permissions to", 0}, nil
+	}
+	if err := s.addContact(acct.Ident, in.GrantedPermissions.Ident); err != nil {
+		return &pb.MessageAck{true, err.Error(), 0}, nil
+	}
+	if s.serverClient != nil {
+		s.serverClient.SendK(in.GrantedPermissions)
+	}
+	return &pb.MessageAck{false, "OK", 0}, nil
+}
+
+// Records that a local user has granted permissions to sender, which makes
+// them an established contact.
+func (s *GSDPServer) addContact(to *pb.Identity, from *pb.Identity) error {
+	acct := s.accounts.GetAccount(to.Ident)
+	if acct == nil || hasContact(acct, from.Ident) {
+		return nil
+	}
+	acct = proto.Clone(acct).(*pb.Account)
+	acct.Contacts = append(acct.Contacts, from.Ident)
+	return s.accounts.PutAccount(acct)
+}
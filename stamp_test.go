@@ -0,0 +1,204 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMintStamp(t *testing.T) {
+	res := []byte("some resource")
+	stamp := MintStamp(res, 12)
+	if !CheckStamp(res, stamp, 12) {
+		t.Error("Minted stamp does not check")
+	}
+	if CheckStamp([]byte("another resource"), stamp, 12) && CheckStamp([]byte("yet another"), stamp, 12) {
+		t.Error("Stamp is not tied to its resource")
+	}
+	if CheckStamp(res, nil, 0) {
+		t.Error("Empty stamp accepted")
+	}
+}
+
+func TestSayNeedsStampForFirstContact(t *testing.T) {
+	from, fromk, _ := makeAnIdentity()
+	to, tok, _ := makeAnIdentity()
+	to.Handle = "recip"
+	sid, sk, _ := makeAnIdentity()
+	key := MakeLocalUser(sid, sk)
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{ServerKey: &key, Domain: "testname", Identities: NewInMemoryIdentStore(), StampBits: 8})
+	defer gs.connectionPool.Close()
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+
+	msg := makeMockMessage(from, to)
+	ack, _ := gs.Say(context.Background(), msg)
+	if !ack.IsError || ack.StampBits != 8 {
+		t.Errorf("Unstamped first contact accepted: %v", ack)
+	}
+	// A 4 bit stamp that happens to be good for 8 bits won't do here.
+	for StampMessage(msg, 4); CheckStamp(messageStampResource(msg), msg.Stamp, 8); StampMessage(msg, 4) {
+		msg.Tstamp++
+	}
+	if ack, _ := gs.Say(context.Background(), msg); !ack.IsError {
+		t.Error("Accepted a stamp that is too weak")
+	}
+	StampMessage(msg, 8)
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Errorf("Stamped message rejected: %s", ack.Error)
+	}
+	stale := makeMockMessage(from, to)
+	stale.Tstamp = time.Now().Unix() - 2*stampWindow
+	StampMessage(stale, 8)
+	if ack, _ := gs.Say(context.Background(), stale); !ack.IsError {
+		t.Error("Accepted a stale stamp")
+	}
+
+	req := &pb.RequestPermissions{to, &pb.UserPermissions{Ident: from}, nil, time.Now().Unix(), nil}
+	StampPermissionRequest(req, 8)
+	SignMessage(req, &req.Signature, sk)
+	if _, err := gs.Sup(context.Background(), req); err == nil {
+		t.Error("Permissions requested in someone else's name")
+	}
+	req.Stamp = nil
+	SignMessage(req, &req.Signature, fromk)
+	if _, err := gs.Sup(context.Background(), req); err == nil {
+		t.Error("Unstamped permissions request accepted")
+	}
+	StampPermissionRequest(req, 8)
+	if _, err := gs.Sup(context.Background(), req); err == nil {
+		t.Error("Permissions request accepted with a signature from before it was stamped")
+	}
+	SignMessage(req, &req.Signature, fromk)
+	if _, err := gs.Sup(context.Background(), req); err != nil {
+		t.Fatalf("Stamped permissions request refused: %s", err)
+	}
+	if hasContact(gs.accounts.GetAccount(to.Ident), from.Ident) {
+		t.Fatal("Asking for permissions made an established contact")
+	}
+
+	grant := &pb.ApprovePermissions{to, &pb.UserPermissions{Ident: from}, nil, time.Now().Unix()}
+	SignMessage(grant, &grant.Signature, fromk)
+	if _, err := gs.Grant(context.Background(), grant); err == nil {
+		t.Error("Permissions granted in someone else's name")
+	}
+	SignMessage(grant, &grant.Signature, tok)
+	if ack, err := gs.Grant(context.Background(), grant); err != nil || ack.IsError {
+		t.Fatalf("Grant refused: %v %v", ack, err)
+	}
+	if !hasContact(gs.accounts.GetAccount(to.Ident), from.Ident) {
+		t.Fatal("Granting permissions did not make an established contact")
+	}
+	if ack, _ := gs.Say(context.Background(), makeMockMessage(from, to)); !ack.IsError {
+		t.Error("Unsigned message claiming to be from a contact got out of the stamp")
+	}
+	if ack, _ := gs.Say(context.Background(), makeSignedMessage(from, fromk, to)); ack.IsError {
+		t.Errorf("Established contact needed a stamp: %s", ack.Error)
+	}
+}
+
+func TestStampsAreSpent(t *testing.T) {
+	from, _, _ := makeAnIdentity()
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{Domain: "testname", Identities: NewInMemoryIdentStore(), StampBits: 8})
+	gs.knownUsers.AddIdentity(to)
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+
+	msg := makeMockMessage(from, to)
+	StampMessage(msg, 8)
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Fatalf("Stamped message rejected: %s", ack.Error)
+	}
+	// Once the dedup window has forgotten the message, its stamp must still
+	// not pay for it again.
+	gs.dedup = NewDedupWindow(dedupWindowSize)
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Errorf("Retry of a stamped message was not acknowledged: %s", ack.Error)
+	}
+	if n, _ := gs.mailboxes.Stat(IdentToString(to.Ident)); n != 1 {
+		t.Errorf("Stamp paid for %d deliveries", n)
+	}
+}
+
+func TestRefusedMessagesKeepTheirStamp(t *testing.T) {
+	from, _, _ := makeAnIdentity()
+	to, _, _ := makeAnIdentity()
+	to.Handle = "recip"
+	gs := &GSDPServer{}
+	gs.Initialize(ServerOptions{Domain: "testname", Identities: NewInMemoryIdentStore(), StampBits: 8})
+
+	msg := makeMockMessage(from, to)
+	StampMessage(msg, 8)
+	if ack, _ := gs.Say(context.Background(), msg); !ack.IsError {
+		t.Fatal("Delivered to a user who is not here yet")
+	}
+	gs.knownUsers.AddIdentity(to)
+	if ack, _ := gs.Say(context.Background(), msg); !ack.IsError {
+		t.Fatal("Delivered to a user without an account")
+	}
+	gs.accounts.PutAccount(&pb.Account{Ident: to})
+	if ack, _ := gs.Say(context.Background(), msg); ack.IsError {
+		t.Fatalf("Retry rejected: %s", ack.Error)
+	}
+	if n, _ := gs.mailboxes.Stat(IdentToString(to.Ident)); n != 1 {
+		t.Errorf("Retry after a refusal delivered %d messages", n)
+	}
+}
+
+func TestSpentStampsPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-stamps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stamps")
+	s, err := MakeFileSpentStamps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Unix()
+	a, b, old := spentStampKey([]byte("a"), []byte{1}), spentStampKey([]byte("b"), []byte{1}), spentStampKey([]byte("c"), []byte{1})
+	if !s.Spend(a, now) || s.Spend(a, now) {
+		t.Error("Stamp was not spent exactly once")
+	}
+	s.Spend(b, now)
+	s.Forget(b)
+	s.Spend(old, now-2*stampWindow)
+
+	s, err = MakeFileSpentStamps(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Spend(a, now) {
+		t.Error("Spent stamp was forgotten on restart")
+	}
+	if !s.Spend(b, now) {
+		t.Error("Forgotten stamp was still spent after a restart")
+	}
+	if _, ok := s.spent[old]; ok {
+		t.Error("Stamp that ran out was kept")
+	}
+}
@@ -0,0 +1,217 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bufio"
+	"errors"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	maxTags   = 16
+	maxTagLen = 64
+)
+
+// Tags are compared without regard to case or surrounding space.
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func checkTags(tags []string) error {
+	if len(tags) > maxTags {
+		return errors.New("too many tags")
+	}
+	for _, t := range tags {
+		if len(normalizeTag(t)) == 0 || len(t) > maxTagLen {
+			return errors.New("bad tag")
+		}
+	}
+	return nil
+}
+
+// MessageTags returns a message's tags: those in the clear and any inside its
+// payload, normalized, without duplicates.
+func MessageTags(msg *pb.RawMessage, plaintext []byte) []string {
+	seen := make(map[string]bool)
+	tags := make([]string, 0)
+	for _, lst := range [][]string{msg.Tags, PayloadTags(msg.MsgType, plaintext)} {
+		for _, t := range lst {
+			if t = normalizeTag(t); len(t) > 0 && !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	return tags
+}
+
+// HasAnyTag says whether tags include any of want.
+func HasAnyTag(tags []string, want []string) bool {
+	for _, t := range tags {
+		for _, w := range want {
+			if normalizeTag(t) == normalizeTag(w) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TagPrefs are a user's standing choices about tags: messages with a pinned
+// (subscribed) tag are listed first, and those with a muted tag are hidden.
+type TagPrefs struct {
+	pinned  map[string]bool
+	muted   map[string]bool
+	SrcPath string
+	lck     *sync.Mutex
+}
+
+func NewTagPrefs() *TagPrefs {
+	return &TagPrefs{make(map[string]bool), make(map[string]bool), "", &sync.Mutex{}}
+}
+
+// MakeFileTagPrefs loads tag preferences from path, one "pin <tag>" or
+// "mute <tag>" per line. A missing file means no preferences.
+func MakeFileTagPrefs(path string) (*TagPrefs, error) {
+	p := NewTagPrefs()
+	p.SrcPath = path
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		pcs := strings.SplitN(sc.Text(), " ", 2)
+		if len(pcs) < 2 {
+			continue
+		}
+		switch pcs[0] {
+		case "pin":
+			p.pinned[normalizeTag(pcs[1])] = true
+		case "mute":
+			p.muted[normalizeTag(pcs[1])] = true
+		}
+	}
+	return p, sc.Err()
+}
+
+// Pin pins a tag, unmuting it.
+func (p *TagPrefs) Pin(tag string) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	delete(p.muted, normalizeTag(tag))
+	p.pinned[normalizeTag(tag)] = true
+}
+
+// Mute mutes a tag, unpinning it.
+func (p *TagPrefs) Mute(tag string) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	delete(p.pinned, normalizeTag(tag))
+	p.muted[normalizeTag(tag)] = true
+}
+
+// Clear forgets any preference about a tag.
+func (p *TagPrefs) Clear(tag string) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	delete(p.pinned, normalizeTag(tag))
+	delete(p.muted, normalizeTag(tag))
+}
+
+func sortedKeys(m map[string]bool) []string {
+	lst := make([]string, 0, len(m))
+	for k, _ := range m {
+		lst = append(lst, k)
+	}
+	sort.Strings(lst)
+	return lst
+}
+
+func (p *TagPrefs) Pinned() []string {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return sortedKeys(p.pinned)
+}
+
+func (p *TagPrefs) Muted() []string {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return sortedKeys(p.muted)
+}
+
+// Save writes the preferences to the file they came from, if any.
+func (p *TagPrefs) Save() error {
+	if len(p.SrcPath) == 0 {
+		return nil
+	}
+	lines := make([]string, 0)
+	for _, t := range p.Pinned() {
+		lines = append(lines, "pin "+t+"\n")
+	}
+	for _, t := range p.Muted() {
+		lines = append(lines, "mute "+t+"\n")
+	}
+	return ioutil.WriteFile(p.SrcPath, []byte(strings.Join(lines, "")), 0600)
+}
+
+func (p *TagPrefs) any(set map[string]bool, tags []string) bool {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	for _, t := range tags {
+		if set[normalizeTag(t)] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMuted says whether any of tags is muted.
+func (p *TagPrefs) IsMuted(tags []string) bool {
+	return p.any(p.muted, tags)
+}
+
+// IsPinned says whether any of tags is pinned.
+func (p *TagPrefs) IsPinned(tags []string) bool {
+	return p.any(p.pinned, tags)
+}
+
+// Apply drops messages with a muted tag and moves those with a pinned one to
+// the front, otherwise keeping their order. A message with both is pinned.
+func (p *TagPrefs) Apply(msgs []*ViewMessage) []*ViewMessage {
+	pinned := make([]*ViewMessage, 0)
+	rest := make([]*ViewMessage, 0)
+	for _, vm := range msgs {
+		tags := MessageTags(vm.Msg, vm.Plaintext)
+		if p.IsPinned(tags) {
+			pinned = append(pinned, vm)
+		} else if !p.IsMuted(tags) {
+			rest = append(rest, vm)
+		}
+	}
+	return append(pinned, rest...)
+}
@@ -0,0 +1,93 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"golang.org/x/net/context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestGetMineFiltersByTag(t *testing.T) {
+	gs := getMockServer(true)
+	id, privk, _ := makeAnIdentity()
+	gs.knownUsers.AddIdentity(id)
+	gs.accounts.PutAccount(&pb.Account{Ident: id})
+	for _, tags := range [][]string{nil, {"infra"}, {"Web", "infra"}, {"web"}} {
+		msg := makeMockMessage(id, id)
+		msg.Tags = tags
+		gs.Say(context.Background(), msg)
+	}
+	many := makeMockMessage(id, id)
+	for i := 0; i <= maxTags; i++ {
+		many.Tags = append(many.Tags, "t"+strconv.Itoa(i))
+	}
+	if ack, _ := gs.Say(context.Background(), many); !ack.IsError {
+		t.Error("Accepted too many tags")
+	}
+	get := signedGet(id, privk)
+	get.Tags = []string{"WEB"}
+	SignMessage(get, &get.ProofOfIdent, privk)
+	page, err := gs.GetMine(context.Background(), get)
+	if err != nil || len(page.Messages) != 2 || page.NextSeq != 4 {
+		t.Errorf("Bad tagged page: %v %v", page, err)
+	}
+}
+
+func TestTagPrefs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	alice, _, _ := makeAnIdentity()
+	bob, _, _ := makeAnIdentity()
+	v := NewMessageView()
+	plain := makeMockMessage(alice, bob)
+	v.Add(plain, []byte("hi"))
+	noisy := makeMockMessage(alice, bob)
+	noisy.Tags = []string{"Noise"}
+	v.Add(noisy, []byte("beep"))
+	task := makeMockMessage(alice, bob)
+	task.MsgType = pb.MessageType_TASK_ASSIGN
+	bs, _ := proto.Marshal(&pb.TaskAssign{Subject: "Ship it", ProjectTags: []string{"launch"}})
+	v.Add(task, bs)
+	if tags := MessageTags(task, bs); len(tags) != 1 || tags[0] != "launch" {
+		t.Errorf("Payload tags not found: %v", tags)
+	}
+
+	path := filepath.Join(dir, "tags")
+	p, _ := MakeFileTagPrefs(path)
+	p.Mute("noise")
+	p.Pin("LAUNCH")
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = MakeFileTagPrefs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lst := p.Apply(v.Messages())
+	if len(lst) != 2 || lst[0].Msg != task || lst[1].Msg != plain {
+		t.Errorf("Tag preferences not applied: %d messages", len(lst))
+	}
+}
@@ -0,0 +1,279 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bufio"
+	"encoding/base64"
+	pb "github.com/jwvictor/gsdprotocol"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// A ThreadNode is a message in a conversation and the replies to it.
+type ThreadNode struct {
+	Msg     *ViewMessage
+	Unread  bool
+	Replies []*ThreadNode
+}
+
+// A Thread is a conversation: the messages sharing a block_id or linked by
+// replies. Roots are messages that reply to nothing in the thread.
+type Thread struct {
+	Roots   []*ThreadNode
+	Size    int
+	Unread  int
+	Started int64
+	Updated int64
+}
+
+// ReadState remembers which messages a user has read, by msg_id.
+type ReadState struct {
+	read    map[string]bool
+	added   []string
+	SrcPath string
+	lck     *sync.Mutex
+}
+
+func NewReadState() *ReadState {
+	return &ReadState{make(map[string]bool), make([]string, 0), "", &sync.Mutex{}}
+}
+
+// MakeFileReadState loads read state from path, one message id per line. A
+// missing file is an empty state.
+func MakeFileReadState(path string) (*ReadState, error) {
+	s := NewReadState()
+	s.SrcPath = path
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		s.read[sc.Text()] = true
+	}
+	return s, sc.Err()
+}
+
+func (s *ReadState) IsRead(msgId []byte) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.read[base64.StdEncoding.EncodeToString(msgId)]
+}
+
+func (s *ReadState) MarkRead(msgId []byte) {
+	k := base64.StdEncoding.EncodeToString(msgId)
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if !s.read[k] {
+		s.read[k] = true
+		s.added = append(s.added, k)
+	}
+}
+
+// Save appends newly read ids to the file the state came from, if any.
+func (s *ReadState) Save() error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	if len(s.SrcPath) == 0 || len(s.added) == 0 {
+		return nil
+	}
+	fh, err := os.OpenFile(s.SrcPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	for _, k := range s.added {
+		w.WriteString(k + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	s.added = s.added[:0]
+	return fh.Close()
+}
+
+type threadSets map[string]string
+
+func (u threadSets) find(k string) string {
+	root := k
+	for {
+		p, ok := u[root]
+		if !ok || p == root {
+			break
+		}
+		root = p
+	}
+	for k != root {
+		next := u[k]
+		u[k] = root
+		k = next
+	}
+	return root
+}
+
+func (u threadSets) union(a string, b string) {
+	ra, rb := u.find(a), u.find(b)
+	if ra != rb {
+		u[ra] = rb
+	}
+}
+
+// Returns what a message replies to, and for an invitation, the id its
+// copies share, which RSVPs reply to. The reply may be named in the clear,
+// where the servers it passes through see it too, or only inside the
+// encrypted payload of structured types.
+func threadLinks(vm *ViewMessage) ([]byte, []byte) {
+	re := vm.Msg.ReMsgId
+	p, err := OpenPayload(vm.Msg.MsgType, vm.Plaintext)
+	if err != nil || p == nil {
+		return re, nil
+	}
+	var inner, invId []byte
+	switch p := p.(type) {
+	case *pb.CodeShare:
+		inner = p.ReMsgId
+	case *pb.TaskAssign:
+		inner = p.ReMsgId
+	case *pb.Invitation:
+		inner, invId = p.ReMsgId, p.InvitationId
+	case *pb.PersonalNote:
+		inner = p.ReMsgId
+	case *pb.Rsvp:
+		inner = p.ReMsgId
+	}
+	if len(re) == 0 {
+		re = inner
+	}
+	return re, invId
+}
+
+// BuildThreads groups the messages in a view into threads, by block_id and
+// by chains of replies, even through messages we never got. Messages within
+// a thread are ordered by timestamp, and threads by their latest message,
+// oldest first. read may be nil, in which case everything is unread.
+func BuildThreads(view *MessageView, read *ReadState) []*Thread {
+	sets := make(threadSets)
+	msgKey := func(id []byte) string { return "m" + string(id) }
+	msgs := view.Messages()
+	replyTo := make([][]byte, len(msgs))
+	invIds := make([][]byte, len(msgs))
+	for i, vm := range msgs {
+		replyTo[i], invIds[i] = threadLinks(vm)
+		k := msgKey(vm.Msg.MsgId)
+		if len(vm.Msg.MsgId) == 0 {
+			k = "i" + strconv.Itoa(i)
+		}
+		if len(replyTo[i]) > 0 {
+			sets.union(k, msgKey(replyTo[i]))
+		}
+		if len(invIds[i]) > 0 {
+			sets.union(k, msgKey(invIds[i]))
+		}
+		if len(vm.Msg.BlockId) > 0 {
+			sets.union(k, "b"+string(vm.Msg.BlockId))
+		}
+	}
+
+	nodes := make(map[string]*ThreadNode)
+	pos := make(map[*ThreadNode]int)
+	for i, vm := range msgs {
+		if len(vm.Msg.MsgId) > 0 {
+			n := &ThreadNode{vm, read == nil || !read.IsRead(vm.Msg.MsgId), nil}
+			nodes[string(vm.Msg.MsgId)] = n
+			pos[n] = i
+		}
+	}
+	// RSVPs hang off the first copy of the invitation they answer.
+	for i, vm := range msgs {
+		if n, ok := nodes[string(vm.Msg.MsgId)]; ok && len(invIds[i]) > 0 {
+			if _, taken := nodes[string(invIds[i])]; !taken {
+				nodes[string(invIds[i])] = n
+			}
+		}
+	}
+	// Replies only hang off earlier messages, so a forged loop of replies
+	// can't cut a thread off from its roots.
+	before := func(a *ThreadNode, b *ThreadNode) bool {
+		ta, tb := a.Msg.Msg.Tstamp, b.Msg.Msg.Tstamp
+		return ta < tb || (ta == tb && pos[a] < pos[b])
+	}
+	byRoot := make(map[string]*Thread)
+	threads := make([]*Thread, 0)
+	for i, vm := range msgs {
+		k := msgKey(vm.Msg.MsgId)
+		node := nodes[string(vm.Msg.MsgId)]
+		if len(vm.Msg.MsgId) == 0 {
+			k = "i" + strconv.Itoa(i)
+			node = &ThreadNode{vm, true, nil}
+		}
+		root := sets.find(k)
+		th, ok := byRoot[root]
+		if !ok {
+			th = &Thread{make([]*ThreadNode, 0), 0, 0, vm.Msg.Tstamp, vm.Msg.Tstamp}
+			byRoot[root] = th
+			threads = append(threads, th)
+		}
+		th.Size++
+		if node.Unread {
+			th.Unread++
+		}
+		if vm.Msg.Tstamp < th.Started {
+			th.Started = vm.Msg.Tstamp
+		}
+		if vm.Msg.Tstamp > th.Updated {
+			th.Updated = vm.Msg.Tstamp
+		}
+		if parent, ok := nodes[string(replyTo[i])]; ok && len(replyTo[i]) > 0 && parent != node && before(parent, node) {
+			parent.Replies = append(parent.Replies, node)
+		} else {
+			th.Roots = append(th.Roots, node)
+		}
+	}
+	for _, th := range threads {
+		sortThreadNodes(th.Roots)
+	}
+	sort.SliceStable(threads, func(i, j int) bool { return threads[i].Updated < threads[j].Updated })
+	return threads
+}
+
+func sortThreadNodes(ns []*ThreadNode) {
+	sort.SliceStable(ns, func(i, j int) bool { return ns[i].Msg.Msg.Tstamp < ns[j].Msg.Msg.Tstamp })
+	for _, n := range ns {
+		sortThreadNodes(n.Replies)
+	}
+}
+
+// Walk calls f on every message in the thread, depth first, with its depth
+// in the reply tree.
+func (th *Thread) Walk(f func(n *ThreadNode, depth int)) {
+	var walk func([]*ThreadNode, int)
+	walk = func(ns []*ThreadNode, depth int) {
+		for _, n := range ns {
+			f(n, depth)
+			walk(n.Replies, depth+1)
+		}
+	}
+	walk(th.Roots, 0)
+}
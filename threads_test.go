@@ -0,0 +1,136 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestThreadsFollowRepliesInPayloads(t *testing.T) {
+	alice, _, _ := makeAnIdentity()
+	bob, _, _ := makeAnIdentity()
+	v := NewMessageView()
+	add := func(tstamp int64, kind pb.MessageType, payload proto.Message) []byte {
+		m := makeMockMessage(alice, bob)
+		m.Tstamp, m.MsgType = tstamp, kind
+		bs, _ := proto.Marshal(payload)
+		v.Add(m, bs)
+		return m.MsgId
+	}
+	task := add(100, pb.MessageType_TASK_ASSIGN, &pb.TaskAssign{Subject: "Fix it"})
+	add(110, pb.MessageType_CODE_SHARE, &pb.CodeShare{Code: "fix", ReMsgId: task})
+	invId := NewMsgId()
+	add(120, pb.MessageType_INVITATION, &pb.Invitation{Subject: "Standup", InvitationId: invId})
+	add(130, pb.MessageType_RSVP, &pb.Rsvp{ReMsgId: invId, Response: pb.RsvpResponse_ACCEPT})
+
+	threads := BuildThreads(v, nil)
+	if len(threads) != 2 {
+		t.Fatalf("Got %d threads, wanted 2", len(threads))
+	}
+	for _, th := range threads {
+		if th.Size != 2 || len(th.Roots) != 1 || len(th.Roots[0].Replies) != 1 {
+			t.Errorf("Reply in the payload not threaded: %+v", th)
+		}
+	}
+}
+
+func TestBuildThreads(t *testing.T) {
+	alice, _, _ := makeAnIdentity()
+	bob, _, _ := makeAnIdentity()
+	v := NewMessageView()
+	add := func(tstamp int64, re []byte, block []byte) []byte {
+		m := makeMockMessage(alice, bob)
+		m.Tstamp = tstamp
+		m.ReMsgId = re
+		m.BlockId = block
+		v.Add(m, []byte("x"))
+		return m.MsgId
+	}
+	root := add(100, nil, nil)
+	reply := add(110, root, nil)
+	// The parent of this one never arrived, but its reply still joins it.
+	lost := NewMsgId()
+	orphan := add(120, lost, nil)
+	add(130, orphan, nil)
+	add(105, nil, []byte("block"))
+	add(140, nil, []byte("block"))
+	// Two messages claiming to reply to each other.
+	a, b := NewMsgId(), NewMsgId()
+	ma := makeMockMessage(alice, bob)
+	ma.MsgId, ma.ReMsgId, ma.Tstamp = a, b, 150
+	mb := makeMockMessage(alice, bob)
+	mb.MsgId, mb.ReMsgId, mb.Tstamp = b, a, 160
+	v.Add(ma, nil)
+	v.Add(mb, nil)
+	add(200, reply, nil)
+
+	read := NewReadState()
+	read.MarkRead(root)
+	threads := BuildThreads(v, read)
+	if len(threads) != 4 {
+		t.Fatalf("Got %d threads, wanted 4", len(threads))
+	}
+	for i := 1; i < len(threads); i++ {
+		if threads[i-1].Updated > threads[i].Updated {
+			t.Error("Threads out of order")
+		}
+	}
+	first := threads[len(threads)-1]
+	if first.Size != 3 || first.Unread != 2 || len(first.Roots) != 1 || first.Roots[0].Unread {
+		t.Fatalf("Bad reply thread: %+v", first)
+	}
+	depths := make([]int, 0)
+	first.Walk(func(n *ThreadNode, depth int) { depths = append(depths, depth) })
+	if len(depths) != 3 || depths[0] != 0 || depths[1] != 1 || depths[2] != 2 {
+		t.Errorf("Bad reply tree depths: %v", depths)
+	}
+	for _, th := range threads[:3] {
+		n := 0
+		th.Walk(func(*ThreadNode, int) { n++ })
+		if th.Size != 2 || n != 2 {
+			t.Errorf("Thread lost messages: size %d, walked %d", th.Size, n)
+		}
+	}
+}
+
+func TestReadStateSurvivesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsdp-read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "read")
+	s, err := MakeFileReadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := NewMsgId()
+	s.MarkRead(id)
+	s.MarkRead(id)
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = MakeFileReadState(path)
+	if err != nil || !s.IsRead(id) || s.IsRead(NewMsgId()) {
+		t.Errorf("Read state not reloaded: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A ViewMessage is a message as it stands after the edits, retractions and
+// reactions that refer to it.
+type ViewMessage struct {
+	Msg *pb.RawMessage
+	// The plaintext as received, and its text as it stands.
+	Plaintext []byte
+	Text      string
+	Edited    int64
+	Retracted bool
+	// Reactions by reactor, keyed by IdentToString of their ident.
+	Reactions map[string]string
+}
+
+// A MessageView is a client's local view of the messages it has seen.
+// Amendments that arrive before the message they refer to are held until it
+// turns up.
+type MessageView struct {
+	msgs    []*ViewMessage
+	byId    map[string]*ViewMessage
+	pending map[string][]pendingAmendment
+}
+
+type pendingAmendment struct {
+	amendment *pb.Amendment
+	signer    *pb.Identity
+}
+
+func NewMessageView() *MessageView {
+	return &MessageView{make([]*ViewMessage, 0), make(map[string]*ViewMessage), make(map[string][]pendingAmendment)}
+}
+
+func isAmendment(t pb.MessageType) bool {
+	return t == pb.MessageType_EDIT || t == pb.MessageType_RETRACT || t == pb.MessageType_REACTION
+}
+
+// MakeAmendment builds a signed edit, retraction or reaction for the message
+// with id reMsgId.
+func MakeAmendment(kind pb.MessageType, reMsgId []byte, text string, user LocalUser) (*pb.Amendment, error) {
+	if !isAmendment(kind) {
+		return nil, errors.New("Not an amendment kind: " + kind.String())
+	}
+	a := &pb.Amendment{kind, reMsgId, text, time.Now().Unix(), []byte{}}
+	if err := SignMessage(a, &a.Signature, user.privKey); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Amend sends an edit, retraction or reaction for the message with id
+// reMsgId to one of the people who got it.
+func (c *GSDPClient) Amend(kind pb.MessageType, reMsgId []byte, text string, to *pb.Identity) error {
+	a, err := MakeAmendment(kind, reMsgId, text, c.user)
+	if err != nil {
+		return err
+	}
+	_, err = c.SendPayload(kind, a, to)
+	return err
+}
+
+// Add puts a decrypted message into the view. Amendments are checked and
+// applied to the message they refer to; an edit or retraction by anyone but
+// that message's sender is an error.
+func (v *MessageView) Add(msg *pb.RawMessage, plaintext []byte) error {
+	if !isAmendment(msg.MsgType) {
+		if _, ok := v.byId[string(msg.MsgId)]; ok && len(msg.MsgId) > 0 {
+			return nil
+		}
+		vm := &ViewMessage{msg, plaintext, PayloadText(msg.MsgType, plaintext), 0, false, make(map[string]string)}
+		v.msgs = append(v.msgs, vm)
+		if len(msg.MsgId) == 0 {
+			return nil
+		}
+		v.byId[string(msg.MsgId)] = vm
+		var err error
+		for _, p := range v.pending[string(msg.MsgId)] {
+			if e := v.apply(vm, p.amendment, p.signer); e != nil {
+				err = e
+			}
+		}
+		delete(v.pending, string(msg.MsgId))
+		return err
+	}
+	a := &pb.Amendment{}
+	if err := proto.Unmarshal(plaintext, a); err != nil {
+		return err
+	}
+	if msg.FromIdent == nil || a.Kind != msg.MsgType {
+		return errors.New("Malformed amendment")
+	}
+	if err := VerifyMessage(a, &a.Signature, msg.FromIdent); err != nil {
+		return errors.New("Bad amendment signature")
+	}
+	vm, ok := v.byId[string(a.ReMsgId)]
+	if !ok {
+		v.pending[string(a.ReMsgId)] = append(v.pending[string(a.ReMsgId)], pendingAmendment{a, msg.FromIdent})
+		return nil
+	}
+	return v.apply(vm, a, msg.FromIdent)
+}
+
+func (v *MessageView) apply(vm *ViewMessage, a *pb.Amendment, signer *pb.Identity) error {
+	if a.Kind != pb.MessageType_REACTION && (vm.Msg.FromIdent == nil || !bytes.Equal(vm.Msg.FromIdent.Ident, signer.Ident)) {
+		return errors.New("Only the sender of a message may edit or retract it")
+	}
+	switch a.Kind {
+	case pb.MessageType_EDIT:
+		if !vm.Retracted && a.Timestamp >= vm.Edited {
+			vm.Text = a.Text
+			vm.Edited = a.Timestamp
+		}
+	case pb.MessageType_RETRACT:
+		vm.Retracted = true
+		vm.Text = ""
+	case pb.MessageType_REACTION:
+		if len(a.Text) == 0 {
+			delete(vm.Reactions, IdentToString(signer.Ident))
+		} else {
+			vm.Reactions[IdentToString(signer.Ident)] = a.Text
+		}
+	}
+	return nil
+}
+
+// Messages returns the messages in the view, in the order they were added.
+func (v *MessageView) Messages() []*ViewMessage {
+	return v.msgs
+}
+
+// Get returns the message with the given id, if the view has it.
+func (v *MessageView) Get(msgId []byte) *ViewMessage {
+	return v.byId[string(msgId)]
+}
+
+// ReactionCounts counts each distinct reaction to a message.
+func (m *ViewMessage) ReactionCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, r := range m.Reactions {
+		counts[r]++
+	}
+	return counts
+}
+
+// ReactionSummary lists reactions and their counts, e.g. "+1 x2", sorted.
+func (m *ViewMessage) ReactionSummary() []string {
+	counts := m.ReactionCounts()
+	lst := make([]string, 0, len(counts))
+	for r, n := range counts {
+		if n > 1 {
+			r = r + " x" + strconv.Itoa(n)
+		}
+		lst = append(lst, r)
+	}
+	sort.Strings(lst)
+	return lst
+}
@@ -0,0 +1,75 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"github.com/golang/protobuf/proto"
+	pb "github.com/jwvictor/gsdprotocol"
+	"testing"
+)
+
+func makeMockAmendment(t *testing.T, kind pb.MessageType, orig *pb.RawMessage, text string, from *pb.Identity, privk []byte) (*pb.RawMessage, []byte) {
+	a, err := MakeAmendment(kind, orig.MsgId, text, MakeLocalUser(from, privk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := proto.Marshal(a)
+	msg := makeMockMessage(from, orig.FromIdent)
+	msg.MsgType = kind
+	return msg, bs
+}
+
+func TestMessageViewAppliesAmendments(t *testing.T) {
+	alice, alicek, _ := makeAnIdentity()
+	bob, bobk, _ := makeAnIdentity()
+	orig := makeMockMessage(alice, bob)
+	v := NewMessageView()
+
+	// An edit that arrives first waits for its message.
+	edit, pt := makeMockAmendment(t, pb.MessageType_EDIT, orig, "hello", alice, alicek)
+	if err := v.Add(edit, pt); err != nil {
+		t.Fatal(err)
+	}
+	v.Add(orig, []byte("hi"))
+	vm := v.Get(orig.MsgId)
+	if vm == nil || vm.Text != "hello" || vm.Edited == 0 {
+		t.Fatalf("Edit not applied: %v", vm)
+	}
+
+	react, pt := makeMockAmendment(t, pb.MessageType_REACTION, orig, "+1", bob, bobk)
+	v.Add(react, pt)
+	react, pt = makeMockAmendment(t, pb.MessageType_REACTION, orig, "+1", alice, alicek)
+	v.Add(react, pt)
+	if s := vm.ReactionSummary(); len(s) != 1 || s[0] != "+1 x2" {
+		t.Errorf("Bad reactions: %v", s)
+	}
+
+	hijack, pt := makeMockAmendment(t, pb.MessageType_RETRACT, orig, "", bob, bobk)
+	if err := v.Add(hijack, pt); err == nil || vm.Retracted {
+		t.Error("Someone else retracted the message")
+	}
+	forged, pt := makeMockAmendment(t, pb.MessageType_EDIT, orig, "pwned", bob, bobk)
+	forged.FromIdent = alice
+	if err := v.Add(forged, pt); err == nil || vm.Text != "hello" {
+		t.Error("Accepted an edit with a bad signature")
+	}
+	retract, pt := makeMockAmendment(t, pb.MessageType_RETRACT, orig, "", alice, alicek)
+	v.Add(retract, pt)
+	if !vm.Retracted || len(vm.Text) != 0 {
+		t.Error("Retraction not applied")
+	}
+}
@@ -0,0 +1,119 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	watchSettleTime = 200 * time.Millisecond
+)
+
+// A DirWatcher calls reload whenever a file with the given suffix is added,
+// changed or removed in a directory. It uses inotify where available and
+// falls back to polling the directory listing otherwise.
+type DirWatcher struct {
+	path     string
+	suffix   string
+	pollFreq time.Duration
+	reload   func() error
+	done     chan struct{}
+}
+
+func WatchDir(path string, suffix string, pollFreq time.Duration, reload func() error) *DirWatcher {
+	w := &DirWatcher{path, suffix, pollFreq, reload, make(chan struct{})}
+	fw, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = fw.Add(path)
+		if err != nil {
+			fw.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Cannot watch %s (%v), polling every %v instead\n", path, err, pollFreq)
+		go w.poll()
+	} else {
+		go w.notify(fw)
+	}
+	return w
+}
+
+func (w *DirWatcher) Stop() {
+	close(w.done)
+}
+
+func (w *DirWatcher) doReload() {
+	if err := w.reload(); err != nil {
+		log.Printf("Failed to reload %s: %v\n", w.path, err)
+	}
+}
+
+// Waits for writes to settle before reloading, so a file that is still being
+// written is picked up once rather than half-read.
+func (w *DirWatcher) notify(fw *fsnotify.Watcher) {
+	defer fw.Close()
+	var settle <-chan time.Time
+	for {
+		select {
+		case ev := <-fw.Events:
+			if strings.HasSuffix(ev.Name, w.suffix) {
+				settle = time.After(watchSettleTime)
+			}
+		case err := <-fw.Errors:
+			log.Printf("Error watching %s: %v\n", w.path, err)
+		case <-settle:
+			settle = nil
+			w.doReload()
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *DirWatcher) snapshot() string {
+	files, _ := ioutil.ReadDir(w.path)
+	sig := ""
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), w.suffix) {
+			sig += fmt.Sprintf("%s:%d:%d;", f.Name(), f.Size(), f.ModTime().UnixNano())
+		}
+	}
+	return sig
+}
+
+func (w *DirWatcher) poll() {
+	ticker := time.NewTicker(w.pollFreq)
+	defer ticker.Stop()
+	last := w.snapshot()
+	for {
+		select {
+		case <-ticker.C:
+			if cur := w.snapshot(); cur != last {
+				last = cur
+				w.doReload()
+			}
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,95 @@
+/* Copyright (C) 2017 Jason Vitor
+
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the Modified BSD License.
+
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+
+ * You should have received a copy of the Modified BSD License
+ * along with this program.  If not, see
+ * <https://opensource.org/licenses/BSD-3-Clause>
+ */
+
+package gsdp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// A WebhookStore keeps the webhooks services set over the bridge, by service
+// name, so they outlive a restart. With SrcPath set, every change is written
+// through to that file before it takes effect.
+type WebhookStore struct {
+	hooks   map[string]webhookRequest
+	SrcPath string
+	lck     *sync.Mutex
+}
+
+func NewWebhookStore() *WebhookStore {
+	return &WebhookStore{make(map[string]webhookRequest), "", &sync.Mutex{}}
+}
+
+// MakeFileWebhookStore loads the webhooks kept at path, which need not
+// exist yet.
+func MakeFileWebhookStore(path string) (*WebhookStore, error) {
+	s := NewWebhookStore()
+	s.SrcPath = path
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, &s.hooks); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns the webhook a service set, and whether it set one at all. A
+// webhook that was removed is set, to "".
+func (s *WebhookStore) Get(name string) (string, string, bool) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	h, ok := s.hooks[name]
+	return h.Url, h.Secret, ok
+}
+
+// Put sets a service's webhook; an empty url removes it.
+func (s *WebhookStore) Put(name string, url string, secret string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	old, had := s.hooks[name]
+	s.hooks[name] = webhookRequest{url, secret}
+	if err := s.writeNotThreadSafe(); err != nil {
+		if had {
+			s.hooks[name] = old
+		} else {
+			delete(s.hooks, name)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *WebhookStore) writeNotThreadSafe() error {
+	if len(s.SrcPath) == 0 {
+		return nil
+	}
+	bs, err := json.Marshal(s.hooks)
+	if err != nil {
+		return err
+	}
+	tmp := s.SrcPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.SrcPath)
+}